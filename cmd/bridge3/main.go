@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/labstack/echo-contrib/prometheus"
@@ -52,24 +56,6 @@ func main() {
 	}
 	tonAnalytics := tonmetrics.NewAnalyticsClient()
 
-	dbURI := ""
-	store := "memory"
-	if config.Config.Storage != "" {
-		store = config.Config.Storage
-	}
-
-	switch store {
-	case "postgres":
-		log.Info("Using PostgreSQL storage")
-		dbURI = config.Config.PostgresURI
-	case "valkey":
-		log.Info("Using Valkey storage")
-		dbURI = config.Config.ValkeyURI
-	default:
-		log.Info("Using in-memory storage as default")
-		// No URI needed for memory storage
-	}
-
 	collector := analytics.NewCollector(200, tonAnalytics, 500*time.Millisecond)
 	go collector.Run(context.Background())
 
@@ -81,21 +67,31 @@ func main() {
 		config.Config.TonAnalyticsNetworkId,
 	)
 
-	dbConn, err := storagev3.NewStorage(store, dbURI, collector, analyticsBuilder)
-
+	dbConn, err := storagev3.NewStorage(config.Config.Storage, collector, analyticsBuilder)
 	if err != nil {
 		log.Fatalf("failed to create storage: %v", err)
 	}
-	if _, ok := dbConn.(*storagev3.MemStorage); ok {
-		log.Info("Using in-memory storage")
-		app.SetBridgeInfo("bridgev3", "memory")
-	} else if _, ok := dbConn.(*storagev3.ValkeyStorage); ok {
-		log.Info("Using Valkey/Redis storage")
-		app.SetBridgeInfo("bridgev3", "valkey")
-	} else {
-		log.Info("Using PostgreSQL storage")
-		app.SetBridgeInfo("bridgev3", "postgres")
+	log.Infof("Using %s storage", dbConn.Name())
+	app.SetBridgeInfo("bridgev3", dbConn.Name())
+	memStorage, _ := dbConn.(*storagev3.MemStorage)
+	snapshotPath := config.Config.MemorySnapshotPath
+	if memStorage != nil && snapshotPath != "" {
+		if err := memStorage.LoadSnapshot(snapshotPath); err != nil {
+			log.Errorf("failed to load memory snapshot: %v", err)
+		}
+		memStorage.StartSnapshots(snapshotPath, time.Duration(config.Config.MemorySnapshotInterval)*time.Second)
+	}
+	if valkeyStorage, ok := dbConn.(*storagev3.ValkeyStorage); ok && config.Config.ValkeyMigrateKeys {
+		go func() {
+			if _, err := valkeyStorage.MigrateKeys(context.Background(), config.Config.ValkeyMigrateFrom); err != nil {
+				log.Errorf("failed to migrate valkey keys: %v", err)
+			}
+		}()
+	}
+	if config.Config.InboxCacheSize > 0 {
+		dbConn = storagev3.NewCachedStorage(dbConn, config.Config.InboxCacheSize, time.Duration(config.Config.InboxCacheTTL)*time.Second)
 	}
+
 	healthManager := app.NewHealthManager()
 	healthManager.UpdateHealthStatus(dbConn)
 	go healthManager.StartHealthMonitoring(dbConn)
@@ -127,7 +123,7 @@ func main() {
 	e.Use(middleware.Logger())
 	e.Use(middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
 		Skipper: func(c echo.Context) bool {
-			if app.SkipRateLimitsByToken(c.Request()) || c.Path() != "/bridge/message" {
+			if app.SkipRateLimitsByToken(c.Request()) || (c.Path() != "/bridge/message" && c.Path() != "/bridge/messages" && c.Path() != "/bridge/ack") {
 				return true
 			}
 			return false
@@ -135,7 +131,7 @@ func main() {
 		Store: middleware.NewRateLimiterMemoryStore(rate.Limit(config.Config.RPSLimit)),
 	}))
 	e.Use(app.ConnectionsLimitMiddleware(bridge_middleware.NewConnectionLimiter(config.Config.ConnectionsLimit, extractor), func(c echo.Context) bool {
-		if app.SkipRateLimitsByToken(c.Request()) || c.Path() != "/bridge/events" {
+		if app.SkipRateLimitsByToken(c.Request()) || (c.Path() != "/bridge/events" && c.Path() != "/bridge/ws" && c.Path() != "/bridge/poll") {
 			return true
 		}
 		return false
@@ -155,8 +151,12 @@ func main() {
 	h := handlerv3.NewHandler(dbConn, time.Duration(config.Config.HeartbeatInterval)*time.Second, extractor, timeProvider, collector, analyticsBuilder)
 
 	e.GET("/bridge/events", h.EventRegistrationHandler)
+	e.GET("/bridge/ws", h.WebSocketHandler)
+	e.GET("/bridge/poll", h.PollHandler)
 	e.POST("/bridge/message", h.SendMessageHandler)
+	e.POST("/bridge/messages", h.SendMessagesHandler)
 	e.POST("/bridge/verify", h.ConnectVerifyHandler)
+	e.POST("/bridge/ack", h.AckHandler)
 
 	var existedPaths []string
 	for _, r := range e.Routes() {
@@ -166,13 +166,41 @@ func main() {
 		return !slices.Contains(existedPaths, c.Path())
 	})
 	e.Use(p.HandlerFunc)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			// SSE streams do not finish on their own
+			log.Warnf("graceful shutdown timed out: %v", err)
+			_ = e.Close()
+		}
+	}()
+
+	var serveErr error
 	if config.Config.SelfSignedTLS {
 		cert, key, err := utils.GenerateSelfSignedCertificate()
 		if err != nil {
 			log.Fatalf("failed to generate self signed certificate: %v", err)
 		}
-		log.Fatal(e.StartTLS(fmt.Sprintf(":%v", config.Config.Port), cert, key))
+		serveErr = e.StartTLS(fmt.Sprintf(":%v", config.Config.Port), cert, key)
 	} else {
-		log.Fatal(e.Start(fmt.Sprintf(":%v", config.Config.Port)))
+		serveErr = e.Start(fmt.Sprintf(":%v", config.Config.Port))
+	}
+	if !errors.Is(serveErr, http.ErrServerClosed) {
+		log.Fatal(serveErr)
+	}
+	<-shutdownDone
+
+	if memStorage != nil && snapshotPath != "" {
+		if err := memStorage.SaveSnapshot(snapshotPath); err != nil {
+			log.Errorf("failed to save memory snapshot: %v", err)
+		}
 	}
 }
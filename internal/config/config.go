@@ -8,7 +8,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var Config = struct {
+// BridgeConfig holds the bridge settings loaded from the environment
+type BridgeConfig struct {
 	// Core Settings
 	LogLevel     string `env:"LOG_LEVEL" envDefault:"info"`
 	Port         int    `env:"PORT" envDefault:"8081"`
@@ -16,9 +17,29 @@ var Config = struct {
 	PprofEnabled bool   `env:"PPROF_ENABLED" envDefault:"true"`
 
 	// Storage
-	Storage   string `env:"STORAGE" envDefault:"memory"` // For v3 only: memory or valkey
+	Storage   string `env:"STORAGE" envDefault:"memory"` // For v3 only: memory, valkey, postgres or sqlite
 	ValkeyURI string `env:"VALKEY_URI"`
 
+	// SQLite database file for STORAGE=sqlite
+	SqlitePath string `env:"SQLITE_PATH" envDefault:"bridge3.db"`
+
+	// Inbox cache in front of the storage (bridge v3): messages kept in memory per instance, 0 disables it
+	InboxCacheSize int `env:"INBOX_CACHE_SIZE" envDefault:"0"`
+	InboxCacheTTL  int `env:"INBOX_CACHE_TTL" envDefault:"30"`
+
+	// Memory storage snapshot, disabled when the path is empty
+	MemorySnapshotPath     string `env:"MEMORY_SNAPSHOT_PATH"`
+	MemorySnapshotInterval int    `env:"MEMORY_SNAPSHOT_INTERVAL" envDefault:"60"`
+
+	// Valkey topology: standalone, sentinel or cluster; auto-detected when empty
+	ValkeyMode             string `env:"VALKEY_MODE"`
+	ValkeySentinelMaster   string `env:"VALKEY_SENTINEL_MASTER"`
+	ValkeySentinelPassword string `env:"VALKEY_SENTINEL_PASSWORD"`
+	ValkeyReadFromReplicas bool   `env:"VALKEY_READ_FROM_REPLICAS" envDefault:"false"`
+	ValkeyKeyPrefix        string `env:"VALKEY_KEY_PREFIX"` // namespace for deployments sharing one Valkey, empty keeps the legacy key layout
+	ValkeyMigrateKeys      bool   `env:"VALKEY_MIGRATE_KEYS" envDefault:"false"`
+	ValkeyMigrateFrom      string `env:"VALKEY_MIGRATE_FROM_PREFIX"` // prefix the keys are migrated from, empty is the legacy layout
+
 	// PostgreSQL Pool Settings
 	PostgresURI                   string `env:"POSTGRES_URI"`
 	PostgresMaxConns              int32  `env:"POSTGRES_MAX_CONNS" envDefault:"25"`
@@ -36,6 +57,30 @@ var Config = struct {
 	MaxBodySize           int64    `env:"MAX_BODY_SIZE" envDefault:"10485760"` // 10 MB
 	RateLimitsByPassToken []string `env:"RATE_LIMITS_BY_PASS_TOKEN"`
 
+	// Message TTL policy in seconds. Requests without ttl get MESSAGE_TTL_DEFAULT, 0 makes ttl required.
+	// TTL_TOPIC_RULES is a JSON object of per-topic rules, e.g. {"sign":{"max_ttl":60,"max_size":4096}}
+	MessageTTLMin     int64  `env:"MESSAGE_TTL_MIN" envDefault:"0"`
+	MessageTTLMax     int64  `env:"MESSAGE_TTL_MAX" envDefault:"300"`
+	MessageTTLDefault int64  `env:"MESSAGE_TTL_DEFAULT" envDefault:"0"`
+	TTLTopicRules     string `env:"TTL_TOPIC_RULES"`
+
+	// Per-recipient inbox limits, 0 disables a limit. Policy on overflow: reject (newest) or evict (oldest)
+	InboxMaxMessages    int    `env:"INBOX_MAX_MESSAGES" envDefault:"0"`
+	InboxMaxBytes       int64  `env:"INBOX_MAX_BYTES" envDefault:"0"`
+	InboxOverflowPolicy string `env:"INBOX_OVERFLOW_POLICY" envDefault:"reject"`
+
+	// Wait for storage before answering /bridge/message (bridge v3), so storage failures get 503
+	// instead of 200. Senders can also ask for it per request with sync=true. Timeout in seconds.
+	SyncPublish    bool `env:"SYNC_PUBLISH" envDefault:"false"`
+	PublishTimeout int  `env:"PUBLISH_TIMEOUT" envDefault:"5"`
+
+	// Max messages in one /bridge/messages request (bridge v3)
+	BatchMaxMessages int `env:"BATCH_MAX_MESSAGES" envDefault:"100"`
+
+	// What to do with an SSE session that missed messages because it reads too slowly:
+	// "drop" only counts and logs them, "disconnect" also closes the session so the client reconnects
+	SlowConsumerPolicy string `env:"SLOW_CONSUMER_POLICY" envDefault:"drop"`
+
 	// Security
 	CorsEnable         bool     `env:"CORS_ENABLE" envDefault:"true"`
 	TrustedProxyRanges []string `env:"TRUSTED_PROXY_RANGES" envDefault:"0.0.0.0/0"`
@@ -65,7 +110,9 @@ var Config = struct {
 	TonAnalyticsBridgeVersion string `env:"TON_ANALYTICS_BRIDGE_VERSION" envDefault:"1.0.0"` // TODO start using build version
 	TonAnalyticsBridgeURL     string `env:"TON_ANALYTICS_BRIDGE_URL" envDefault:"localhost"`
 	TonAnalyticsNetworkId     string `env:"TON_ANALYTICS_NETWORK_ID" envDefault:"-239"`
-}{}
+}
+
+var Config BridgeConfig
 
 func LoadConfig() {
 	if err := env.Parse(&Config); err != nil {
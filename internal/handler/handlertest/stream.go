@@ -0,0 +1,163 @@
+// Package handlertest provides an event stream test suite shared by the bridge engines,
+// so that SSE clients see the same stream from either of them.
+package handlertest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+const (
+	// eventTimeout bounds how long an event may take to reach the stream
+	eventTimeout = 5 * time.Second
+
+	senderID    = "a3f9c8e21d7b4a5e9c0f6b1d8e72c4fa9b0e1d5c7a6f84b2e93d0c1a5f7e8b42"
+	recipientID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+// Handlers are the endpoints of one engine under test
+type Handlers struct {
+	Events echo.HandlerFunc // GET /bridge/events
+	Send   echo.HandlerFunc // POST /bridge/message
+}
+
+// Factory returns the handlers of a fresh engine with empty storage for one subtest
+type Factory func(t *testing.T) Handlers
+
+// RunStream runs the event stream suite against handlers created by newHandlers
+func RunStream(t *testing.T, newHandlers Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, srv *httptest.Server)
+	}{
+		{"QueueDone", testQueueDone},
+		{"QueueDoneDisabled", testQueueDoneDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandlers(t)
+			e := echo.New()
+			e.GET("/bridge/events", h.Events)
+			e.POST("/bridge/message", h.Send)
+			srv := httptest.NewServer(e)
+			// Registered first so that open streams are cancelled before the server closes
+			t.Cleanup(srv.Close)
+			tt.run(t, srv)
+		})
+	}
+}
+
+// testQueueDone checks that queue_done follows the stored messages, and that stored
+// and live messages carry the IP of the stream connection as connect_source
+func testQueueDone(t *testing.T, srv *httptest.Server) {
+	sendMessage(t, srv.URL, "offline")
+	events := openStream(t, srv.URL, true)
+	assertBridgeMessage(t, nextEvent(t, events), "offline")
+	if data := nextEvent(t, events); data != "queue_done" {
+		t.Fatalf("expected queue_done after the stored messages, got %q", data)
+	}
+	sendMessage(t, srv.URL, "live")
+	assertBridgeMessage(t, nextEvent(t, events), "live")
+}
+
+// testQueueDoneDisabled checks that queue_done is only sent when asked for
+func testQueueDoneDisabled(t *testing.T, srv *httptest.Server) {
+	sendMessage(t, srv.URL, "offline")
+	events := openStream(t, srv.URL, false)
+	assertBridgeMessage(t, nextEvent(t, events), "offline")
+	sendMessage(t, srv.URL, "live")
+	assertBridgeMessage(t, nextEvent(t, events), "live")
+}
+
+func sendMessage(t *testing.T, baseURL, body string) {
+	t.Helper()
+	values := url.Values{}
+	values.Set("client_id", senderID)
+	values.Set("to", recipientID)
+	values.Set("ttl", "60")
+	values.Set("no_request_source", "true")
+	resp, err := http.Post(baseURL+"/bridge/message?"+values.Encode(), "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("send message: expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+// openStream connects to /bridge/events and returns the data of the received events
+func openStream(t *testing.T, baseURL string, queueDone bool) <-chan string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	values := url.Values{}
+	values.Set("client_id", recipientID)
+	if queueDone {
+		values.Set("enable_queue_done_event", "true")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/bridge/events?"+values.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to open event stream: %v", err)
+	}
+
+	events := make(chan string, 10)
+	go func() {
+		defer resp.Body.Close()
+		var data []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimSuffix(scanner.Text(), "\r")
+			if value, ok := strings.CutPrefix(line, "data: "); ok {
+				data = append(data, value)
+			} else if line == "" && len(data) > 0 {
+				events <- strings.Join(data, "\n")
+				data = nil
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan string) string {
+	t.Helper()
+	select {
+	case data := <-events:
+		return data
+	case <-time.After(eventTimeout):
+		t.Fatal("no event received")
+		return ""
+	}
+}
+
+func assertBridgeMessage(t *testing.T, data, body string) {
+	t.Helper()
+	var bridgeMsg models.BridgeMessage
+	if err := json.Unmarshal([]byte(data), &bridgeMsg); err != nil {
+		t.Fatalf("expected a bridge message, got %q", data)
+	}
+	if bridgeMsg.From != senderID {
+		t.Errorf("message from %q, want %q", bridgeMsg.From, senderID)
+	}
+	if bridgeMsg.BridgeConnectSource.IP != "127.0.0.1" {
+		t.Errorf("connect_source = %+v, want the IP of the stream connection", bridgeMsg.BridgeConnectSource)
+	}
+	if bridgeMsg.Message != body {
+		t.Errorf("message %q, want %q", bridgeMsg.Message, body)
+	}
+}
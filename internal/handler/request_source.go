@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ton-connect/bridge/internal/models"
+	"github.com/ton-connect/bridge/internal/utils"
+)
+
+// RequestSource returns the request_source of a message to walletID: the origin, IP,
+// time and user agent of the sending request, encrypted for the wallet so it can warn
+// about phishing. Returns an empty string when the sender opts out with
+// no_request_source=true. An error means the message must not be sent.
+func RequestSource(request *http.Request, params url.Values, realIP *utils.RealIPExtractor, walletID string) (string, error) {
+	noRequestSourceParam, ok := params["no_request_source"]
+	enableRequestSource := !ok || len(noRequestSourceParam) == 0 || strings.ToLower(noRequestSourceParam[0]) != "true"
+	if !enableRequestSource {
+		return "", nil
+	}
+
+	return utils.EncryptRequestSourceWithWalletID(
+		models.BridgeRequestSource{
+			Origin:    utils.ExtractOrigin(request.Header.Get("Origin")),
+			IP:        realIP.Extract(request),
+			Time:      strconv.FormatInt(time.Now().Unix(), 10),
+			UserAgent: request.Header.Get("User-Agent"),
+		},
+		walletID,
+	)
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ton-connect/bridge/internal/models"
+	"github.com/ton-connect/bridge/internal/utils"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestRequestSource(t *testing.T) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	walletID := hex.EncodeToString(publicKey[:])
+	extractor, err := utils.NewRealIPExtractor([]string{})
+	if err != nil {
+		t.Fatalf("failed to create RealIPExtractor: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/bridge/message", nil)
+	req.Header.Set("Origin", "https://dapp.example.com/path")
+	req.Header.Set("User-Agent", "TestAgent/1.0")
+	req.RemoteAddr = "203.0.113.7:1234"
+
+	encrypted, err := RequestSource(req, url.Values{}, extractor, walletID)
+	if err != nil {
+		t.Fatalf("RequestSource() error = %v", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		t.Fatalf("request source is not base64: %v", err)
+	}
+	data, ok := box.OpenAnonymous(nil, sealed, publicKey, privateKey)
+	if !ok {
+		t.Fatal("wallet cannot decrypt the request source")
+	}
+	var source models.BridgeRequestSource
+	if err := json.Unmarshal(data, &source); err != nil {
+		t.Fatalf("failed to decode request source: %v", err)
+	}
+	if source.Origin != "https://dapp.example.com" || source.IP != "203.0.113.7" || source.UserAgent != "TestAgent/1.0" || source.Time == "" {
+		t.Errorf("unexpected request source %+v", source)
+	}
+
+	for _, optOut := range []string{"true", "TRUE"} {
+		got, err := RequestSource(req, url.Values{"no_request_source": {optOut}}, extractor, walletID)
+		if err != nil || got != "" {
+			t.Errorf("RequestSource(no_request_source=%s) = %q, %v, want no request source", optOut, got, err)
+		}
+	}
+	if got, _ := RequestSource(req, url.Values{"no_request_source": {"false"}}, extractor, walletID); got == "" {
+		t.Error("RequestSource(no_request_source=false) returned no request source")
+	}
+
+	if _, err := RequestSource(req, url.Values{}, extractor, "not-a-key"); err == nil {
+		t.Error("RequestSource() expected error for an invalid wallet ID")
+	}
+}
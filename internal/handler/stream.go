@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+// QueueDoneEvent is sent once the messages stored while the client was offline have
+// been replayed, to SSE clients that connect with enable_queue_done_event=true
+const QueueDoneEvent = "event: message\r\ndata: queue_done\r\n\r\n"
+
+// QueueDoneEnabled reports whether the enable_queue_done_event parameter asks for QueueDoneEvent
+func QueueDoneEnabled(param string) bool {
+	return strings.ToLower(param) == "true"
+}
+
+// WithConnectSource sets the connect_source of a stored bridge message to the IP the
+// receiving client connected from. Returns the message to send and the decoded bridge
+// message, or the message unchanged and nil if it is not a bridge message.
+func WithConnectSource(message []byte, connectIP string) ([]byte, *models.BridgeMessage) {
+	var bridgeMsg models.BridgeMessage
+	if err := json.Unmarshal(message, &bridgeMsg); err != nil {
+		return message, nil
+	}
+	bridgeMsg.BridgeConnectSource = models.BridgeConnectSource{
+		IP: connectIP,
+	}
+	modifiedMessage, err := json.Marshal(bridgeMsg)
+	if err != nil {
+		return message, &bridgeMsg
+	}
+	return modifiedMessage, &bridgeMsg
+}
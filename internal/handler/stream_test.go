@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+func TestWithConnectSource(t *testing.T) {
+	message, err := json.Marshal(models.BridgeMessage{From: "sender", Message: "payload", TraceId: "trace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enriched, bridgeMsg := WithConnectSource(message, "192.0.2.1")
+	if bridgeMsg == nil || bridgeMsg.From != "sender" || bridgeMsg.TraceId != "trace" {
+		t.Fatalf("WithConnectSource() decoded %+v", bridgeMsg)
+	}
+	var sent models.BridgeMessage
+	if err := json.Unmarshal(enriched, &sent); err != nil {
+		t.Fatalf("enriched message is not a bridge message: %v", err)
+	}
+	if sent.BridgeConnectSource.IP != "192.0.2.1" || sent.Message != "payload" {
+		t.Errorf("WithConnectSource() = %s", enriched)
+	}
+
+	if raw, bridgeMsg := WithConnectSource([]byte("not json"), "192.0.2.1"); bridgeMsg != nil || string(raw) != "not json" {
+		t.Errorf("WithConnectSource() changed a message that is not a bridge message: %s", raw)
+	}
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/ton-connect/bridge/internal/config"
+)
+
+// DefaultMaxTTL is the maximum TTL in seconds when MESSAGE_TTL_MAX is not set
+const DefaultMaxTTL = 300
+
+// TTLRule limits the messages of one topic. Zero values leave a limit unset.
+type TTLRule struct {
+	MaxTTL int64 `json:"max_ttl,omitempty"` // replaces MESSAGE_TTL_MAX for the topic
+	// ForceTTL replaces the requested TTL once the message is validated,
+	// for messages smaller than ForceTTLUnderSize bytes if that is set
+	ForceTTL          int64 `json:"force_ttl,omitempty"`
+	ForceTTLUnderSize int   `json:"force_ttl_under_size,omitempty"`
+	MaxSize           int   `json:"max_size,omitempty"` // larger message bodies are rejected
+}
+
+// TTLPolicy decides the TTL of sent messages. Both bridge engines apply it the same
+// way: Validate checks the request before anything is sent and Apply replaces the
+// TTL of topics with a forced one.
+type TTLPolicy struct {
+	MinTTL     int64
+	MaxTTL     int64
+	DefaultTTL int64 // used when the request has no ttl, 0 makes ttl required
+	Topics     map[string]TTLRule
+}
+
+// TTLPolicyError is a request rejected by the policy; the message names the violated rule
+type TTLPolicyError struct {
+	Rule    string
+	Message string
+}
+
+func (e *TTLPolicyError) Error() string {
+	return e.Message
+}
+
+// TTLPolicyFromConfig builds the policy from MESSAGE_TTL_* and TTL_TOPIC_RULES.
+// Unless TTL_TOPIC_RULES has a "disconnect" rule, disconnect events get
+// DISCONNECT_EVENTS_TTL when smaller than DISCONNECT_EVENT_MAX_SIZE.
+func TTLPolicyFromConfig() (*TTLPolicy, error) {
+	topics := make(map[string]TTLRule)
+	if config.Config.TTLTopicRules != "" {
+		if err := json.Unmarshal([]byte(config.Config.TTLTopicRules), &topics); err != nil {
+			return nil, fmt.Errorf("failed to parse TTL_TOPIC_RULES: %w", err)
+		}
+	}
+	if _, ok := topics["disconnect"]; !ok {
+		topics["disconnect"] = TTLRule{
+			ForceTTL:          config.Config.DisconnectEventsTTL,
+			ForceTTLUnderSize: config.Config.DisconnectEventMaxSize,
+		}
+	}
+	maxTTL := config.Config.MessageTTLMax
+	if maxTTL == 0 {
+		maxTTL = DefaultMaxTTL
+	}
+	return NewTTLPolicy(config.Config.MessageTTLMin, maxTTL, config.Config.MessageTTLDefault, topics)
+}
+
+// NewTTLPolicy checks that the limits are consistent
+func NewTTLPolicy(minTTL, maxTTL, defaultTTL int64, topics map[string]TTLRule) (*TTLPolicy, error) {
+	if minTTL < 0 || maxTTL < minTTL {
+		return nil, fmt.Errorf("invalid TTL limits: MESSAGE_TTL_MIN %d, MESSAGE_TTL_MAX %d", minTTL, maxTTL)
+	}
+	if defaultTTL != 0 && (defaultTTL < minTTL || defaultTTL > maxTTL) {
+		return nil, fmt.Errorf("MESSAGE_TTL_DEFAULT %d is outside [%d, %d]", defaultTTL, minTTL, maxTTL)
+	}
+	for topic, rule := range topics {
+		if rule.MaxTTL < 0 || rule.ForceTTL < 0 || rule.ForceTTLUnderSize < 0 || rule.MaxSize < 0 {
+			return nil, fmt.Errorf("invalid TTL rule for topic %q: negative limit", topic)
+		}
+		if rule.MaxTTL != 0 && rule.MaxTTL < minTTL {
+			return nil, fmt.Errorf("invalid TTL rule for topic %q: max_ttl %d is below MESSAGE_TTL_MIN %d", topic, rule.MaxTTL, minTTL)
+		}
+	}
+	return &TTLPolicy{MinTTL: minTTL, MaxTTL: maxTTL, DefaultTTL: defaultTTL, Topics: topics}, nil
+}
+
+// Validate checks the requested TTL and body size of a message to topic and returns
+// the TTL to use. ttlParam is the raw "ttl" parameter, empty when it was not sent.
+func (p *TTLPolicy) Validate(topic, ttlParam string, size int) (int64, error) {
+	rule, hasRule := p.Topics[topic]
+
+	ttl := p.DefaultTTL
+	if ttlParam == "" {
+		if ttl == 0 {
+			return 0, &TTLPolicyError{Rule: "MESSAGE_TTL_DEFAULT", Message: "param \"ttl\" not present"}
+		}
+	} else {
+		var err error
+		ttl, err = strconv.ParseInt(ttlParam, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if ttl < p.MinTTL {
+		return 0, &TTLPolicyError{
+			Rule:    "MESSAGE_TTL_MIN",
+			Message: fmt.Sprintf("param \"ttl\" too low: %d is below MESSAGE_TTL_MIN %d", ttl, p.MinTTL),
+		}
+	}
+	if hasRule && rule.MaxTTL != 0 {
+		if ttl > rule.MaxTTL {
+			return 0, &TTLPolicyError{
+				Rule:    "max_ttl",
+				Message: fmt.Sprintf("param \"ttl\" too high: %d exceeds max_ttl %d of topic %q", ttl, rule.MaxTTL, topic),
+			}
+		}
+	} else if ttl > p.MaxTTL {
+		return 0, &TTLPolicyError{
+			Rule:    "MESSAGE_TTL_MAX",
+			Message: fmt.Sprintf("param \"ttl\" too high: %d exceeds MESSAGE_TTL_MAX %d", ttl, p.MaxTTL),
+		}
+	}
+	if hasRule && rule.MaxSize != 0 && size > rule.MaxSize {
+		return 0, &TTLPolicyError{
+			Rule:    "max_size",
+			Message: fmt.Sprintf("message too large: %d bytes exceed max_size %d of topic %q", size, rule.MaxSize, topic),
+		}
+	}
+	return ttl, nil
+}
+
+// Apply returns the TTL to store a validated message with, given the size of the
+// stored message
+func (p *TTLPolicy) Apply(topic string, ttl int64, size int) int64 {
+	rule, ok := p.Topics[topic]
+	if !ok || rule.ForceTTL == 0 {
+		return ttl
+	}
+	if rule.ForceTTLUnderSize != 0 && size >= rule.ForceTTLUnderSize {
+		return ttl
+	}
+	return rule.ForceTTL
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ton-connect/bridge/internal/config"
+)
+
+func TestTTLPolicy_Validate(t *testing.T) {
+	policy, err := NewTTLPolicy(10, 300, 0, map[string]TTLRule{
+		"sign":    {MaxTTL: 60, MaxSize: 100},
+		"archive": {MaxTTL: 3600},
+	})
+	if err != nil {
+		t.Fatalf("NewTTLPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		topic    string
+		ttl      string
+		size     int
+		want     int64
+		wantRule string
+	}{
+		{name: "within global limits", ttl: "300", want: 300},
+		{name: "missing ttl without default", ttl: "", wantRule: "MESSAGE_TTL_DEFAULT"},
+		{name: "below global minimum", ttl: "5", wantRule: "MESSAGE_TTL_MIN"},
+		{name: "above global maximum", ttl: "301", wantRule: "MESSAGE_TTL_MAX"},
+		{name: "above topic maximum", topic: "sign", ttl: "61", wantRule: "max_ttl"},
+		{name: "topic maximum above global one", topic: "archive", ttl: "3600", want: 3600},
+		{name: "topic body too large", topic: "sign", ttl: "60", size: 101, wantRule: "max_size"},
+		{name: "topic body at limit", topic: "sign", ttl: "60", size: 100, want: 60},
+		{name: "size limit of other topic", ttl: "60", size: 101, want: 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := policy.Validate(tt.topic, tt.ttl, tt.size)
+			if tt.wantRule != "" {
+				var policyErr *TTLPolicyError
+				if !errors.As(err, &policyErr) || policyErr.Rule != tt.wantRule {
+					t.Fatalf("Validate() error = %v, want violation of %s", err, tt.wantRule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Validate() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := policy.Validate("", "abc", 0); err == nil {
+		t.Error("Validate() accepted a non-numeric ttl")
+	}
+
+	withDefault, err := NewTTLPolicy(0, 300, 120, nil)
+	if err != nil {
+		t.Fatalf("NewTTLPolicy() error = %v", err)
+	}
+	if got, err := withDefault.Validate("", "", 0); err != nil || got != 120 {
+		t.Errorf("Validate() = %d, %v, want the default TTL 120", got, err)
+	}
+}
+
+func TestTTLPolicy_Apply(t *testing.T) {
+	policy, err := NewTTLPolicy(0, 300, 0, map[string]TTLRule{
+		"disconnect": {ForceTTL: 3600, ForceTTLUnderSize: 512},
+		"ping":       {ForceTTL: 5},
+	})
+	if err != nil {
+		t.Fatalf("NewTTLPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		topic string
+		size  int
+		want  int64
+	}{
+		{topic: "disconnect", size: 511, want: 3600},
+		{topic: "disconnect", size: 512, want: 60},
+		{topic: "ping", size: 1 << 20, want: 5},
+		{topic: "other", size: 10, want: 60},
+	}
+	for _, tt := range tests {
+		if got := policy.Apply(tt.topic, 60, tt.size); got != tt.want {
+			t.Errorf("Apply(%q, 60, %d) = %d, want %d", tt.topic, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestTTLPolicyFromConfig(t *testing.T) {
+	saved := config.Config
+	defer func() { config.Config = saved }()
+
+	config.Config.MessageTTLMax = 0
+	config.Config.DisconnectEventsTTL = 3600
+	config.Config.DisconnectEventMaxSize = 512
+	policy, err := TTLPolicyFromConfig()
+	if err != nil {
+		t.Fatalf("TTLPolicyFromConfig() error = %v", err)
+	}
+	if policy.MaxTTL != DefaultMaxTTL {
+		t.Errorf("MaxTTL = %d, want %d", policy.MaxTTL, DefaultMaxTTL)
+	}
+	if got := policy.Apply("disconnect", 60, 100); got != 3600 {
+		t.Errorf("disconnect events get TTL %d, want DISCONNECT_EVENTS_TTL 3600", got)
+	}
+
+	config.Config.TTLTopicRules = `{"disconnect":{"force_ttl":600},"sign":{"max_ttl":60,"max_size":4096}}`
+	policy, err = TTLPolicyFromConfig()
+	if err != nil {
+		t.Fatalf("TTLPolicyFromConfig() error = %v", err)
+	}
+	if got := policy.Apply("disconnect", 60, 1000); got != 600 {
+		t.Errorf("disconnect events get TTL %d, want the configured 600", got)
+	}
+	if want := (TTLRule{MaxTTL: 60, MaxSize: 4096}); policy.Topics["sign"] != want {
+		t.Errorf("sign rule = %+v, want %+v", policy.Topics["sign"], want)
+	}
+
+	invalid := []struct {
+		name  string
+		setup func()
+	}{
+		{name: "malformed rules", setup: func() { config.Config.TTLTopicRules = `{"sign":` }},
+		{name: "negative limit", setup: func() { config.Config.TTLTopicRules = `{"sign":{"max_size":-1}}` }},
+		{name: "min above max", setup: func() { config.Config.MessageTTLMin = 400 }},
+		{name: "default above max", setup: func() { config.Config.MessageTTLDefault = 301 }},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config = saved
+			tt.setup()
+			if _, err := TTLPolicyFromConfig(); err == nil {
+				t.Error("TTLPolicyFromConfig() expected error")
+			}
+		})
+	}
+}
@@ -4,6 +4,9 @@ type SseMessage struct {
 	EventId int64
 	Message []byte
 	To      string
+	// ExpireAt is when the stored message expires (unix seconds), 0 when unknown.
+	// Bridge v3 storages set it so inbox caches know how long to keep the message.
+	ExpireAt int64 `json:",omitempty"`
 }
 
 type BridgeMessage struct {
@@ -0,0 +1,4 @@
+BEGIN;
+drop index if exists bridge.messages_event_id_index;
+drop table if exists bridge.connections;
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+create table if not exists bridge.connections
+(
+    client_id                 text                 not null,
+    ip                        text                 not null,
+    origin                    text                 not null,
+    user_agent                text                 not null,
+    end_time                  timestamp            not null,
+    primary key (client_id, ip, origin)
+);
+
+create index if not exists messages_event_id_index
+    on bridge.messages (event_id);
+
+create index if not exists connections_end_time_index
+    on bridge.connections (end_time);
+
+COMMIT;
@@ -0,0 +1,3 @@
+BEGIN;
+alter table bridge.messages drop column if exists delivered;
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+alter table bridge.messages
+    add column if not exists delivered boolean not null default false;
+
+COMMIT;
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/config"
+)
+
+//go:embed migrations/*.sql
+var fs embed.FS
+
+// MigrateDb applies the bridge schema migrations shared by all PostgreSQL-backed engines
+func MigrateDb(postgresURI string) error {
+	log := logrus.WithField("prefix", "MigrateDb")
+	d, err := iofs.New(fs, "migrations")
+	if err != nil {
+		log.Info("iofs err: ", err)
+		return err
+	}
+	m, err := migrate.NewWithSourceInstance("iofs", d, postgresURI)
+	if err != nil {
+		log.Info("source instance err: ", err)
+		return err
+	}
+	err = m.Up()
+	if errors.Is(err, migrate.ErrNoChange) {
+		log.Info("DB is up to date")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	log.Info("DB updated successfully")
+	return nil
+}
+
+// ConfigurePoolSettings creates a new pgxpool.Config with settings from environment variables
+// See https://pkg.go.dev/github.com/jackc/pgx/v4/pgxpool#ParseConfig
+func ConfigurePoolSettings(postgresURI string) (*pgxpool.Config, error) {
+	log := logrus.WithField("prefix", "ConfigurePoolSettings")
+
+	// Parse the base connection config
+	poolConfig, err := pgxpool.ParseConfig(postgresURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse postgres URI: %w", err)
+	}
+
+	// Apply pool configuration from environment variables
+	poolConfig.MaxConns = config.Config.PostgresMaxConns
+	poolConfig.MinConns = config.Config.PostgresMinConns
+
+	// Parse duration strings for timeout settings
+	if maxLifetime, err := time.ParseDuration(config.Config.PostgresMaxConnLifetime); err == nil {
+		poolConfig.MaxConnLifetime = maxLifetime
+	} else {
+		log.Warnf("Invalid PostgresMaxConnLifetime '%s', using default", config.Config.PostgresMaxConnLifetime)
+	}
+
+	if maxLifetimeJitter, err := time.ParseDuration(config.Config.PostgresMaxConnLifetimeJitter); err == nil {
+		poolConfig.MaxConnLifetimeJitter = maxLifetimeJitter
+	} else {
+		log.Warnf("Invalid PostgresMaxConnLifetimeJitter '%s', using default", config.Config.PostgresMaxConnLifetimeJitter)
+	}
+
+	if maxIdleTime, err := time.ParseDuration(config.Config.PostgresMaxConnIdleTime); err == nil {
+		poolConfig.MaxConnIdleTime = maxIdleTime
+	} else {
+		log.Warnf("Invalid PostgresMaxConnIdleTime '%s', using default", config.Config.PostgresMaxConnIdleTime)
+	}
+
+	if healthCheckPeriod, err := time.ParseDuration(config.Config.PostgresHealthCheckPeriod); err == nil {
+		poolConfig.HealthCheckPeriod = healthCheckPeriod
+	} else {
+		log.Warnf("Invalid PostgresHealthCheckPeriod '%s', using default", config.Config.PostgresHealthCheckPeriod)
+	}
+
+	poolConfig.LazyConnect = config.Config.PostgresLazyConnect
+
+	return poolConfig, nil
+}
@@ -105,10 +105,10 @@ func TestConfigurePoolSettings(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.setup()
 
-			poolConfig, err := configurePoolSettings(tt.uri)
+			poolConfig, err := ConfigurePoolSettings(tt.uri)
 
 			if (err != nil) != tt.wantErr {
-				t.Errorf("configurePoolSettings() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("ConfigurePoolSettings() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 
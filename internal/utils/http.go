@@ -11,6 +11,7 @@ import (
 type HttpRes struct {
 	Message    string `json:"message,omitempty" example:"status ok"`
 	StatusCode int    `json:"statusCode,omitempty" example:"200"`
+	Code       string `json:"code,omitempty" example:"storage_unavailable"` // machine-readable error, set for errors a client may retry
 }
 
 func HttpResOk() HttpRes {
@@ -27,6 +28,15 @@ func HttpResError(errMsg string, statusCode int) (int, HttpRes) {
 	}
 }
 
+// HttpResErrorCode is HttpResError with a machine-readable error code
+func HttpResErrorCode(errMsg string, code string, statusCode int) (int, HttpRes) {
+	return statusCode, HttpRes{
+		Message:    errMsg,
+		StatusCode: statusCode,
+		Code:       code,
+	}
+}
+
 func ExtractOrigin(rawURL string) string {
 	if rawURL == "" {
 		return ""
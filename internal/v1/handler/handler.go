@@ -83,9 +83,14 @@ type handler struct {
 	realIP            *utils.RealIPExtractor
 	eventCollector    analytics.EventCollector
 	eventBuilder      analytics.EventBuilder
+	ttlPolicy         *handler_common.TTLPolicy
 }
 
 func NewHandler(db storage.Storage, heartbeatInterval time.Duration, extractor *utils.RealIPExtractor, collector analytics.EventCollector, builder analytics.EventBuilder) *handler {
+	ttlPolicy, err := handler_common.TTLPolicyFromConfig()
+	if err != nil {
+		logrus.Fatalf("invalid TTL policy: %v", err)
+	}
 	connectionCache := NewConnectionCache(config.Config.ConnectCacheSize, time.Duration(config.Config.ConnectCacheTTL)*time.Second)
 	connectionCache.StartBackgroundCleanup(nil)
 
@@ -99,6 +104,7 @@ func NewHandler(db storage.Storage, heartbeatInterval time.Duration, extractor *
 		realIP:            extractor,
 		eventCollector:    collector,
 		eventBuilder:      builder,
+		ttlPolicy:         ttlPolicy,
 	}
 	return &h
 }
@@ -144,10 +150,8 @@ func (h *handler) EventRegistrationHandler(c echo.Context) error {
 		return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
 	}
 
-	enableQueueDoneEvent := false
-	if queueDoneParam, exists := paramsStore.Get("enable_queue_done_event"); exists && strings.ToLower(queueDoneParam) == "true" {
-		enableQueueDoneEvent = true
-	}
+	queueDoneParam, _ := paramsStore.Get("enable_queue_done_event")
+	enableQueueDoneEvent := handler_common.QueueDoneEnabled(queueDoneParam)
 
 	var lastEventId int64
 	lastEventIDStr := c.Request().Header.Get("Last-Event-ID")
@@ -217,20 +221,13 @@ func (h *handler) EventRegistrationHandler(c echo.Context) error {
 
 	for msg := range session.MessageCh {
 
-		// Parse the message, add BridgeConnectSource, keep it for later logging
-		var bridgeMsg models.BridgeMessage
+		// Add BridgeConnectSource, keep the parsed message for later logging
 		fromID := "unknown"
 		traceID := ""
-		messageToSend := msg.Message
-		if err := json.Unmarshal(msg.Message, &bridgeMsg); err == nil {
+		messageToSend, bridgeMsg := handler_common.WithConnectSource(msg.Message, connectIP)
+		if bridgeMsg != nil {
 			fromID = bridgeMsg.From
 			traceID = bridgeMsg.TraceId
-			bridgeMsg.BridgeConnectSource = models.BridgeConnectSource{
-				IP: connectIP,
-			}
-			if modifiedMessage, err := json.Marshal(bridgeMsg); err == nil {
-				messageToSend = modifiedMessage
-			}
 		}
 
 		var sseMessage string
@@ -320,30 +317,19 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 		return h.logMessageSentValidationFailure(c, err.Error(), clientID.String(), traceId, "", "")
 	}
 
-	ttlParam, ok := params["ttl"]
-	if !ok {
-		badRequestMetric.Inc()
-		errorMsg := "param \"ttl\" not present"
-		log.Error(errorMsg)
-		return h.logMessageSentValidationFailure(c, errorMsg, clientID.String(), traceId, "", "")
-	}
-	ttl, err := strconv.ParseInt(ttlParam[0], 10, 32)
+	message, err := io.ReadAll(c.Request().Body)
 	if err != nil {
 		badRequestMetric.Inc()
 		log.Error(err)
 		return h.logMessageSentValidationFailure(c, err.Error(), clientID.String(), traceId, "", "")
 	}
-	if ttl > 300 { // TODO: config
-		badRequestMetric.Inc()
-		errorMsg := "param \"ttl\" too high"
-		log.Error(errorMsg)
-		return h.logMessageSentValidationFailure(c, errorMsg, clientID.String(), traceId, "", "")
-	}
-	message, err := io.ReadAll(c.Request().Body)
+
+	topic := params.Get("topic")
+	ttl, err := h.ttlPolicy.Validate(topic, params.Get("ttl"), len(message))
 	if err != nil {
 		badRequestMetric.Inc()
 		log.Error(err)
-		return h.logMessageSentValidationFailure(c, err.Error(), clientID.String(), traceId, "", "")
+		return h.logMessageSentValidationFailure(c, err.Error(), clientID.String(), traceId, topic, "")
 	}
 
 	data := append(message, []byte(clientID.String())...)
@@ -367,46 +353,24 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 			http.DefaultClient.Do(req) //nolint:errcheck// TODO review golangci-lint issue
 		}()
 	}
-	topicParam, ok := params["topic"]
-	topic := ""
-	if ok {
-		topic = topicParam[0]
+	if _, ok := params["topic"]; ok {
 		go func(clientID, topic, message string) {
 			handler_common.SendWebhook(clientID, handler_common.WebhookData{Topic: topic, Hash: message})
 		}(clientID.String(), topic, string(message))
 	}
 
-	var requestSource string
-	noRequestSourceParam, ok := params["no_request_source"]
-	enableRequestSource := !ok || len(noRequestSourceParam) == 0 || strings.ToLower(noRequestSourceParam[0]) != "true"
-
-	if enableRequestSource {
-		origin := utils.ExtractOrigin(c.Request().Header.Get("Origin"))
-		ip := h.realIP.Extract(c.Request())
-		userAgent := c.Request().Header.Get("User-Agent")
-
-		encryptedRequestSource, err := utils.EncryptRequestSourceWithWalletID(
-			models.BridgeRequestSource{
-				Origin:    origin,
-				IP:        ip,
-				Time:      strconv.FormatInt(time.Now().Unix(), 10),
-				UserAgent: userAgent,
-			},
-			toId.String(),
+	requestSource, err := handler_common.RequestSource(c.Request(), params, h.realIP, toId.String())
+	if err != nil {
+		badRequestMetric.Inc()
+		log.Error(err)
+		return h.logMessageSentValidationFailure(
+			c,
+			fmt.Sprintf("failed to encrypt request source: %v", err),
+			clientID.String(),
+			traceId,
+			topic,
+			"",
 		)
-		if err != nil {
-			badRequestMetric.Inc()
-			log.Error(err)
-			return h.logMessageSentValidationFailure(
-				c,
-				fmt.Sprintf("failed to encrypt request source: %v", err),
-				clientID.String(),
-				traceId,
-				topic,
-				"",
-			)
-		}
-		requestSource = encryptedRequestSource
 	}
 
 	mes, err := json.Marshal(models.BridgeMessage{
@@ -421,9 +385,7 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 		return h.logMessageSentValidationFailure(c, err.Error(), clientID.String(), traceId, topic, "")
 	}
 
-	if topic == "disconnect" && len(mes) < config.Config.DisconnectEventMaxSize {
-		ttl = config.Config.DisconnectEventsTTL
-	}
+	ttl = h.ttlPolicy.Apply(topic, ttl, len(mes))
 
 	sseMessage := models.SseMessage{
 		EventId: h.nextID(),
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/ton-connect/bridge/internal/handler/handlertest"
 	"github.com/ton-connect/bridge/internal/utils"
 	"github.com/ton-connect/bridge/internal/v1/storage"
 )
@@ -67,7 +68,7 @@ func TestHandler(t *testing.T) {
 		},
 		"ttl too high": {
 			expectedStatus: http.StatusBadRequest,
-			expectedBody:   []string{`"message":"param \"ttl\" too high"`},
+			expectedBody:   []string{`"message":"param \"ttl\" too high: 500 exceeds MESSAGE_TTL_MAX 300"`},
 			rqParams: map[string]string{
 				"client_id": defaultClientID,
 				"to":        defaultToID,
@@ -185,3 +186,14 @@ func TestHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestEventStream(t *testing.T) {
+	handlertest.RunStream(t, func(t *testing.T) handlertest.Handlers {
+		extractor, err := utils.NewRealIPExtractor([]string{})
+		if err != nil {
+			t.Fatalf("failed to create RealIPExtractor: %v", err)
+		}
+		h := NewHandler(storage.NewMemStorage(nil, nil), time.Minute, extractor, nil, nil)
+		return handlertest.Handlers{Events: h.EventRegistrationHandler, Send: h.SendMessageHandler}
+	})
+}
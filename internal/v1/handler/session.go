@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	handler_common "github.com/ton-connect/bridge/internal/handler"
 	"github.com/ton-connect/bridge/internal/models"
 	"github.com/ton-connect/bridge/internal/v1/storage"
 )
@@ -86,7 +87,7 @@ func (s *Session) retrieveHistoricMessages(wg *sync.WaitGroup, log *logrus.Entry
 	}
 
 	if doneEvent {
-		s.MessageCh <- models.SseMessage{EventId: -1, Message: []byte("event: message\r\ndata: queue_done\r\n\r\n")}
+		s.MessageCh <- models.SseMessage{EventId: -1, Message: []byte(handler_common.QueueDoneEvent)}
 	}
 }
 
@@ -3,23 +3,17 @@ package storage
 import (
 	"context"
 	"crypto/sha256"
-	"embed"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"time"
 
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
 	"github.com/ton-connect/bridge/internal/analytics"
-	"github.com/ton-connect/bridge/internal/config"
 	"github.com/ton-connect/bridge/internal/models"
+	common_storage "github.com/ton-connect/bridge/internal/storage"
 )
 
 var (
@@ -44,84 +38,13 @@ type PgStorage struct {
 	eventBuilder analytics.EventBuilder
 }
 
-//go:embed migrations/*.sql
-var fs embed.FS
-
-func MigrateDb(postgresURI string) error {
-	log := logrus.WithField("prefix", "MigrateDb")
-	d, err := iofs.New(fs, "migrations")
-	if err != nil {
-		log.Info("iofs err: ", err)
-		return err
-	}
-	m, err := migrate.NewWithSourceInstance("iofs", d, postgresURI)
-	if err != nil {
-		log.Info("source instance err: ", err)
-		return err
-	}
-	err = m.Up()
-	if errors.Is(err, migrate.ErrNoChange) {
-		log.Info("DB is up to date")
-		return nil
-	} else if err != nil {
-		return err
-	}
-	log.Info("DB updated successfully")
-	return nil
-}
-
-// configurePoolSettings creates a new pgxpool.Config with settings from environment variables
-// See https://pkg.go.dev/github.com/jackc/pgx/v4/pgxpool#ParseConfig
-func configurePoolSettings(postgresURI string) (*pgxpool.Config, error) {
-	log := logrus.WithField("prefix", "configurePoolSettings")
-
-	// Parse the base connection config
-	poolConfig, err := pgxpool.ParseConfig(postgresURI)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse postgres URI: %w", err)
-	}
-
-	// Apply pool configuration from environment variables
-	poolConfig.MaxConns = config.Config.PostgresMaxConns
-	poolConfig.MinConns = config.Config.PostgresMinConns
-
-	// Parse duration strings for timeout settings
-	if maxLifetime, err := time.ParseDuration(config.Config.PostgresMaxConnLifetime); err == nil {
-		poolConfig.MaxConnLifetime = maxLifetime
-	} else {
-		log.Warnf("Invalid PostgresMaxConnLifetime '%s', using default", config.Config.PostgresMaxConnLifetime)
-	}
-
-	if maxLifetimeJitter, err := time.ParseDuration(config.Config.PostgresMaxConnLifetimeJitter); err == nil {
-		poolConfig.MaxConnLifetimeJitter = maxLifetimeJitter
-	} else {
-		log.Warnf("Invalid PostgresMaxConnLifetimeJitter '%s', using default", config.Config.PostgresMaxConnLifetimeJitter)
-	}
-
-	if maxIdleTime, err := time.ParseDuration(config.Config.PostgresMaxConnIdleTime); err == nil {
-		poolConfig.MaxConnIdleTime = maxIdleTime
-	} else {
-		log.Warnf("Invalid PostgresMaxConnIdleTime '%s', using default", config.Config.PostgresMaxConnIdleTime)
-	}
-
-	if healthCheckPeriod, err := time.ParseDuration(config.Config.PostgresHealthCheckPeriod); err == nil {
-		poolConfig.HealthCheckPeriod = healthCheckPeriod
-	} else {
-		log.Warnf("Invalid PostgresHealthCheckPeriod '%s', using default", config.Config.PostgresHealthCheckPeriod)
-	}
-
-	poolConfig.LazyConnect = config.Config.PostgresLazyConnect
-
-	return poolConfig, nil
-}
-
 func NewPgStorage(postgresURI string, collector analytics.EventCollector, builder analytics.EventBuilder) (*PgStorage, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	log := logrus.WithField("prefix", "NewStorage")
 	defer cancel()
 
 	// Create configured pool config
-	poolConfig, err := configurePoolSettings(postgresURI)
+	poolConfig, err := common_storage.ConfigurePoolSettings(postgresURI)
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +55,7 @@ func NewPgStorage(postgresURI string, collector analytics.EventCollector, builde
 		return nil, err
 	}
 
-	err = MigrateDb(postgresURI)
+	err = common_storage.MigrateDb(postgresURI)
 	if err != nil {
 		log.Info("migrte err: ", err)
 		return nil, err
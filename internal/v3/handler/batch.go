@@ -0,0 +1,213 @@
+package handlerv3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/config"
+	handler_common "github.com/ton-connect/bridge/internal/handler"
+	"github.com/ton-connect/bridge/internal/models"
+	"github.com/ton-connect/bridge/internal/utils"
+	storagev3 "github.com/ton-connect/bridge/internal/v3/storage"
+)
+
+// defaultBatchMaxMessages limits a batch when BATCH_MAX_MESSAGES is not set
+const defaultBatchMaxMessages = 100
+
+// batchMessage is one message of a POST /bridge/messages body
+type batchMessage struct {
+	To      string      `json:"to"`
+	TTL     json.Number `json:"ttl"`
+	Topic   string      `json:"topic"`
+	Message string      `json:"message"`
+}
+
+// batchResult is the outcome of one batch message, in the order of the request
+type batchResult struct {
+	To         string `json:"to"`
+	EventID    int64  `json:"event_id,omitempty"`
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message,omitempty"`
+	Code       string `json:"code,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// SendMessagesHandler sends a JSON array of messages from one client_id. Each message is
+// validated like a /bridge/message request and gets its own result; valid messages are
+// published together, waiting for storage like SYNC_PUBLISH.
+func (h *handler) SendMessagesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	log := logrus.WithContext(ctx).WithField("prefix", "SendMessagesHandler")
+
+	params := c.QueryParams()
+
+	traceIdParam, hasTraceId := params["trace_id"]
+	traceIdValue := ""
+	if hasTraceId && len(traceIdParam) > 0 {
+		traceIdValue = traceIdParam[0]
+	}
+	hasTraceId = hasTraceId && len(traceIdParam) > 0
+
+	clientIdValues, ok := params["client_id"]
+	if !ok {
+		badRequestMetric.Inc()
+		errorMsg := "param \"client_id\" not present"
+		log.Error(errorMsg)
+		return h.failValidation(c, errorMsg, "", traceIdValue, "", "")
+	}
+	clientID, err := utils.NewPublicAddressFromString(clientIdValues[0])
+	if err != nil {
+		err = fmt.Errorf("failed to parse the \"client_id\" address: %w", err)
+		badRequestMetric.Inc()
+		log.Error(err)
+		return h.failValidation(c, err.Error(), clientIdValues[0], traceIdValue, "", "")
+	}
+
+	body := io.Reader(c.Request().Body)
+	if config.Config.MaxBodySize > 0 {
+		body = io.LimitReader(body, config.Config.MaxBodySize+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		badRequestMetric.Inc()
+		log.Error(err)
+		return h.failValidation(c, err.Error(), clientID.String(), traceIdValue, "", "")
+	}
+	if config.Config.MaxBodySize > 0 && int64(len(data)) > config.Config.MaxBodySize {
+		badRequestMetric.Inc()
+		errorMsg := fmt.Sprintf("request body exceeds MAX_BODY_SIZE %d", config.Config.MaxBodySize)
+		log.Error(errorMsg)
+		return h.failValidation(c, errorMsg, clientID.String(), traceIdValue, "", "")
+	}
+
+	var items []batchMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		badRequestMetric.Inc()
+		errorMsg := fmt.Sprintf("body must be a JSON array of messages: %v", err)
+		log.Error(errorMsg)
+		return h.failValidation(c, errorMsg, clientID.String(), traceIdValue, "", "")
+	}
+	maxMessages := config.Config.BatchMaxMessages
+	if maxMessages <= 0 {
+		maxMessages = defaultBatchMaxMessages
+	}
+	if len(items) == 0 || len(items) > maxMessages {
+		badRequestMetric.Inc()
+		errorMsg := fmt.Sprintf("batch must have 1 to %d messages, got %d", maxMessages, len(items))
+		log.Error(errorMsg)
+		return h.failValidation(c, errorMsg, clientID.String(), traceIdValue, "", "")
+	}
+
+	results := make([]batchResult, len(items))
+	traceIDs := make([]string, len(items))
+	batch := make([]storagev3.BatchMessage, 0, len(items))
+	batchIndex := make([]int, 0, len(items)) // result index of each batch message
+	for i, item := range items {
+		results[i].To = item.To
+		traceIDs[i] = handler_common.ParseOrGenerateTraceID(traceIdValue, hasTraceId)
+		msg, ttl, err := h.newBatchMessage(c.Request(), params, clientID.String(), item, traceIDs[i])
+		if err != nil {
+			badRequestMetric.Inc()
+			log.Error(err)
+			results[i].StatusCode = http.StatusBadRequest
+			results[i].Message = err.Error()
+			if h.eventCollector != nil {
+				_ = h.eventCollector.TryAdd(h.eventBuilder.NewBridgeMessageValidationFailedEvent(clientID.String(), traceIDs[i], item.Topic, ""))
+			}
+			continue
+		}
+		batch = append(batch, storagev3.BatchMessage{Message: msg, TTL: ttl})
+		batchIndex = append(batchIndex, i)
+	}
+
+	if len(batch) > 0 {
+		pubCtx, cancel := context.WithTimeout(ctx, h.publishTimeout)
+		errs := h.publishBatch(pubCtx, batch)
+		cancel()
+		for j, err := range errs {
+			i := batchIndex[j]
+			h.publishResult(log, &results[i], batch[j].Message, err, clientID.String(), traceIDs[i], items[i].Topic)
+		}
+	}
+
+	return c.JSON(http.StatusOK, batchResponse{Results: results})
+}
+
+// newBatchMessage validates one batch message like SendMessageHandler validates a request
+// and builds the message to store, with its TTL
+func (h *handler) newBatchMessage(request *http.Request, params url.Values, clientID string, item batchMessage, traceID string) (models.SseMessage, int64, error) {
+	toID, err := utils.NewPublicAddressFromString(item.To)
+	if err != nil {
+		return models.SseMessage{}, 0, fmt.Errorf("failed to parse the \"to\" address: %w", err)
+	}
+	message := []byte(item.Message)
+	ttl, err := h.ttlPolicy.Validate(item.Topic, item.TTL.String(), len(message))
+	if err != nil {
+		return models.SseMessage{}, 0, err
+	}
+
+	itemParams := url.Values{
+		"client_id": {clientID},
+		"to":        {toID.String()},
+		"ttl":       {strconv.FormatInt(ttl, 10)},
+		"trace_id":  {traceID},
+	}
+	if item.Topic != "" {
+		itemParams.Set("topic", item.Topic)
+	}
+	if noRequestSource, ok := params["no_request_source"]; ok {
+		itemParams["no_request_source"] = noRequestSource
+	}
+	if config.Config.CopyToURL != "" {
+		go copyMessage(itemParams, message)
+	}
+	if item.Topic != "" {
+		go func(clientID, topic, message string) {
+			handler_common.SendWebhook(clientID, handler_common.WebhookData{Topic: topic, Hash: message})
+		}(clientID, item.Topic, item.Message)
+	}
+
+	return h.newMessage(request, itemParams, clientID, toID.String(), message, item.Topic, traceID, ttl)
+}
+
+// publishResult fills result with the outcome of a synchronous publish of msg
+func (h *handler) publishResult(log *logrus.Entry, result *batchResult, msg models.SseMessage, err error, clientID, traceID, topic string) {
+	switch {
+	case err == nil:
+		result.StatusCode = http.StatusOK
+		result.EventID = msg.EventId
+		h.messageReceived(log, msg, clientID, traceID, topic)
+	case errors.Is(err, storagev3.ErrInboxFull):
+		log.Warnf("inbox of %s is full, message rejected", msg.To)
+		result.StatusCode, result.Message = http.StatusTooManyRequests, err.Error()
+	default:
+		log.Errorf("db error: %v", err)
+		status, res := publishFailure(err)
+		result.StatusCode, result.Message, result.Code = status, res.Message, res.Code
+	}
+}
+
+// publishBatch stores and distributes messages, recording the batch latency and failures
+func (h *handler) publishBatch(ctx context.Context, batch []storagev3.BatchMessage) []error {
+	start := time.Now()
+	errs := storagev3.PubBatch(ctx, h.storage, batch)
+	publishLatencyMetric.WithLabelValues("batch").Observe(time.Since(start).Seconds())
+	for _, err := range errs {
+		if err != nil {
+			publishErrorsMetric.WithLabelValues(publishErrorReason(err)).Inc()
+		}
+	}
+	return errs
+}
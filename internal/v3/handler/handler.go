@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -51,6 +52,14 @@ var (
 		Name: "number_of_delivered_messages",
 		Help: "The total number of delivered_messages",
 	})
+	ackedMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_acked_messages",
+		Help: "The total number of messages acknowledged by recipients",
+	})
+	slowConsumerDisconnectsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_slow_consumer_disconnects",
+		Help: "The total number of SSE connections closed because they missed messages",
+	})
 	badRequestMetric = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "number_of_bad_requests",
 		Help: "The total number of bad requests",
@@ -59,6 +68,24 @@ var (
 		Name:    "number_of_client_ids_per_connection",
 		Buckets: []float64{1, 2, 3, 4, 5, 10, 20, 30, 40, 50, 100},
 	})
+	publishLatencyMetric = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "publish_latency_seconds",
+		Help:    "Time storage took to publish a message or batch, by mode (sync, async or batch)",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"mode"})
+	publishErrorsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_publish_errors",
+		Help: "The total number of messages storage failed to publish, by reason",
+	}, []string{"reason"})
+)
+
+// defaultPublishTimeout bounds a synchronous publish when PUBLISH_TIMEOUT is not set
+const defaultPublishTimeout = 5 * time.Second
+
+// Error codes of /bridge/message responses for messages that were not stored
+const (
+	errCodeStorageUnavailable = "storage_unavailable"
+	errCodePublishTimeout     = "publish_timeout"
 )
 
 type stream struct {
@@ -74,9 +101,21 @@ type handler struct {
 	realIP            *utils.RealIPExtractor
 	eventCollector    analytics.EventCollector
 	eventBuilder      analytics.EventBuilder
+	ttlPolicy         *handler_common.TTLPolicy
+	rejectOverQuota   bool
+	syncPublish       bool
+	publishTimeout    time.Duration
 }
 
 func NewHandler(s storagev3.Storage, heartbeatInterval time.Duration, extractor *utils.RealIPExtractor, timeProvider ntp.TimeProvider, collector analytics.EventCollector, builder analytics.EventBuilder) *handler {
+	ttlPolicy, err := handler_common.TTLPolicyFromConfig()
+	if err != nil {
+		logrus.Fatalf("invalid TTL policy: %v", err)
+	}
+	publishTimeout := time.Duration(config.Config.PublishTimeout) * time.Second
+	if publishTimeout <= 0 {
+		publishTimeout = defaultPublishTimeout
+	}
 	// TODO support extractor in v3
 	h := handler{
 		Mux:               sync.RWMutex{},
@@ -87,6 +126,10 @@ func NewHandler(s storagev3.Storage, heartbeatInterval time.Duration, extractor
 		heartbeatInterval: heartbeatInterval,
 		eventCollector:    collector,
 		eventBuilder:      builder,
+		ttlPolicy:         ttlPolicy,
+		rejectOverQuota:   storagev3.RejectsOverQuota(),
+		syncPublish:       config.Config.SyncPublish,
+		publishTimeout:    publishTimeout,
 	}
 	return &h
 }
@@ -132,71 +175,15 @@ func (h *handler) EventRegistrationHandler(c echo.Context) error {
 		return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
 	}
 
-	var lastEventId int64
-	var err error
-	lastEventIDStr := c.Request().Header.Get("Last-Event-ID")
-	if lastEventIDStr != "" {
-		lastEventId, err = strconv.ParseInt(lastEventIDStr, 10, 64)
-		if err != nil {
-			badRequestMetric.Inc()
-			errorMsg := "Last-Event-ID should be int"
-			log.Error(errorMsg)
-			h.logEventRegistrationValidationFailure("", traceId, "events/last-event-id-header")
-			return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
-		}
-	}
-	lastEventIdQuery, ok := params["last_event_id"]
-	if ok && lastEventId == 0 {
-		lastEventId, err = strconv.ParseInt(lastEventIdQuery[0], 10, 64)
-		if err != nil {
-			badRequestMetric.Inc()
-			errorMsg := "last_event_id should be int"
-			log.Error(errorMsg)
-			h.logEventRegistrationValidationFailure("", traceId, "events/last-event-id-query")
-			return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
-		}
-	}
-	clientId, ok := params["client_id"]
-	if !ok {
-		badRequestMetric.Inc()
-		errorMsg := "param \"client_id\" not present"
-		log.Error(errorMsg)
-		h.logEventRegistrationValidationFailure("", traceId, "events/missing-client-id")
-		return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
-	}
-
-	clientIds := strings.Split(clientId[0], ",")
-	for _, id := range clientIds {
-		if _, err := utils.NewPublicAddressFromString(id); err != nil {
-			badRequestMetric.Inc()
-			errMsg := fmt.Errorf("param \"client_id\" must be a valid public address, error: %w", err).Error()
-			log.Error(errMsg)
-			h.logEventRegistrationValidationFailure("", traceId, errMsg)
-			return c.JSON(utils.HttpResError(errMsg, http.StatusBadRequest))
-		}
+	sub, err := h.parseSubscription(log, c.Request(), params, traceId)
+	if err != nil {
+		return c.JSON(utils.HttpResError(err.Error(), http.StatusBadRequest))
 	}
-	clientIdsPerConnectionMetric.Observe(float64(len(clientIds)))
+	clientIds := sub.clientIds
 
-	session := h.CreateSession(clientIds, lastEventId, traceId)
-
-	// Track connection for verification
-	if len(clientIds) > 0 {
-		ip := h.realIP.Extract(c.Request())
-		origin := utils.ExtractOrigin(c.Request().Header.Get("Origin"))
-		userAgent := c.Request().Header.Get("User-Agent")
-
-		conn := storagev3.ConnectionInfo{
-			ClientID:  clientIds[0],
-			IP:        ip,
-			Origin:    origin,
-			UserAgent: userAgent,
-		}
-
-		ttl := time.Duration(config.Config.ConnectCacheTTL) * time.Second
-		if err := h.storage.AddConnection(c.Request().Context(), conn, ttl); err != nil {
-			log.Warnf("failed to store connection: %v", err)
-		}
-	}
+	connectIP := h.realIP.Extract(c.Request())
+	session := h.CreateSession(clientIds, sub.lastEventId, traceId)
+	h.trackConnection(c.Request(), connectIP, clientIds)
 
 	ctx := c.Request().Context()
 	notify := ctx.Done()
@@ -208,7 +195,7 @@ func (h *handler) EventRegistrationHandler(c echo.Context) error {
 	}()
 	ticker := time.NewTicker(h.heartbeatInterval)
 	defer ticker.Stop()
-	session.Start()
+	session.Start(sub.queueDone)
 loop:
 	for {
 		select {
@@ -217,46 +204,31 @@ loop:
 				// can't read from channel, session is closed
 				break loop
 			}
-			_, err = fmt.Fprintf(c.Response(), "event: %v\nid: %v\ndata: %v\n\n", "message", msg.EventId, string(msg.Message))
+			if msg.EventId == -1 {
+				// Events generated by the bridge, such as queue_done, are sent as is
+				_, err = fmt.Fprint(c.Response(), string(msg.Message))
+				if err != nil {
+					log.Errorf("event can't write to connection: %v", err)
+					break loop
+				}
+				c.Response().Flush()
+				continue
+			}
+
+			// Add BridgeConnectSource, keep the parsed message for later logging
+			messageToSend, bridgeMsg := handler_common.WithConnectSource(msg.Message, connectIP)
+			_, err = fmt.Fprintf(c.Response(), "event: %v\nid: %v\ndata: %v\n\n", "message", msg.EventId, string(messageToSend))
 			if err != nil {
 				log.Errorf("msg can't write to connection: %v", err)
 				break loop
 			}
 			c.Response().Flush()
-
-			fromId := "unknown"
-			toId := msg.To
-			traceID := ""
-
-			hash := sha256.Sum256(msg.Message)
-			messageHash := hex.EncodeToString(hash[:])
-
-			var bridgeMsg models.BridgeMessage
-			if err := json.Unmarshal(msg.Message, &bridgeMsg); err == nil {
-				fromId = bridgeMsg.From
-				traceID = bridgeMsg.TraceId
-				contentHash := sha256.Sum256([]byte(bridgeMsg.Message))
-				messageHash = hex.EncodeToString(contentHash[:])
-			}
-
-			logrus.WithFields(logrus.Fields{
-				"hash":     messageHash,
-				"from":     fromId,
-				"to":       toId,
-				"event_id": msg.EventId,
-				"trace_id": traceID,
-			}).Debug("message sent")
-
-			if h.eventCollector != nil {
-				_ = h.eventCollector.TryAdd(h.eventBuilder.NewBridgeMessageSentEvent(
-					msg.To,
-					traceID,
-					msg.EventId,
-					messageHash,
-				))
-			}
-			deliveredMessagesMetric.Inc()
-			storagev3.ExpiredCache.Mark(msg.EventId)
+			h.messageSent(ctx, log, msg, bridgeMsg)
+		case <-session.Lagging():
+			// The missed messages are still stored, the client gets them after reconnecting
+			log.Warnf("disconnecting slow consumer %v", session.ClientIds)
+			slowConsumerDisconnectsMetric.Inc()
+			break loop
 		case <-ticker.C:
 			_, err = fmt.Fprint(c.Response(), heartbeatMsg)
 			if err != nil {
@@ -315,82 +287,94 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 		return h.failValidation(c, err.Error(), clientID.String(), traceId, "", "")
 	}
 
-	ttlParam, ok := params["ttl"]
-	if !ok {
-		badRequestMetric.Inc()
-		errorMsg := "param \"ttl\" not present"
-		log.Error(errorMsg)
-		return h.failValidation(c, errorMsg, clientID.String(), traceId, "", "")
-	}
-	ttl, err := strconv.ParseInt(ttlParam[0], 10, 32)
+	message, err := io.ReadAll(c.Request().Body)
 	if err != nil {
 		badRequestMetric.Inc()
 		log.Error(err)
 		return h.failValidation(c, err.Error(), clientID.String(), traceId, "", "")
 	}
-	if ttl > 300 { // TODO: config MaxTTL value
-		badRequestMetric.Inc()
-		errorMsg := "param \"ttl\" too high"
-		log.Error(errorMsg)
-		return h.failValidation(c, errorMsg, clientID.String(), traceId, "", "")
-	}
-	message, err := io.ReadAll(c.Request().Body)
+
+	topic := params.Get("topic")
+	ttl, err := h.ttlPolicy.Validate(topic, params.Get("ttl"), len(message))
 	if err != nil {
 		badRequestMetric.Inc()
 		log.Error(err)
-		return h.failValidation(c, err.Error(), clientID.String(), traceId, "", "")
+		return h.failValidation(c, err.Error(), clientID.String(), traceId, topic, "")
 	}
 
 	if config.Config.CopyToURL != "" {
-		go func() {
-			u, err := url.Parse(config.Config.CopyToURL)
-			if err != nil {
-				return
-			}
-			u.RawQuery = params.Encode()
-			req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(message))
-			if err != nil {
-				return
-			}
-			http.DefaultClient.Do(req) //nolint:errcheck// TODO review golangci-lint issue
-		}()
+		go copyMessage(params, message)
 	}
-	topicParam, ok := params["topic"]
-	topic := ""
-	if ok {
-		topic = topicParam[0]
+	if _, ok := params["topic"]; ok {
 		go func(clientID, topic, message string) {
 			handler_common.SendWebhook(clientID, handler_common.WebhookData{Topic: topic, Hash: message})
 		}(clientID.String(), topic, string(message))
 	}
 
-	mes, err := json.Marshal(models.BridgeMessage{
-		From:    clientID.String(),
-		Message: string(message),
-		TraceId: traceId,
-	})
+	sseMessage, ttl, err := h.newMessage(c.Request(), params, clientID.String(), toId.String(), message, topic, traceId, ttl)
 	if err != nil {
 		badRequestMetric.Inc()
 		log.Error(err)
 		return h.failValidation(c, err.Error(), clientID.String(), traceId, topic, "")
 	}
 
-	sseMessage := models.SseMessage{
-		EventId: h.eventIDGen.NextID(),
-		Message: mes,
-		To:      toId.String(),
-	}
-
 	// Send message only to storage - pub-sub will handle distribution
-	go func() {
-		log := log.WithField("prefix", "SendMessageHandler.storage.Pub")
-		err = h.storage.Pub(context.Background(), sseMessage, ttl)
+	syncPublish := h.syncPublish || strings.ToLower(params.Get("sync")) == "true"
+	if syncPublish || h.rejectOverQuota {
+		// The inbox quota may reject the message, and in sync mode the sender
+		// learns about storage failures, so wait for the result. Having waited,
+		// the response never claims a message storage did not accept.
+		pubCtx, cancel := context.WithTimeout(ctx, h.publishTimeout)
+		err := h.publish(pubCtx, sseMessage, ttl, "sync")
+		cancel()
 		if err != nil {
-			// TODO ooops
+			if errors.Is(err, storagev3.ErrInboxFull) {
+				log.Warnf("inbox of %s is full, message rejected", toId.String())
+				return c.JSON(utils.HttpResError(err.Error(), http.StatusTooManyRequests))
+			}
 			log.Errorf("db error: %v", err)
+			return c.JSON(publishFailure(err))
 		}
-	}()
+	} else {
+		go func() {
+			log := log.WithField("prefix", "SendMessageHandler.storage.Pub")
+			if err := h.publish(context.Background(), sseMessage, ttl, "async"); err != nil {
+				log.Errorf("db error: %v", err)
+			}
+		}()
+	}
+
+	h.messageReceived(log, sseMessage, clientID.String(), traceId, topic)
+	return c.JSON(http.StatusOK, utils.HttpResOk())
+}
+
+// newMessage builds the message from clientID to toID with its event ID. ttl is the
+// TTL accepted by the TTL policy, the returned one is adjusted to the built message.
+func (h *handler) newMessage(request *http.Request, params url.Values, clientID, toID string, message []byte, topic, traceID string, ttl int64) (models.SseMessage, int64, error) {
+	requestSource, err := handler_common.RequestSource(request, params, h.realIP, toID)
+	if err != nil {
+		return models.SseMessage{}, 0, fmt.Errorf("failed to encrypt request source: %w", err)
+	}
+
+	mes, err := json.Marshal(models.BridgeMessage{
+		From:                clientID,
+		Message:             string(message),
+		BridgeRequestSource: requestSource,
+		TraceId:             traceID,
+	})
+	if err != nil {
+		return models.SseMessage{}, 0, err
+	}
 
+	return models.SseMessage{
+		EventId: h.eventIDGen.NextID(),
+		Message: mes,
+		To:      toID,
+	}, h.ttlPolicy.Apply(topic, ttl, len(mes)), nil
+}
+
+// messageReceived logs, counts and reports a message accepted for delivery
+func (h *handler) messageReceived(log *logrus.Entry, sseMessage models.SseMessage, clientID, traceID, topic string) {
 	var bridgeMsg models.BridgeMessage
 	fromId := "unknown"
 
@@ -406,15 +390,15 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 	log.WithFields(logrus.Fields{
 		"hash":     messageHash,
 		"from":     fromId,
-		"to":       toId[0],
+		"to":       sseMessage.To,
 		"event_id": sseMessage.EventId,
-		"trace_id": traceId,
+		"trace_id": traceID,
 	}).Debug("message received")
 
 	if h.eventCollector != nil {
 		_ = h.eventCollector.TryAdd(h.eventBuilder.NewBridgeMessageReceivedEvent(
-			clientID.String(),
-			traceId,
+			clientID,
+			traceID,
 			topic,
 			sseMessage.EventId,
 			messageHash,
@@ -422,6 +406,102 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 	}
 
 	transferedMessagesNumMetric.Inc()
+}
+
+// copyMessage sends a copy of a received message to COPY_TO_URL
+func copyMessage(params url.Values, message []byte) {
+	u, err := url.Parse(config.Config.CopyToURL)
+	if err != nil {
+		return
+	}
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(message))
+	if err != nil {
+		return
+	}
+	http.DefaultClient.Do(req) //nolint:errcheck// TODO review golangci-lint issue
+}
+
+// publish stores and distributes a message, recording its latency and failures
+func (h *handler) publish(ctx context.Context, msg models.SseMessage, ttl int64, mode string) error {
+	start := time.Now()
+	err := h.storage.Pub(ctx, msg, ttl)
+	publishLatencyMetric.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+	if err != nil {
+		publishErrorsMetric.WithLabelValues(publishErrorReason(err)).Inc()
+	}
+	return err
+}
+
+func publishErrorReason(err error) string {
+	switch {
+	case errors.Is(err, storagev3.ErrInboxFull):
+		return "inbox_full"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "storage"
+	}
+}
+
+// publishFailure is the response to a synchronous publish that storage did not complete.
+// The message may still be stored after a timeout, so a retry can deliver it twice.
+func publishFailure(err error) (int, utils.HttpRes) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return utils.HttpResErrorCode("timed out waiting for storage to publish the message", errCodePublishTimeout, http.StatusServiceUnavailable)
+	}
+	return utils.HttpResErrorCode("storage failed to publish the message", errCodeStorageUnavailable, http.StatusServiceUnavailable)
+}
+
+// AckHandler drops a message the recipient has processed, so it is neither
+// replayed on reconnect nor reported as expired
+func (h *handler) AckHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	log := logrus.WithContext(ctx).WithField("prefix", "AckHandler")
+
+	paramsStore, err := handler_common.NewParamsStorage(c, config.Config.MaxBodySize)
+	if err != nil {
+		badRequestMetric.Inc()
+		log.Error(err)
+		return c.JSON(utils.HttpResError(err.Error(), http.StatusBadRequest))
+	}
+
+	clientIdValue, ok := paramsStore.Get("client_id")
+	if !ok {
+		badRequestMetric.Inc()
+		errorMsg := "param \"client_id\" not present"
+		log.Error(errorMsg)
+		return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	clientID, err := utils.NewPublicAddressFromString(clientIdValue)
+	if err != nil {
+		err = fmt.Errorf("failed to parse the \"client_id\" address: %w", err)
+		badRequestMetric.Inc()
+		log.Error(err)
+		return c.JSON(utils.HttpResError(err.Error(), http.StatusBadRequest))
+	}
+
+	eventIdValue, ok := paramsStore.Get("event_id")
+	if !ok {
+		badRequestMetric.Inc()
+		errorMsg := "param \"event_id\" not present"
+		log.Error(errorMsg)
+		return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	eventID, err := strconv.ParseInt(eventIdValue, 10, 64)
+	if err != nil {
+		badRequestMetric.Inc()
+		errorMsg := "param \"event_id\" must be an integer"
+		log.Error(errorMsg)
+		return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
+	}
+
+	if err := h.storage.Ack(ctx, clientID.String(), eventID); err != nil {
+		log.Errorf("failed to ack message %d for client %s: %v", eventID, clientID.String(), err)
+		return c.JSON(utils.HttpResError(err.Error(), http.StatusInternalServerError))
+	}
+
+	ackedMessagesMetric.Inc()
 	return c.JSON(http.StatusOK, utils.HttpResOk())
 }
 
@@ -581,6 +661,119 @@ func (h *handler) CreateSession(clientIds []string, lastEventId int64, traceID s
 	return session
 }
 
+// subscription is what a client subscribes to on /bridge/events and /bridge/ws
+type subscription struct {
+	clientIds   []string
+	lastEventId int64
+	queueDone   bool
+}
+
+// parseSubscription reads client_id, last_event_id (or the Last-Event-ID header) and
+// enable_queue_done_event. Invalid params are counted and reported to analytics, the
+// returned error is the message for the client.
+func (h *handler) parseSubscription(log *logrus.Entry, request *http.Request, params url.Values, traceId string) (subscription, error) {
+	fail := func(errorMsg, requestType string) (subscription, error) {
+		badRequestMetric.Inc()
+		log.Error(errorMsg)
+		h.logEventRegistrationValidationFailure("", traceId, requestType)
+		return subscription{}, errors.New(errorMsg)
+	}
+
+	var sub subscription
+	if queueDoneParam, exists := params["enable_queue_done_event"]; exists && len(queueDoneParam) > 0 {
+		sub.queueDone = handler_common.QueueDoneEnabled(queueDoneParam[0])
+	}
+
+	var err error
+	lastEventIDStr := request.Header.Get("Last-Event-ID")
+	if lastEventIDStr != "" {
+		sub.lastEventId, err = strconv.ParseInt(lastEventIDStr, 10, 64)
+		if err != nil {
+			return fail("Last-Event-ID should be int", "events/last-event-id-header")
+		}
+	}
+	lastEventIdQuery, ok := params["last_event_id"]
+	if ok && sub.lastEventId == 0 {
+		sub.lastEventId, err = strconv.ParseInt(lastEventIdQuery[0], 10, 64)
+		if err != nil {
+			return fail("last_event_id should be int", "events/last-event-id-query")
+		}
+	}
+	clientId, ok := params["client_id"]
+	if !ok {
+		return fail("param \"client_id\" not present", "events/missing-client-id")
+	}
+
+	sub.clientIds = strings.Split(clientId[0], ",")
+	for _, id := range sub.clientIds {
+		if _, err := utils.NewPublicAddressFromString(id); err != nil {
+			errMsg := fmt.Errorf("param \"client_id\" must be a valid public address, error: %w", err).Error()
+			return fail(errMsg, errMsg)
+		}
+	}
+	clientIdsPerConnectionMetric.Observe(float64(len(sub.clientIds)))
+	return sub, nil
+}
+
+// trackConnection stores the connection of the first client id for /bridge/verify
+func (h *handler) trackConnection(request *http.Request, connectIP string, clientIds []string) {
+	if len(clientIds) == 0 {
+		return
+	}
+	conn := storagev3.ConnectionInfo{
+		ClientID:  clientIds[0],
+		IP:        connectIP,
+		Origin:    utils.ExtractOrigin(request.Header.Get("Origin")),
+		UserAgent: request.Header.Get("User-Agent"),
+	}
+	ttl := time.Duration(config.Config.ConnectCacheTTL) * time.Second
+	if err := h.storage.AddConnection(request.Context(), conn, ttl); err != nil {
+		logrus.WithField("prefix", "trackConnection").Warnf("failed to store connection: %v", err)
+	}
+}
+
+// messageSent records a message written to a client: analytics, metrics and delivery state.
+// bridgeMsg is the decoded message, nil when it is not a bridge message.
+func (h *handler) messageSent(ctx context.Context, log *logrus.Entry, msg models.SseMessage, bridgeMsg *models.BridgeMessage) {
+	fromId := "unknown"
+	toId := msg.To
+	traceID := ""
+
+	hash := sha256.Sum256(msg.Message)
+	messageHash := hex.EncodeToString(hash[:])
+
+	if bridgeMsg != nil {
+		fromId = bridgeMsg.From
+		traceID = bridgeMsg.TraceId
+		contentHash := sha256.Sum256([]byte(bridgeMsg.Message))
+		messageHash = hex.EncodeToString(contentHash[:])
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"hash":     messageHash,
+		"from":     fromId,
+		"to":       toId,
+		"event_id": msg.EventId,
+		"trace_id": traceID,
+	}).Debug("message sent")
+
+	if h.eventCollector != nil {
+		_ = h.eventCollector.TryAdd(h.eventBuilder.NewBridgeMessageSentEvent(
+			msg.To,
+			traceID,
+			msg.EventId,
+			messageHash,
+		))
+	}
+	deliveredMessagesMetric.Inc()
+	storagev3.ExpiredCache.Mark(msg.EventId)
+	if tracker, ok := h.storage.(storagev3.DeliveryTracker); ok {
+		if err := tracker.MarkDelivered(ctx, msg.EventId); err != nil {
+			log.Warnf("failed to mark message %d as delivered: %v", msg.EventId, err)
+		}
+	}
+}
+
 func (h *handler) logEventRegistrationValidationFailure(clientID, traceID, requestType string) {
 	if h.eventCollector == nil {
 		return
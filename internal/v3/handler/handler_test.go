@@ -1,6 +1,9 @@
 package handlerv3
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -9,6 +12,9 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/ton-connect/bridge/internal/config"
+	"github.com/ton-connect/bridge/internal/handler/handlertest"
+	"github.com/ton-connect/bridge/internal/models"
 	"github.com/ton-connect/bridge/internal/ntp"
 	"github.com/ton-connect/bridge/internal/utils"
 	storagev3 "github.com/ton-connect/bridge/internal/v3/storage"
@@ -19,6 +25,15 @@ const (
 	defaultToID     = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
 )
 
+func newMemStorage(t *testing.T) *storagev3.MemStorage {
+	t.Helper()
+	s, err := storagev3.NewMemStorage(nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create memory storage: %v", err)
+	}
+	return s
+}
+
 func TestHandler(t *testing.T) {
 	defaultBody := "test message payload"
 
@@ -68,7 +83,7 @@ func TestHandler(t *testing.T) {
 		},
 		"ttl too high": {
 			expectedStatus: http.StatusBadRequest,
-			expectedBody:   []string{`"message":"param \"ttl\" too high"`},
+			expectedBody:   []string{`"message":"param \"ttl\" too high: 500 exceeds MESSAGE_TTL_MAX 300"`},
 			rqParams: map[string]string{
 				"client_id": defaultClientID,
 				"to":        defaultToID,
@@ -160,7 +175,7 @@ func TestHandler(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, reqURL, strings.NewReader(tc.body))
 			req.Header.Set("Content-Type", "application/octet-stream")
 
-			memStorage := storagev3.NewMemStorage(nil, nil)
+			memStorage := newMemStorage(t)
 			extractor, err := utils.NewRealIPExtractor([]string{})
 			if err != nil {
 				t.Fatalf("failed to create RealIPExtractor: %v", err)
@@ -186,3 +201,360 @@ func TestHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestAckHandler(t *testing.T) {
+	tCases := map[string]struct {
+		expectedStatus int
+		expectedBody   string
+		rqParams       map[string]string
+	}{
+		"ok path": {
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"statusCode":200`,
+			rqParams:       map[string]string{"client_id": defaultToID, "event_id": "1"},
+		},
+		"missing client_id": {
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `param \"client_id\" not present`,
+			rqParams:       map[string]string{"event_id": "1"},
+		},
+		"missing event_id": {
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `param \"event_id\" not present`,
+			rqParams:       map[string]string{"client_id": defaultToID},
+		},
+		"invalid event_id": {
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `param \"event_id\" must be an integer`,
+			rqParams:       map[string]string{"client_id": defaultToID, "event_id": "abc"},
+		},
+	}
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			values := url.Values{}
+			for key, value := range tc.rqParams {
+				values.Set(key, value)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/bridge/ack?"+values.Encode(), nil)
+
+			extractor, err := utils.NewRealIPExtractor([]string{})
+			if err != nil {
+				t.Fatalf("failed to create RealIPExtractor: %v", err)
+			}
+			h := NewHandler(newMemStorage(t), 10*time.Second, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+
+			rec := httptest.NewRecorder()
+			if err := h.AckHandler(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatalf("AckHandler returned error: %v", err)
+			}
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rec.Code)
+			}
+			if !strings.Contains(rec.Body.String(), tc.expectedBody) {
+				t.Errorf("expected body to contain %q, got %q", tc.expectedBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSendMessageHandler_InboxFull(t *testing.T) {
+	prevMax, prevPolicy := config.Config.InboxMaxMessages, config.Config.InboxOverflowPolicy
+	config.Config.InboxMaxMessages, config.Config.InboxOverflowPolicy = 1, "reject"
+	defer func() {
+		config.Config.InboxMaxMessages, config.Config.InboxOverflowPolicy = prevMax, prevPolicy
+	}()
+
+	extractor, err := utils.NewRealIPExtractor([]string{})
+	if err != nil {
+		t.Fatalf("failed to create RealIPExtractor: %v", err)
+	}
+	h := NewHandler(newMemStorage(t), 10*time.Second, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+
+	values := url.Values{}
+	values.Set("client_id", defaultClientID)
+	values.Set("to", defaultToID)
+	values.Set("ttl", "60")
+	for i, expectedStatus := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?"+values.Encode(), strings.NewReader("payload"))
+		rec := httptest.NewRecorder()
+		if err := h.SendMessageHandler(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatalf("SendMessageHandler returned error: %v", err)
+		}
+		if rec.Code != expectedStatus {
+			t.Errorf("message %d: expected status %d, got %d", i+1, expectedStatus, rec.Code)
+		}
+	}
+}
+
+func TestSendMessageHandler_RequestSource(t *testing.T) {
+	extractor, err := utils.NewRealIPExtractor([]string{})
+	if err != nil {
+		t.Fatalf("failed to create RealIPExtractor: %v", err)
+	}
+
+	for _, optOut := range []bool{false, true} {
+		memStorage := newMemStorage(t)
+		h := NewHandler(memStorage, 10*time.Second, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+		ch := make(chan models.SseMessage, 1)
+		if err := memStorage.Sub(context.Background(), []string{defaultToID}, 0, ch); err != nil {
+			t.Fatalf("Sub() error = %v", err)
+		}
+
+		values := url.Values{}
+		values.Set("client_id", defaultClientID)
+		values.Set("to", defaultToID)
+		values.Set("ttl", "60")
+		if optOut {
+			values.Set("no_request_source", "true")
+		}
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?"+values.Encode(), strings.NewReader("payload"))
+		req.Header.Set("Origin", "https://dapp.example.com")
+		rec := httptest.NewRecorder()
+		if err := h.SendMessageHandler(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatalf("SendMessageHandler returned error: %v", err)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+
+		select {
+		case msg := <-ch:
+			var bridgeMsg models.BridgeMessage
+			if err := json.Unmarshal(msg.Message, &bridgeMsg); err != nil {
+				t.Fatalf("failed to decode bridge message: %v", err)
+			}
+			if hasSource := bridgeMsg.BridgeRequestSource != ""; hasSource == optOut {
+				t.Errorf("no_request_source=%v: request_source present = %v", optOut, hasSource)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message was not published")
+		}
+	}
+}
+
+func TestSendMessagesHandler(t *testing.T) {
+	extractor, err := utils.NewRealIPExtractor([]string{})
+	if err != nil {
+		t.Fatalf("failed to create RealIPExtractor: %v", err)
+	}
+	otherToID := strings.Repeat("ab", 32)
+
+	tCases := map[string]struct {
+		body           string
+		expectedStatus int
+		expectedBody   string
+		expectedItems  []int
+	}{
+		"per message results": {
+			body: `[{"to":"` + defaultToID + `","ttl":60,"message":"one"},` +
+				`{"to":"` + otherToID + `","ttl":60,"topic":"sign","message":"two"},` +
+				`{"to":"invalid","ttl":60,"message":"three"},` +
+				`{"to":"` + defaultToID + `","ttl":500,"message":"four"}]`,
+			expectedStatus: http.StatusOK,
+			expectedItems:  []int{http.StatusOK, http.StatusOK, http.StatusBadRequest, http.StatusBadRequest},
+		},
+		"not an array": {
+			body:           `{"to":"` + defaultToID + `"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "body must be a JSON array of messages",
+		},
+		"empty batch": {
+			body:           `[]`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "batch must have 1 to 100 messages, got 0",
+		},
+		"too many messages": {
+			body:           "[" + strings.TrimSuffix(strings.Repeat(`{"to":"`+defaultToID+`","ttl":60,"message":"m"},`, 101), ",") + "]",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "batch must have 1 to 100 messages, got 101",
+		},
+	}
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			memStorage := newMemStorage(t)
+			h := NewHandler(memStorage, 10*time.Second, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/bridge/messages?client_id="+defaultClientID+"&no_request_source=true", strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+			if err := h.SendMessagesHandler(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatalf("SendMessagesHandler returned error: %v", err)
+			}
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.expectedStatus, rec.Code, rec.Body.String())
+			}
+			if tc.expectedBody != "" && !strings.Contains(rec.Body.String(), tc.expectedBody) {
+				t.Errorf("expected body to contain %q, got %q", tc.expectedBody, rec.Body.String())
+			}
+			if tc.expectedItems == nil {
+				return
+			}
+
+			var res batchResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+			}
+			if len(res.Results) != len(tc.expectedItems) {
+				t.Fatalf("expected %d results, got %d", len(tc.expectedItems), len(res.Results))
+			}
+			stored := make(map[int64]string)
+			for i, result := range res.Results {
+				if result.StatusCode != tc.expectedItems[i] {
+					t.Errorf("message %d: expected status %d, got %d (%s)", i+1, tc.expectedItems[i], result.StatusCode, result.Message)
+				}
+				if (result.EventID != 0) != (result.StatusCode == http.StatusOK) {
+					t.Errorf("message %d: unexpected event ID %d for status %d", i+1, result.EventID, result.StatusCode)
+				}
+				if result.EventID != 0 {
+					stored[result.EventID] = result.To
+				}
+			}
+
+			ch := make(chan models.SseMessage, 10)
+			if err := memStorage.Sub(context.Background(), []string{defaultToID, otherToID}, 0, ch); err != nil {
+				t.Fatalf("Sub() error = %v", err)
+			}
+			for range stored {
+				select {
+				case msg := <-ch:
+					if to, ok := stored[msg.EventId]; !ok || to != msg.To {
+						t.Errorf("unexpected stored message %d for %s", msg.EventId, msg.To)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("accepted message was not stored")
+				}
+			}
+		})
+	}
+}
+
+// failingStorage is a MemStorage whose Pub fails, or blocks until its context is done when err is nil
+type failingStorage struct {
+	*storagev3.MemStorage
+	err error
+}
+
+func (s *failingStorage) Pub(ctx context.Context, message models.SseMessage, ttl int64) error {
+	if s.err != nil {
+		return s.err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *failingStorage) PubBatch(ctx context.Context, messages []storagev3.BatchMessage) []error {
+	errs := make([]error, len(messages))
+	for i, m := range messages {
+		errs[i] = s.Pub(ctx, m.Message, m.TTL)
+	}
+	return errs
+}
+
+func TestSendMessageHandler_SyncPublish(t *testing.T) {
+	extractor, err := utils.NewRealIPExtractor([]string{})
+	if err != nil {
+		t.Fatalf("failed to create RealIPExtractor: %v", err)
+	}
+
+	tCases := map[string]struct {
+		storageErr      error
+		configSync      bool
+		rejectOverQuota bool
+		syncParam       string
+		expectedStatus  int
+		expectedCode    string
+	}{
+		"async ignores storage errors": {
+			storageErr:     errors.New("connection refused"),
+			expectedStatus: http.StatusOK,
+		},
+		"sync param, storage error": {
+			storageErr:     errors.New("connection refused"),
+			syncParam:      "true",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedCode:   "storage_unavailable",
+		},
+		"sync config, storage error": {
+			storageErr:     errors.New("connection refused"),
+			configSync:     true,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedCode:   "storage_unavailable",
+		},
+		"quota wait, storage error": {
+			storageErr:      errors.New("connection refused"),
+			rejectOverQuota: true,
+			expectedStatus:  http.StatusServiceUnavailable,
+			expectedCode:    "storage_unavailable",
+		},
+		"sync param, storage timeout": {
+			syncParam:      "true",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedCode:   "publish_timeout",
+		},
+	}
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			h := NewHandler(&failingStorage{MemStorage: newMemStorage(t), err: tc.storageErr}, 10*time.Second, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+			h.syncPublish = tc.configSync
+			h.rejectOverQuota = tc.rejectOverQuota
+			h.publishTimeout = 50 * time.Millisecond
+
+			values := url.Values{}
+			values.Set("client_id", defaultClientID)
+			values.Set("to", defaultToID)
+			values.Set("ttl", "60")
+			values.Set("no_request_source", "true")
+			if tc.syncParam != "" {
+				values.Set("sync", tc.syncParam)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/bridge/message?"+values.Encode(), strings.NewReader("payload"))
+			rec := httptest.NewRecorder()
+			if err := h.SendMessageHandler(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatalf("SendMessageHandler returned error: %v", err)
+			}
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rec.Code)
+			}
+			var res utils.HttpRes
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+			}
+			if res.Code != tc.expectedCode {
+				t.Errorf("expected code %q, got %q", tc.expectedCode, res.Code)
+			}
+		})
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	handlertest.RunStream(t, func(t *testing.T) handlertest.Handlers {
+		extractor, err := utils.NewRealIPExtractor([]string{})
+		if err != nil {
+			t.Fatalf("failed to create RealIPExtractor: %v", err)
+		}
+		h := NewHandler(newMemStorage(t), time.Minute, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+		return handlertest.Handlers{Events: h.EventRegistrationHandler, Send: h.SendMessageHandler}
+	})
+}
+
+func TestSendMessagesHandler_StorageFailure(t *testing.T) {
+	extractor, err := utils.NewRealIPExtractor([]string{})
+	if err != nil {
+		t.Fatalf("failed to create RealIPExtractor: %v", err)
+	}
+	h := NewHandler(&failingStorage{MemStorage: newMemStorage(t), err: errors.New("connection refused")}, 10*time.Second, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+
+	body := `[{"to":"` + defaultToID + `","ttl":60,"message":"one"}]`
+	req := httptest.NewRequest(http.MethodPost, "/bridge/messages?client_id="+defaultClientID+"&no_request_source=true", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	if err := h.SendMessagesHandler(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("SendMessagesHandler returned error: %v", err)
+	}
+
+	var res batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+	if len(res.Results) != 1 || res.Results[0].StatusCode != http.StatusServiceUnavailable || res.Results[0].Code != "storage_unavailable" {
+		t.Errorf("expected a 503 storage_unavailable result, got %+v", res.Results)
+	}
+}
@@ -0,0 +1,121 @@
+package handlerv3
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	handler_common "github.com/ton-connect/bridge/internal/handler"
+	"github.com/ton-connect/bridge/internal/models"
+	"github.com/ton-connect/bridge/internal/utils"
+)
+
+const (
+	// defaultPollTimeout holds a poll without the timeout param, below common proxy idle timeouts
+	defaultPollTimeout = 25 * time.Second
+	// maxPollTimeout caps the timeout param
+	maxPollTimeout = 60 * time.Second
+)
+
+// pollMessage is a message of a /bridge/poll response. Data is the message as in
+// the data field of a /bridge/events message event.
+type pollMessage struct {
+	ID   int64  `json:"id"`
+	Data string `json:"data"`
+}
+
+// PollHandler serves /bridge/poll, a long-polling fallback for clients that cannot keep
+// a streaming response open. It takes the /bridge/events params and returns the messages
+// after last_event_id as soon as there are any, or an empty array after timeout seconds.
+func (h *handler) PollHandler(c echo.Context) error {
+	log := logrus.WithField("prefix", "PollHandler")
+	params := c.QueryParams()
+
+	traceIdParam, ok := params["trace_id"]
+	traceIdValue := ""
+	if ok && len(traceIdParam) > 0 {
+		traceIdValue = traceIdParam[0]
+	}
+	traceId := handler_common.ParseOrGenerateTraceID(traceIdValue, ok && len(traceIdParam) > 0)
+
+	timeout := defaultPollTimeout
+	if timeoutParam := params.Get("timeout"); timeoutParam != "" {
+		seconds, err := strconv.ParseInt(timeoutParam, 10, 64)
+		if err != nil || seconds < 0 {
+			badRequestMetric.Inc()
+			errorMsg := "timeout should be a non-negative int"
+			log.Error(errorMsg)
+			h.logEventRegistrationValidationFailure("", traceId, "poll/timeout")
+			return c.JSON(utils.HttpResError(errorMsg, http.StatusBadRequest))
+		}
+		timeout = min(time.Duration(seconds)*time.Second, maxPollTimeout)
+	}
+
+	sub, err := h.parseSubscription(log, c.Request(), params, traceId)
+	if err != nil {
+		return c.JSON(utils.HttpResError(err.Error(), http.StatusBadRequest))
+	}
+
+	connectIP := h.realIP.Extract(c.Request())
+	session := h.CreateSession(sub.clientIds, sub.lastEventId, traceId)
+	h.trackConnection(c.Request(), connectIP, sub.clientIds)
+	defer func() {
+		session.Close()
+		h.removeConnection(session, traceId)
+		activeConnectionMetric.Dec()
+	}()
+
+	// Sub replays the stored messages before Start returns
+	session.Start(false)
+	messages := drainMessages(session.GetMessages(), nil)
+	if len(messages) == 0 && timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case msg, ok := <-session.GetMessages():
+			if ok {
+				messages = drainMessages(session.GetMessages(), []models.SseMessage{msg})
+			}
+		case <-session.Lagging():
+		case <-timer.C:
+		case <-c.Request().Context().Done():
+			log.Infof("poll of %v cancelled: %v", sub.clientIds, c.Request().Context().Err())
+			return nil
+		}
+	}
+
+	res := make([]pollMessage, 0, len(messages))
+	bridgeMsgs := make([]*models.BridgeMessage, len(messages))
+	for i, msg := range messages {
+		var messageToSend []byte
+		messageToSend, bridgeMsgs[i] = handler_common.WithConnectSource(msg.Message, connectIP)
+		res = append(res, pollMessage{ID: msg.EventId, Data: string(messageToSend)})
+	}
+
+	c.Response().Header().Set("Cache-Control", "private, no-cache, no-transform")
+	if err := c.JSON(http.StatusOK, res); err != nil {
+		return fmt.Errorf("failed to write poll response: %w", err)
+	}
+	for i, msg := range messages {
+		h.messageSent(c.Request().Context(), log, msg, bridgeMsgs[i])
+	}
+	return nil
+}
+
+// drainMessages appends the messages already buffered in ch without waiting for more
+func drainMessages(ch <-chan models.SseMessage, messages []models.SseMessage) []models.SseMessage {
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package handlerv3
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ton-connect/bridge/internal/models"
+	"github.com/ton-connect/bridge/internal/ntp"
+	"github.com/ton-connect/bridge/internal/utils"
+)
+
+func TestPollHandler(t *testing.T) {
+	extractor, err := utils.NewRealIPExtractor([]string{})
+	if err != nil {
+		t.Fatalf("failed to create RealIPExtractor: %v", err)
+	}
+	bridgeMessage := func(text string) []byte {
+		mes, _ := json.Marshal(models.BridgeMessage{From: defaultToID, Message: text})
+		return mes
+	}
+
+	tCases := map[string]struct {
+		query          string
+		stored         []string
+		published      string
+		expectedStatus int
+		expectedBody   string
+		expectedData   []string
+	}{
+		"stored messages after last_event_id": {
+			query:          "client_id=" + defaultClientID + "&last_event_id=1&timeout=5",
+			stored:         []string{"old", "new", "newer"},
+			expectedStatus: http.StatusOK,
+			expectedData:   []string{"new", "newer"},
+		},
+		"waits for a message": {
+			query:          "client_id=" + defaultClientID + "&timeout=5",
+			published:      "live",
+			expectedStatus: http.StatusOK,
+			expectedData:   []string{"live"},
+		},
+		"no messages until timeout": {
+			query:          "client_id=" + defaultClientID + "&timeout=0",
+			expectedStatus: http.StatusOK,
+			expectedData:   []string{},
+		},
+		"invalid timeout": {
+			query:          "client_id=" + defaultClientID + "&timeout=soon",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "timeout should be a non-negative int",
+		},
+		"missing client_id": {
+			query:          "timeout=1",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "param \\\"client_id\\\" not present",
+		},
+	}
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			memStorage := newMemStorage(t)
+			for i, text := range tc.stored {
+				if err := memStorage.Pub(context.Background(), models.SseMessage{EventId: int64(i + 1), Message: bridgeMessage(text), To: defaultClientID}, 60); err != nil {
+					t.Fatalf("Pub() error = %v", err)
+				}
+			}
+			h := NewHandler(memStorage, 10*time.Second, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+
+			if tc.published != "" {
+				go func() {
+					// Publish once the poll is subscribed
+					for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+						h.Mux.RLock()
+						_, subscribed := h.Connections[defaultClientID]
+						h.Mux.RUnlock()
+						if subscribed {
+							_ = memStorage.Pub(context.Background(), models.SseMessage{EventId: 100, Message: bridgeMessage(tc.published), To: defaultClientID}, 60)
+							return
+						}
+					}
+				}()
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/bridge/poll?"+tc.query, nil)
+			rec := httptest.NewRecorder()
+			if err := h.PollHandler(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatalf("PollHandler returned error: %v", err)
+			}
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.expectedStatus, rec.Code, rec.Body.String())
+			}
+			if tc.expectedBody != "" && !strings.Contains(rec.Body.String(), tc.expectedBody) {
+				t.Errorf("expected body to contain %q, got %q", tc.expectedBody, rec.Body.String())
+			}
+			if len(h.Connections) != 0 {
+				t.Errorf("expected the poll to unsubscribe, got %d subscribed client ids", len(h.Connections))
+			}
+			if tc.expectedData == nil {
+				return
+			}
+
+			var res []pollMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res == nil {
+				t.Fatalf("expected a JSON array, got %q: %v", rec.Body.String(), err)
+			}
+			if len(res) != len(tc.expectedData) {
+				t.Fatalf("expected %d messages, got %d: %s", len(tc.expectedData), len(res), rec.Body.String())
+			}
+			for i, msg := range res {
+				var bridgeMsg models.BridgeMessage
+				if err := json.Unmarshal([]byte(msg.Data), &bridgeMsg); err != nil {
+					t.Fatalf("data is not a bridge message: %v", err)
+				}
+				if bridgeMsg.Message != tc.expectedData[i] || msg.ID == 0 {
+					t.Errorf("message %d: expected %q with an event ID, got %+v", i+1, tc.expectedData[i], msg)
+				}
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	log "github.com/sirupsen/logrus"
+	handler_common "github.com/ton-connect/bridge/internal/handler"
 	"github.com/ton-connect/bridge/internal/models"
 	"github.com/ton-connect/bridge/internal/v3/storage"
 )
@@ -14,8 +15,11 @@ type Session struct {
 	ClientIds   []string
 	storage     storagev3.Storage
 	messageCh   chan models.SseMessage
+	lagging     <-chan struct{}
 	Closer      chan interface{}
 	lastEventId int64
+	closeOnce   sync.Once
+	queueDone   sync.WaitGroup // pending queue_done send, see Start
 }
 
 func NewSession(s storagev3.Storage, clientIds []string, lastEventId int64) *Session {
@@ -27,6 +31,7 @@ func NewSession(s storagev3.Storage, clientIds []string, lastEventId int64) *Ses
 		Closer:      make(chan interface{}),
 		lastEventId: lastEventId,
 	}
+	session.lagging = storagev3.WatchSlowConsumer(session.messageCh)
 	return &session
 }
 
@@ -35,6 +40,12 @@ func (s *Session) GetMessages() <-chan models.SseMessage {
 	return s.messageCh
 }
 
+// Lagging returns a channel that is closed when the session missed a message and should
+// be disconnected, so the client reconnects with Last-Event-ID (SLOW_CONSUMER_POLICY=disconnect)
+func (s *Session) Lagging() <-chan struct{} {
+	return s.lagging
+}
+
 // Close stops the session and cleans up resources
 func (s *Session) Close() {
 	log := log.WithField("prefix", "Session.Close")
@@ -45,19 +56,50 @@ func (s *Session) Close() {
 	if err != nil {
 		log.Errorf("failed to unsubscribe from storage: %v", err)
 	}
+	storagev3.UnwatchSlowConsumer(s.messageCh)
 
 	close(s.Closer)
-	close(s.messageCh)
+	s.queueDone.Wait()
+	s.closeMessages()
 }
 
-// Start begins the session by subscribing to storage
-func (s *Session) Start() {
+// closeMessages closes the message channel once, Start closes it when Sub fails
+func (s *Session) closeMessages() {
+	s.closeOnce.Do(func() { close(s.messageCh) })
+}
+
+// Start begins the session by subscribing to storage. Sub replays the stored history
+// before it returns, so with enableQueueDoneEvent the queue_done event follows it.
+// When the replay filled the message buffer, queue_done is sent once the consumer
+// has made room, or dropped when the session closes first.
+func (s *Session) Start(enableQueueDoneEvent bool) {
+	log := log.WithField("prefix", "Session.Start")
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
 	err := s.storage.Sub(context.Background(), s.ClientIds, s.lastEventId, s.messageCh)
 	if err != nil {
-		close(s.messageCh)
+		log.Errorf("failed to subscribe to storage: %v", err)
+		s.closeMessages()
+		return
+	}
+
+	if !enableQueueDoneEvent {
+		return
+	}
+	queueDone := models.SseMessage{EventId: -1, Message: []byte(handler_common.QueueDoneEvent)}
+	select {
+	case s.messageCh <- queueDone:
 		return
+	default:
 	}
+	// The consumer starts reading after Start returns
+	s.queueDone.Add(1)
+	go func() {
+		defer s.queueDone.Done()
+		select {
+		case s.messageCh <- queueDone:
+		case <-s.Closer:
+		}
+	}()
 }
@@ -0,0 +1,65 @@
+package handlerv3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+func TestSession_QueueDoneAfterFullReplay(t *testing.T) {
+	s := newMemStorage(t)
+	ctx := context.Background()
+	for i := int64(1); i <= 150; i++ {
+		if err := s.Pub(ctx, models.SseMessage{EventId: i, To: defaultToID, Message: []byte("msg")}, 60); err != nil {
+			t.Fatalf("Pub failed: %v", err)
+		}
+	}
+
+	// The replay fills the message buffer before anything reads it
+	session := NewSession(s, []string{defaultToID}, 0)
+	session.Start(true)
+	defer session.Close()
+
+	received := 0
+	for {
+		select {
+		case msg := <-session.GetMessages():
+			if msg.EventId == -1 {
+				if received == 0 {
+					t.Error("queue_done sent before the replayed messages")
+				}
+				return
+			}
+			received++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("queue_done not received after %d messages", received)
+		}
+	}
+}
+
+func TestSession_CloseWithPendingQueueDone(t *testing.T) {
+	s := newMemStorage(t)
+	ctx := context.Background()
+	for i := int64(1); i <= 150; i++ {
+		if err := s.Pub(ctx, models.SseMessage{EventId: i, To: defaultToID, Message: []byte("msg")}, 60); err != nil {
+			t.Fatalf("Pub failed: %v", err)
+		}
+	}
+
+	session := NewSession(s, []string{defaultToID}, 0)
+	session.Start(true)
+
+	// Closing without reading drops the pending queue_done instead of blocking
+	done := make(chan struct{})
+	go func() {
+		session.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked on the pending queue_done")
+	}
+}
@@ -0,0 +1,237 @@
+package handlerv3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/app"
+	"github.com/ton-connect/bridge/internal/config"
+	handler_common "github.com/ton-connect/bridge/internal/handler"
+	"github.com/ton-connect/bridge/internal/utils"
+	"golang.org/x/net/websocket"
+	"golang.org/x/time/rate"
+)
+
+// Types of /bridge/ws frames
+const (
+	wsFrameMessage    = "message"
+	wsFrameQueueDone  = "queue_done"
+	wsFrameSend       = "send"
+	wsFrameSendResult = "send_result"
+)
+
+// wsMessage is a frame pushed to a /bridge/ws client. Data is the message as in
+// the data field of a /bridge/events message event.
+type wsMessage struct {
+	Type string `json:"type"`
+	ID   int64  `json:"id,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+// wsSend is a frame a /bridge/ws client sends a message with. ClientID may be
+// omitted when the connection subscribed to a single client_id.
+type wsSend struct {
+	batchMessage
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	ClientID  string `json:"client_id"`
+	TraceID   string `json:"trace_id"`
+}
+
+// wsSendResult answers a send frame, matched by its request_id
+type wsSendResult struct {
+	batchResult
+	Type      string `json:"type"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// wsPing writes a ping frame. The client answers with a pong, which the reader discards;
+// a dead connection shows up as a failed write.
+var wsPing = websocket.Codec{Marshal: func(interface{}) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+// WebSocketHandler serves /bridge/ws, an alternative to /bridge/events for clients behind
+// proxies that buffer SSE. It takes the /bridge/events params at handshake, pushes messages
+// as JSON frames, accepts send frames and sends pings instead of heartbeats.
+func (h *handler) WebSocketHandler(c echo.Context) error {
+	log := logrus.WithField("prefix", "WebSocketHandler")
+	params := c.QueryParams()
+
+	traceIdParam, ok := params["trace_id"]
+	traceIdValue := ""
+	if ok && len(traceIdParam) > 0 {
+		traceIdValue = traceIdParam[0]
+	}
+	traceId := handler_common.ParseOrGenerateTraceID(traceIdValue, ok && len(traceIdParam) > 0)
+
+	sub, err := h.parseSubscription(log, c.Request(), params, traceId)
+	if err != nil {
+		return c.JSON(utils.HttpResError(err.Error(), http.StatusBadRequest))
+	}
+
+	// Sends over the socket bypass the /bridge/message rate limiter, so limit them per connection
+	var limiter *rate.Limiter
+	if config.Config.RPSLimit > 0 && !app.SkipRateLimitsByToken(c.Request()) {
+		limiter = rate.NewLimiter(rate.Limit(config.Config.RPSLimit), config.Config.RPSLimit)
+	}
+
+	server := websocket.Server{
+		// Like /bridge/events, the bridge accepts any origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			h.serveWebSocket(ws, c.Request(), params, sub, traceId, limiter)
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// serveWebSocket pushes the session's messages to ws until the connection fails
+func (h *handler) serveWebSocket(ws *websocket.Conn, request *http.Request, params url.Values, sub subscription, traceId string, limiter *rate.Limiter) {
+	log := logrus.WithField("prefix", "WebSocketHandler")
+	if config.Config.MaxBodySize > 0 {
+		ws.MaxPayloadBytes = int(config.Config.MaxBodySize)
+	}
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+
+	connectIP := h.realIP.Extract(request)
+	session := h.CreateSession(sub.clientIds, sub.lastEventId, traceId)
+	h.trackConnection(request, connectIP, sub.clientIds)
+	defer func() {
+		session.Close()
+		h.removeConnection(session, traceId)
+		activeConnectionMetric.Dec()
+		log.Infof("connection: %v closed", session.ClientIds)
+	}()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		h.readWebSocket(ctx, ws, request, params, sub.clientIds, limiter)
+	}()
+
+	ticker := time.NewTicker(h.heartbeatInterval)
+	defer ticker.Stop()
+	session.Start(sub.queueDone)
+	for {
+		select {
+		case msg, ok := <-session.GetMessages():
+			if !ok {
+				// can't read from channel, session is closed
+				return
+			}
+			if msg.EventId == -1 {
+				// queue_done is the only event generated by the bridge
+				if err := websocket.JSON.Send(ws, wsMessage{Type: wsFrameQueueDone}); err != nil {
+					log.Errorf("event can't write to connection: %v", err)
+					return
+				}
+				continue
+			}
+
+			messageToSend, bridgeMsg := handler_common.WithConnectSource(msg.Message, connectIP)
+			if err := websocket.JSON.Send(ws, wsMessage{Type: wsFrameMessage, ID: msg.EventId, Data: string(messageToSend)}); err != nil {
+				log.Errorf("msg can't write to connection: %v", err)
+				return
+			}
+			h.messageSent(ctx, log, msg, bridgeMsg)
+		case <-session.Lagging():
+			// The missed messages are still stored, the client gets them after reconnecting
+			log.Warnf("disconnecting slow consumer %v", session.ClientIds)
+			slowConsumerDisconnectsMetric.Inc()
+			return
+		case <-ticker.C:
+			if err := wsPing.Send(ws, nil); err != nil {
+				log.Errorf("ticker can't write ping to connection: %v", err)
+				return
+			}
+		case <-readDone:
+			return
+		}
+	}
+}
+
+// readWebSocket handles the frames of a /bridge/ws client until the connection fails.
+// Every send frame gets a send_result frame.
+func (h *handler) readWebSocket(ctx context.Context, ws *websocket.Conn, request *http.Request, params url.Values, clientIds []string, limiter *rate.Limiter) {
+	log := logrus.WithField("prefix", "WebSocketHandler.read")
+	for {
+		var data []byte
+		err := websocket.Message.Receive(ws, &data)
+		if err != nil && !errors.Is(err, websocket.ErrFrameTooLarge) {
+			log.Debugf("connection read failed: %v", err)
+			return
+		}
+
+		var frame wsSend
+		result := wsSendResult{Type: wsFrameSendResult}
+		switch {
+		case err != nil:
+			badRequestMetric.Inc()
+			result.StatusCode, result.Message = http.StatusBadRequest, fmt.Sprintf("frame exceeds MAX_BODY_SIZE %d", ws.MaxPayloadBytes)
+		case json.Unmarshal(data, &frame) != nil:
+			badRequestMetric.Inc()
+			result.StatusCode, result.Message = http.StatusBadRequest, "frame must be a JSON object"
+		case frame.Type != wsFrameSend:
+			badRequestMetric.Inc()
+			result.RequestID = frame.RequestID
+			result.StatusCode, result.Message = http.StatusBadRequest, fmt.Sprintf("unsupported frame type %q", frame.Type)
+		case limiter != nil && !limiter.Allow():
+			result.RequestID = frame.RequestID
+			result.To = frame.To
+			result.StatusCode, result.Message = http.StatusTooManyRequests, "rate limit exceeded"
+		default:
+			result.RequestID = frame.RequestID
+			result.batchResult = h.sendWebSocketMessage(ctx, log, request, params, clientIds, frame)
+		}
+
+		if err := websocket.JSON.Send(ws, result); err != nil {
+			log.Debugf("send result can't write to connection: %v", err)
+			return
+		}
+	}
+}
+
+// sendWebSocketMessage validates and publishes a send frame like a /bridge/messages item,
+// waiting for storage
+func (h *handler) sendWebSocketMessage(ctx context.Context, log *logrus.Entry, request *http.Request, params url.Values, clientIds []string, frame wsSend) batchResult {
+	result := batchResult{To: frame.To}
+	clientID := frame.ClientID
+	if clientID == "" && len(clientIds) == 1 {
+		clientID = clientIds[0]
+	}
+	traceID := handler_common.ParseOrGenerateTraceID(frame.TraceID, frame.TraceID != "")
+	if !slices.Contains(clientIds, clientID) {
+		badRequestMetric.Inc()
+		result.StatusCode, result.Message = http.StatusBadRequest, "\"client_id\" must be one of the client ids of the connection"
+		log.Error(result.Message)
+		return result
+	}
+
+	msg, ttl, err := h.newBatchMessage(request, params, clientID, frame.batchMessage, traceID)
+	if err != nil {
+		badRequestMetric.Inc()
+		log.Error(err)
+		result.StatusCode, result.Message = http.StatusBadRequest, err.Error()
+		if h.eventCollector != nil {
+			_ = h.eventCollector.TryAdd(h.eventBuilder.NewBridgeMessageValidationFailedEvent(clientID, traceID, frame.Topic, ""))
+		}
+		return result
+	}
+
+	pubCtx, cancel := context.WithTimeout(ctx, h.publishTimeout)
+	err = h.publish(pubCtx, msg, ttl, "sync")
+	cancel()
+	h.publishResult(log, &result, msg, err, clientID, traceID, frame.Topic)
+	return result
+}
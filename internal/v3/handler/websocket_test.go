@@ -0,0 +1,184 @@
+package handlerv3
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ton-connect/bridge/internal/models"
+	"github.com/ton-connect/bridge/internal/ntp"
+	"github.com/ton-connect/bridge/internal/utils"
+	storagev3 "github.com/ton-connect/bridge/internal/v3/storage"
+	"golang.org/x/net/websocket"
+)
+
+// wsFrame is any /bridge/ws frame as seen by a client
+type wsFrame struct {
+	Type       string `json:"type"`
+	ID         int64  `json:"id"`
+	Data       string `json:"data"`
+	RequestID  string `json:"request_id"`
+	EventID    int64  `json:"event_id"`
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message"`
+}
+
+func newWebSocketServer(t *testing.T, s storagev3.Storage) string {
+	extractor, err := utils.NewRealIPExtractor([]string{})
+	if err != nil {
+		t.Fatalf("failed to create RealIPExtractor: %v", err)
+	}
+	h := NewHandler(s, time.Minute, extractor, ntp.NewLocalTimeProvider(), nil, nil)
+	e := echo.New()
+	e.GET("/bridge/ws", h.WebSocketHandler)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func dialWebSocket(t *testing.T, serverURL, query string) *websocket.Conn {
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(serverURL, "http")+"/bridge/ws?"+query, "", serverURL)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func nextFrame(t *testing.T, ws *websocket.Conn) wsFrame {
+	t.Helper()
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var frame wsFrame
+	if err := websocket.JSON.Receive(ws, &frame); err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	return frame
+}
+
+func TestWebSocketHandler_History(t *testing.T) {
+	memStorage := newMemStorage(t)
+	for i, text := range []string{"old", "new"} {
+		mes, _ := json.Marshal(models.BridgeMessage{From: defaultToID, Message: text})
+		if err := memStorage.Pub(context.Background(), models.SseMessage{EventId: int64(i + 1), Message: mes, To: defaultClientID}, 60); err != nil {
+			t.Fatalf("Pub() error = %v", err)
+		}
+	}
+	serverURL := newWebSocketServer(t, memStorage)
+
+	ws := dialWebSocket(t, serverURL, "client_id="+defaultClientID+"&last_event_id=1&enable_queue_done_event=true")
+
+	frame := nextFrame(t, ws)
+	if frame.Type != "message" || frame.ID != 2 {
+		t.Fatalf("expected message 2, got %+v", frame)
+	}
+	var bridgeMsg models.BridgeMessage
+	if err := json.Unmarshal([]byte(frame.Data), &bridgeMsg); err != nil {
+		t.Fatalf("data is not a bridge message: %v", err)
+	}
+	if bridgeMsg.Message != "new" || bridgeMsg.BridgeConnectSource.IP != "127.0.0.1" {
+		t.Errorf("unexpected message %+v", bridgeMsg)
+	}
+	if frame := nextFrame(t, ws); frame.Type != "queue_done" {
+		t.Errorf("expected queue_done, got %+v", frame)
+	}
+}
+
+func TestWebSocketHandler_Send(t *testing.T) {
+	serverURL := newWebSocketServer(t, newMemStorage(t))
+	ws := dialWebSocket(t, serverURL, "client_id="+defaultClientID+","+defaultToID+"&no_request_source=true")
+
+	send := func(frame string) {
+		t.Helper()
+		if err := websocket.Message.Send(ws, frame); err != nil {
+			t.Fatalf("failed to send frame: %v", err)
+		}
+	}
+
+	tCases := map[string]struct {
+		frame          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		"not json": {
+			frame:          "hello",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "frame must be a JSON object",
+		},
+		"unsupported type": {
+			frame:          `{"type":"subscribe","request_id":"1"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `unsupported frame type "subscribe"`,
+		},
+		"client_id required with several ids": {
+			frame:          `{"type":"send","request_id":"2","to":"` + defaultToID + `","ttl":60,"message":"m"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "must be one of the client ids",
+		},
+		"invalid ttl": {
+			frame:          `{"type":"send","request_id":"3","client_id":"` + defaultClientID + `","to":"` + defaultToID + `","ttl":500,"message":"m"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			send(tc.frame)
+			frame := nextFrame(t, ws)
+			if frame.Type != "send_result" || frame.StatusCode != tc.expectedStatus {
+				t.Fatalf("expected send_result %d, got %+v", tc.expectedStatus, frame)
+			}
+			if !strings.Contains(frame.Message, tc.expectedBody) {
+				t.Errorf("expected message to contain %q, got %q", tc.expectedBody, frame.Message)
+			}
+		})
+	}
+
+	// The connection is subscribed to the recipient too, so it gets the message it sent
+	send(`{"type":"send","request_id":"4","client_id":"` + defaultClientID + `","to":"` + defaultToID + `","ttl":60,"message":"payload"}`)
+	frames := map[string]wsFrame{}
+	for range 2 {
+		frame := nextFrame(t, ws)
+		frames[frame.Type] = frame
+	}
+	result, message := frames["send_result"], frames["message"]
+	if result.RequestID != "4" || result.StatusCode != http.StatusOK || result.EventID == 0 {
+		t.Fatalf("unexpected send result %+v", result)
+	}
+	if message.ID != result.EventID {
+		t.Fatalf("expected message %d, got %+v", result.EventID, message)
+	}
+	var bridgeMsg models.BridgeMessage
+	if err := json.Unmarshal([]byte(message.Data), &bridgeMsg); err != nil {
+		t.Fatalf("data is not a bridge message: %v", err)
+	}
+	if bridgeMsg.From != defaultClientID || bridgeMsg.Message != "payload" {
+		t.Errorf("unexpected message %+v", bridgeMsg)
+	}
+}
+
+func TestWebSocketHandler_InvalidParams(t *testing.T) {
+	serverURL := newWebSocketServer(t, newMemStorage(t))
+
+	for name, query := range map[string]string{
+		"missing client_id":     "",
+		"invalid client_id":     "client_id=invalid",
+		"invalid last_event_id": "client_id=" + defaultClientID + "&last_event_id=abc",
+	} {
+		t.Run(name, func(t *testing.T) {
+			res, err := http.Get(serverURL + "/bridge/ws?" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package storagev3
+
+import (
+	"context"
+
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+// BatchMessage is one message of a batch publish with its TTL in seconds
+type BatchMessage struct {
+	Message models.SseMessage
+	TTL     int64
+}
+
+// BatchPublisher is implemented by storages that publish several messages at once,
+// cheaper than one Pub per message. Each message is stored or rejected on its own:
+// the result has one error per message, nil for the published ones.
+type BatchPublisher interface {
+	PubBatch(ctx context.Context, messages []BatchMessage) []error
+}
+
+// PubBatch publishes messages with the storage's PubBatch, or one by one with Pub
+// when the storage does not implement BatchPublisher
+func PubBatch(ctx context.Context, s Storage, messages []BatchMessage) []error {
+	if publisher, ok := s.(BatchPublisher); ok {
+		return publisher.PubBatch(ctx, messages)
+	}
+	errs := make([]error, len(messages))
+	for i, m := range messages {
+		errs[i] = s.Pub(ctx, m.Message, m.TTL)
+	}
+	return errs
+}
@@ -0,0 +1,536 @@
+package storagev3
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+const (
+	// inboxCacheFeedBuffer is the buffer of the channel CachedStorage subscribes to the backend with
+	inboxCacheFeedBuffer = 10000
+	// inboxCacheTombstoneTTL is how long removals of messages the cache has not seen yet are
+	// remembered, in case the message arrives from the backend after its removal notice
+	inboxCacheTombstoneTTL = 10 * time.Second
+	// feedLoaded marks the end of the history the backend replayed into the feed for a key
+	feedLoaded int64 = -1
+)
+
+var (
+	inboxCacheHits   atomic.Int64
+	inboxCacheMisses atomic.Int64
+
+	inboxCacheLookupsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_inbox_cache_lookups",
+		Help: "The total number of inbox history lookups served from the local cache (hit) or from the storage (miss)",
+	}, []string{"result"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "inbox_cache_hit_ratio",
+		Help: "Share of inbox history lookups served from the local cache since start",
+	}, func() float64 {
+		hits, misses := inboxCacheHits.Load(), inboxCacheMisses.Load()
+		if hits+misses == 0 {
+			return 0
+		}
+		return float64(hits) / float64(hits+misses)
+	})
+	inboxCacheMessagesMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "inbox_cache_messages",
+		Help: "The number of messages kept in the local inbox cache",
+	})
+)
+
+// CachedStorage keeps the inboxes of clients subscribed on this instance in memory in
+// front of any backend, so SSE reconnects are replayed without reading the backend.
+// It holds a single backend subscription per key and fans the messages out to its own
+// subscribers. Backends implementing RemovalWatcher keep the cached inboxes in step with
+// acks and quota evictions on every instance; other backends only see the acks made
+// through this instance, which is exact for single-instance backends.
+type CachedStorage struct {
+	Storage
+	cache  *inboxCache
+	linger time.Duration
+	feed   chan models.SseMessage
+
+	subscribers map[string][]chan<- models.SseMessage
+	fed         map[string]bool          // keys subscribed at the backend with feed
+	loading     map[string]chan struct{} // closed once the history of a newly fed key is cached
+	lingering   map[string]*time.Timer   // pending backend unsubscribes of keys without subscribers
+	subMutex    sync.RWMutex
+	replay      *replayGate
+}
+
+// NewCachedStorage wraps backend with an inbox cache of up to maxSize messages. Inboxes
+// are kept for linger after their last subscriber is gone, to serve reconnects.
+func NewCachedStorage(backend Storage, maxSize int, linger time.Duration) *CachedStorage {
+	s := &CachedStorage{
+		Storage:     backend,
+		cache:       newInboxCache(maxSize),
+		linger:      linger,
+		feed:        make(chan models.SseMessage, inboxCacheFeedBuffer),
+		subscribers: make(map[string][]chan<- models.SseMessage),
+		fed:         make(map[string]bool),
+		loading:     make(map[string]chan struct{}),
+		lingering:   make(map[string]*time.Timer),
+		replay:      newReplayGate(),
+	}
+	if watcher, ok := backend.(RemovalWatcher); ok {
+		watcher.WatchRemovals(s.cache.remove)
+	}
+	go s.pump()
+	return s
+}
+
+func (s *CachedStorage) Sub(ctx context.Context, keys []string, lastEventId int64, messageCh chan<- models.SseMessage) error {
+	log := log.WithField("prefix", "CachedStorage.Sub")
+
+	s.subMutex.Lock()
+	for _, key := range keys {
+		s.subscribers[key] = append(s.subscribers[key], messageCh)
+		if timer, ok := s.lingering[key]; ok {
+			timer.Stop()
+			delete(s.lingering, key)
+		}
+	}
+	s.replay.open(messageCh)
+	var feedKeys []string
+	for _, key := range keys {
+		if !s.fed[key] {
+			s.fed[key] = true
+			s.loading[key] = make(chan struct{})
+			s.cache.begin(key)
+			feedKeys = append(feedKeys, key)
+		}
+	}
+	s.subMutex.Unlock()
+
+	if len(feedKeys) > 0 {
+		// The backend replays the stored messages into the feed before it returns,
+		// the markers behind them complete the cached inboxes
+		if err := s.Storage.Sub(ctx, feedKeys, 0, s.feed); err != nil {
+			log.Errorf("failed to subscribe to the storage: %v", err)
+			for _, key := range feedKeys {
+				s.cache.drop(key)
+			}
+		}
+		for _, key := range feedKeys {
+			s.feed <- models.SseMessage{EventId: feedLoaded, To: key}
+		}
+	}
+
+	loaded := make(map[string]bool, len(feedKeys))
+	for _, key := range feedKeys {
+		loaded[key] = true
+	}
+	var history []models.SseMessage
+	for _, key := range keys {
+		s.subMutex.RLock()
+		done := s.loading[key]
+		s.subMutex.RUnlock()
+		if done != nil {
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+		}
+
+		var messages []models.SseMessage
+		ok := false
+		if loaded[key] {
+			// Read from the backend by this call, counted as a miss
+			messages, ok = s.cache.lookup(key)
+			recordInboxCacheLookup(false)
+		} else {
+			messages, ok = s.cache.get(key)
+		}
+		if !ok {
+			messages = s.load(ctx, key)
+		}
+		history = append(history, messages...)
+	}
+
+	s.subMutex.Lock()
+	replayHistory(messageCh, history, s.replay.release(messageCh), lastEventId)
+	s.subMutex.Unlock()
+	return nil
+}
+
+// load reads the stored messages of a fed key whose inbox is not cached and caches them again
+func (s *CachedStorage) load(ctx context.Context, key string) []models.SseMessage {
+	log := log.WithField("prefix", "CachedStorage.load")
+
+	s.cache.begin(key)
+	ch := make(chan models.SseMessage, inboxCacheFeedBuffer)
+	if err := s.Storage.Sub(ctx, []string{key}, 0, ch); err != nil {
+		log.Errorf("failed to read the inbox from the storage: %v", err)
+		s.cache.drop(key)
+		return nil
+	}
+	if err := s.Storage.Unsub(ctx, []string{key}, ch); err != nil {
+		log.Warnf("failed to unsubscribe from the storage: %v", err)
+	}
+
+	history := make([]models.SseMessage, 0, len(ch))
+	for len(ch) > 0 {
+		history = append(history, <-ch)
+	}
+	s.cache.fill(key, history)
+	return history
+}
+
+func (s *CachedStorage) Unsub(ctx context.Context, keys []string, messageCh chan<- models.SseMessage) error {
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	for _, key := range keys {
+		subscribers := s.subscribers[key]
+		for i, ch := range subscribers {
+			if ch == messageCh {
+				subscribers = append(subscribers[:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(subscribers) > 0 {
+			s.subscribers[key] = subscribers
+			continue
+		}
+		delete(s.subscribers, key)
+		if s.fed[key] {
+			s.unfeedLater(key)
+		}
+	}
+	s.replay.release(messageCh)
+	return nil
+}
+
+// unfeedLater keeps the backend subscription and the cached inbox of a key without
+// subscribers for the linger time, so a reconnect is served from the cache.
+// Should be called with subMutex locked
+func (s *CachedStorage) unfeedLater(key string) {
+	var timer *time.Timer
+	timer = time.AfterFunc(s.linger, func() {
+		log := log.WithField("prefix", "CachedStorage.unfeedLater")
+
+		s.subMutex.Lock()
+		defer s.subMutex.Unlock()
+		if s.lingering[key] != timer {
+			return
+		}
+		delete(s.lingering, key)
+		if len(s.subscribers[key]) > 0 {
+			return
+		}
+		// Unsubscribed under subMutex, so a new Sub cannot feed the key in between
+		if err := s.Storage.Unsub(context.Background(), []string{key}, s.feed); err != nil {
+			log.Warnf("failed to unsubscribe from the storage: %v", err)
+		}
+		delete(s.fed, key)
+		s.cache.drop(key)
+	})
+	s.lingering[key] = timer
+}
+
+// pump caches the messages the backend sends to the feed and fans them out to the subscribers
+func (s *CachedStorage) pump() {
+	for msg := range s.feed {
+		if msg.EventId == feedLoaded {
+			s.cache.fill(msg.To, nil)
+			s.subMutex.Lock()
+			if done, ok := s.loading[msg.To]; ok {
+				close(done)
+				delete(s.loading, msg.To)
+			}
+			s.subMutex.Unlock()
+			continue
+		}
+		if !s.cache.add(msg.To, msg) {
+			// Already sent, e.g. replayed again after the backend reconnected
+			continue
+		}
+		s.subMutex.RLock()
+		if _, ok := s.loading[msg.To]; ok {
+			// History replayed by the backend, or live messages during the load: the
+			// subscribers read them from the cached inbox once it is complete
+			s.subMutex.RUnlock()
+			continue
+		}
+		for _, ch := range s.subscribers[msg.To] {
+			if s.replay.hold(ch, msg) {
+				continue
+			}
+			deliver(ch, msg, dropLiveBufferFull)
+		}
+		s.subMutex.RUnlock()
+	}
+}
+
+func (s *CachedStorage) Ack(ctx context.Context, clientID string, eventID int64) error {
+	if err := s.Storage.Ack(ctx, clientID, eventID); err != nil {
+		return err
+	}
+	s.cache.remove(clientID, []int64{eventID})
+	return nil
+}
+
+// MarkDelivered forwards to the backend if it is a DeliveryTracker
+func (s *CachedStorage) MarkDelivered(ctx context.Context, eventID int64) error {
+	if tracker, ok := s.Storage.(DeliveryTracker); ok {
+		return tracker.MarkDelivered(ctx, eventID)
+	}
+	return nil
+}
+
+// PubBatch forwards to the backend, see the PubBatch function
+func (s *CachedStorage) PubBatch(ctx context.Context, messages []BatchMessage) []error {
+	return PubBatch(ctx, s.Storage, messages)
+}
+
+type cachedInbox struct {
+	key      string
+	loading  bool // history is being read from the backend; live messages are collected meanwhile
+	messages []models.SseMessage
+	removed  map[int64]time.Time // removals of messages not seen yet
+}
+
+// inboxCache holds the inboxes cached by CachedStorage. Cached inboxes are kept up to date
+// with the messages and removal notices from the backend; inboxes the cache cannot follow,
+// e.g. with messages of unknown expiry, are dropped and read from the backend again.
+type inboxCache struct {
+	mu      sync.Mutex
+	inboxes map[string]*list.Element
+	order   *list.List // most recently used at the front
+	size    int        // cached messages
+	maxSize int
+	timeNow func() time.Time
+}
+
+func newInboxCache(maxSize int) *inboxCache {
+	return &inboxCache{
+		inboxes: make(map[string]*list.Element),
+		order:   list.New(),
+		maxSize: maxSize,
+		timeNow: time.Now,
+	}
+}
+
+func recordInboxCacheLookup(hit bool) {
+	if hit {
+		inboxCacheHits.Add(1)
+		inboxCacheLookupsMetric.WithLabelValues("hit").Inc()
+		return
+	}
+	inboxCacheMisses.Add(1)
+	inboxCacheLookupsMetric.WithLabelValues("miss").Inc()
+}
+
+// get returns the cached, not yet expired messages of the inbox and counts the lookup
+func (c *inboxCache) get(key string) ([]models.SseMessage, bool) {
+	messages, ok := c.lookup(key)
+	recordInboxCacheLookup(ok)
+	return messages, ok
+}
+
+// lookup is get without counting the lookup
+func (c *inboxCache) lookup(key string) ([]models.SseMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.inboxes[key]
+	if !ok || e.Value.(*cachedInbox).loading {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	inbox := e.Value.(*cachedInbox)
+	now := c.timeNow().Unix()
+	messages := make([]models.SseMessage, 0, len(inbox.messages))
+	for _, m := range inbox.messages {
+		if m.ExpireAt > now {
+			messages = append(messages, m)
+		}
+	}
+	return messages, true
+}
+
+// begin starts loading the inbox; live messages added until fill are kept
+func (c *inboxCache) begin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.inboxes[key]; ok {
+		inbox := e.Value.(*cachedInbox)
+		if inbox.loading {
+			return
+		}
+		c.removeInbox(e)
+	}
+	c.inboxes[key] = c.order.PushFront(&cachedInbox{key: key, loading: true})
+}
+
+// fill completes loading with the history read from the backend. It is a no-op when
+// the inbox was dropped meanwhile or another load has completed it.
+func (c *inboxCache) fill(key string, history []models.SseMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.inboxes[key]
+	if !ok {
+		return
+	}
+	inbox := e.Value.(*cachedInbox)
+	if !inbox.loading {
+		return
+	}
+
+	seen := make(map[int64]struct{}, len(history))
+	messages := make([]models.SseMessage, 0, len(history)+len(inbox.messages))
+	for _, m := range history {
+		if _, removed := inbox.removed[m.EventId]; removed {
+			continue
+		}
+		seen[m.EventId] = struct{}{}
+		messages = append(messages, m)
+	}
+	for _, m := range inbox.messages {
+		if _, ok := seen[m.EventId]; !ok {
+			messages = append(messages, m)
+		}
+	}
+	for _, m := range messages {
+		if m.ExpireAt == 0 {
+			c.removeInbox(e)
+			return
+		}
+	}
+	c.size += len(messages) - len(inbox.messages)
+	inbox.messages = messages
+	inbox.loading = false
+	c.evictOverflow()
+}
+
+// add appends a live message to the inbox if it is cached. Returns false if the
+// message is already in the inbox.
+func (c *inboxCache) add(key string, msg models.SseMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.inboxes[key]
+	if !ok {
+		return true
+	}
+	inbox := e.Value.(*cachedInbox)
+	if msg.ExpireAt == 0 {
+		c.removeInbox(e)
+		return true
+	}
+
+	now := c.timeNow()
+	live := inbox.messages[:0]
+	duplicate := false
+	for _, m := range inbox.messages {
+		if m.EventId == msg.EventId {
+			duplicate = true
+		}
+		if m.ExpireAt > now.Unix() {
+			live = append(live, m)
+		}
+	}
+	c.size -= len(inbox.messages) - len(live)
+	inbox.messages = live
+	c.pruneRemoved(inbox, now)
+	if duplicate {
+		inboxCacheMessagesMetric.Set(float64(c.size))
+		return false
+	}
+	if _, removed := inbox.removed[msg.EventId]; removed {
+		inboxCacheMessagesMetric.Set(float64(c.size))
+		return true
+	}
+
+	inbox.messages = append(inbox.messages, msg)
+	c.size++
+	c.evictOverflow()
+	return true
+}
+
+// remove deletes acked or evicted messages from the inbox. Nil eventIDs drop the inbox,
+// as removals may have been missed.
+func (c *inboxCache) remove(key string, eventIDs []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.inboxes[key]
+	if !ok {
+		return
+	}
+	if eventIDs == nil {
+		c.removeInbox(e)
+		return
+	}
+	inbox := e.Value.(*cachedInbox)
+	now := c.timeNow()
+	c.pruneRemoved(inbox, now)
+	for _, id := range eventIDs {
+		found := false
+		for i, m := range inbox.messages {
+			if m.EventId == id {
+				inbox.messages = append(inbox.messages[:i], inbox.messages[i+1:]...)
+				c.size--
+				found = true
+				break
+			}
+		}
+		if !found {
+			if inbox.removed == nil {
+				inbox.removed = make(map[int64]time.Time)
+			}
+			inbox.removed[id] = now
+		}
+	}
+	inboxCacheMessagesMetric.Set(float64(c.size))
+}
+
+// drop forgets the inbox, the next lookup reads it from the backend
+func (c *inboxCache) drop(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.inboxes[key]; ok {
+		c.removeInbox(e)
+	}
+}
+
+// pruneRemoved forgets removals older than inboxCacheTombstoneTTL. Should be called with mu locked
+func (c *inboxCache) pruneRemoved(inbox *cachedInbox, now time.Time) {
+	for id, at := range inbox.removed {
+		if now.Sub(at) >= inboxCacheTombstoneTTL {
+			delete(inbox.removed, id)
+		}
+	}
+}
+
+// evictOverflow drops least recently used inboxes until the cache fits maxSize.
+// Should be called with mu locked
+func (c *inboxCache) evictOverflow() {
+	for c.size > c.maxSize {
+		back := c.order.Back()
+		if back == nil {
+			break
+		}
+		c.removeInbox(back)
+	}
+	inboxCacheMessagesMetric.Set(float64(c.size))
+}
+
+// removeInbox deletes an inbox. Should be called with mu locked
+func (c *inboxCache) removeInbox(e *list.Element) {
+	inbox := c.order.Remove(e).(*cachedInbox)
+	delete(c.inboxes, inbox.key)
+	c.size -= len(inbox.messages)
+	inboxCacheMessagesMetric.Set(float64(c.size))
+}
@@ -0,0 +1,192 @@
+package storagev3
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+func newCachedMessage(to string, eventID int64, expireAt time.Time) models.SseMessage {
+	return models.SseMessage{EventId: eventID, To: to, ExpireAt: expireAt.Unix()}
+}
+
+func cachedIds(messages []models.SseMessage) []int64 {
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.EventId
+	}
+	return ids
+}
+
+func TestInboxCache(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Minute)
+	c := newInboxCache(100)
+	c.timeNow = func() time.Time { return now }
+
+	if _, ok := c.get("1"); ok {
+		t.Fatal("get() hit before the inbox was loaded")
+	}
+
+	// Live messages during the load are merged with the history
+	c.begin("1")
+	c.add("1", newCachedMessage("1", 3, later))
+	if _, ok := c.get("1"); ok {
+		t.Fatal("get() hit while the inbox is loading")
+	}
+	c.fill("1", []models.SseMessage{
+		newCachedMessage("1", 1, later),
+		newCachedMessage("1", 2, now.Add(time.Second)),
+		newCachedMessage("1", 3, later),
+	})
+	if !c.add("1", newCachedMessage("1", 4, later)) {
+		t.Error("add() reported a new message as a duplicate")
+	}
+	if c.add("1", newCachedMessage("1", 4, later)) {
+		t.Error("add() did not report a duplicate")
+	}
+	c.remove("1", []int64{1})
+
+	got, ok := c.get("1")
+	if !ok {
+		t.Fatal("get() missed a loaded inbox")
+	}
+	if want := []int64{2, 3, 4}; !reflect.DeepEqual(cachedIds(got), want) {
+		t.Errorf("get() = %v, want %v", cachedIds(got), want)
+	}
+
+	// Expired messages are not replayed
+	now = now.Add(2 * time.Second)
+	got, _ = c.get("1")
+	if want := []int64{3, 4}; !reflect.DeepEqual(cachedIds(got), want) {
+		t.Errorf("get() = %v, want %v", cachedIds(got), want)
+	}
+
+	// Messages removed before they arrive are not cached
+	c.remove("1", []int64{5})
+	c.add("1", newCachedMessage("1", 5, later))
+	got, _ = c.get("1")
+	if want := []int64{3, 4}; !reflect.DeepEqual(cachedIds(got), want) {
+		t.Errorf("get() = %v, want %v", cachedIds(got), want)
+	}
+
+	// Missed removals drop the inbox
+	c.remove("1", nil)
+	if _, ok := c.get("1"); ok {
+		t.Error("get() hit an inbox with missed removals")
+	}
+
+	// Messages for inboxes that are not cached are ignored
+	c.add("2", newCachedMessage("2", 5, later))
+	if _, ok := c.get("2"); ok {
+		t.Error("get() hit an inbox that was never loaded")
+	}
+
+	// Inboxes dropped during the load stay uncached
+	c.begin("3")
+	c.drop("3")
+	c.fill("3", nil)
+	if _, ok := c.get("3"); ok {
+		t.Error("get() hit an inbox dropped during the load")
+	}
+
+	// Messages of unknown expiry are not cached
+	c.begin("4")
+	c.fill("4", []models.SseMessage{{EventId: 6, To: "4"}})
+	if _, ok := c.get("4"); ok {
+		t.Error("get() hit an inbox with a message of unknown expiry")
+	}
+}
+
+func TestInboxCache_Eviction(t *testing.T) {
+	later := time.Now().Add(time.Minute)
+
+	// Least recently used inboxes go first when the cache is full
+	c := newInboxCache(3)
+	c.begin("1")
+	c.fill("1", []models.SseMessage{newCachedMessage("1", 1, later), newCachedMessage("1", 2, later)})
+	c.begin("2")
+	c.fill("2", []models.SseMessage{newCachedMessage("2", 3, later)})
+	c.get("1")
+	c.add("2", newCachedMessage("2", 4, later))
+	if _, ok := c.get("2"); ok {
+		t.Error("get() hit the least recently used inbox of a full cache")
+	}
+	if _, ok := c.get("1"); !ok {
+		t.Error("get() missed a recently used inbox")
+	}
+}
+
+func receiveIds(t *testing.T, ch <-chan models.SseMessage, n int) []int64 {
+	t.Helper()
+	ids := make([]int64, 0, n)
+	for len(ids) < n {
+		select {
+		case msg := <-ch:
+			ids = append(ids, msg.EventId)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v, want %d messages", ids, n)
+		}
+	}
+	return ids
+}
+
+func TestCachedStorage(t *testing.T) {
+	backend, err := NewMemStorage(nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	s := NewCachedStorage(backend, 100, time.Minute)
+	ctx := context.Background()
+
+	for _, id := range []int64{1, 2} {
+		if err := s.Pub(ctx, models.SseMessage{EventId: id, To: "1", Message: []byte("msg")}, 60); err != nil {
+			t.Fatalf("Pub failed: %v", err)
+		}
+	}
+
+	ch := make(chan models.SseMessage, 10)
+	if err := s.Sub(ctx, []string{"1"}, 0, ch); err != nil {
+		t.Fatalf("Sub failed: %v", err)
+	}
+	if got, want := receiveIds(t, ch, 2), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if err := s.Pub(ctx, models.SseMessage{EventId: 3, To: "1", Message: []byte("msg")}, 60); err != nil {
+		t.Fatalf("Pub failed: %v", err)
+	}
+	if got, want := receiveIds(t, ch, 1), []int64{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+	if err := s.Unsub(ctx, []string{"1"}, ch); err != nil {
+		t.Fatalf("Unsub failed: %v", err)
+	}
+
+	// An ack made on the backend directly, like another instance would, reaches the cache
+	if err := backend.Ack(ctx, "1", 1); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+
+	hits := inboxCacheHits.Load()
+	ch = make(chan models.SseMessage, 10)
+	if err := s.Sub(ctx, []string{"1"}, 0, ch); err != nil {
+		t.Fatalf("Sub failed: %v", err)
+	}
+	if got, want := receiveIds(t, ch, 2), []int64{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if inboxCacheHits.Load() != hits+1 {
+		t.Error("reconnect was not served from the cache")
+	}
+
+	// Acks through the wrapper drop the message as well
+	if err := s.Ack(ctx, "1", 2); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if got, _ := s.cache.get("1"); !reflect.DeepEqual(cachedIds(got), []int64{3}) {
+		t.Errorf("cached %v after ack, want [3]", cachedIds(got))
+	}
+}
@@ -0,0 +1,94 @@
+package storagev3_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ton-connect/bridge/internal/analytics"
+	storagev3 "github.com/ton-connect/bridge/internal/v3/storage"
+	"github.com/ton-connect/bridge/internal/v3/storage/storagev3test"
+)
+
+func testBuilder() analytics.EventBuilder {
+	return analytics.NewEventBuilder("http://test", "test", "bridge", "1.0.0", "-239")
+}
+
+func TestConformance_Memory(t *testing.T) {
+	storagev3test.Run(t, func(t *testing.T) storagev3.Storage {
+		s, err := storagev3.NewMemStorage(analytics.NewCollector(10, nil, 0), testBuilder())
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+		return s
+	})
+}
+
+func TestConformance_Sqlite(t *testing.T) {
+	storagev3test.Run(t, func(t *testing.T) storagev3.Storage {
+		s, err := storagev3.NewSqliteStorage(filepath.Join(t.TempDir(), "bridge.db"), analytics.NewCollector(10, nil, 0), testBuilder())
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+		return s
+	})
+}
+
+func TestConformance_Valkey(t *testing.T) {
+	uri := os.Getenv("VALKEY_URI")
+	if uri == "" {
+		uri = os.Getenv("REDIS_URI")
+	}
+	if uri == "" {
+		t.Skip("Skipping Valkey integration test: VALKEY_URI or REDIS_URI not set")
+	}
+	storagev3test.Run(t, func(t *testing.T) storagev3.Storage {
+		s, err := storagev3.NewValkeyStorage(uri, analytics.NewCollector(10, nil, 0), testBuilder())
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+		return s
+	})
+}
+
+func TestConformance_Postgres(t *testing.T) {
+	uri := os.Getenv("POSTGRES_URI")
+	if uri == "" {
+		t.Skip("Skipping PostgreSQL integration test: POSTGRES_URI not set")
+	}
+	storagev3test.Run(t, func(t *testing.T) storagev3.Storage {
+		s, err := storagev3.NewPgStorage(uri, analytics.NewCollector(10, nil, 0), testBuilder())
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+		return s
+	})
+}
+
+func TestConformance_CachedMemory(t *testing.T) {
+	storagev3test.Run(t, func(t *testing.T) storagev3.Storage {
+		s, err := storagev3.NewMemStorage(analytics.NewCollector(10, nil, 0), testBuilder())
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+		return storagev3.NewCachedStorage(s, 1000, time.Minute)
+	})
+}
+
+func TestConformance_CachedValkey(t *testing.T) {
+	uri := os.Getenv("VALKEY_URI")
+	if uri == "" {
+		uri = os.Getenv("REDIS_URI")
+	}
+	if uri == "" {
+		t.Skip("Skipping Valkey integration test: VALKEY_URI or REDIS_URI not set")
+	}
+	storagev3test.Run(t, func(t *testing.T) storagev3.Storage {
+		s, err := storagev3.NewValkeyStorage(uri, analytics.NewCollector(10, nil, 0), testBuilder())
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+		return storagev3.NewCachedStorage(s, 1000, time.Minute)
+	})
+}
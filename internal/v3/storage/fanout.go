@@ -0,0 +1,91 @@
+package storagev3
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/config"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+// Reasons a message was not delivered to a subscriber
+const (
+	dropLiveBufferFull   = "live_buffer_full"   // live message, subscriber channel full
+	dropReplayBufferFull = "replay_buffer_full" // history replay, subscriber channel full
+	dropLagging          = "lagging"            // subscriber already missed a message and is being disconnected
+	dropDecodeError      = "decode_error"       // message from the backend could not be decoded
+	dropFetchError       = "fetch_error"        // notified message could not be read from the backend
+)
+
+var droppedMessagesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_dropped_messages",
+	Help: "The total number of messages not delivered to a subscriber, by reason",
+}, []string{"reason"})
+
+// slowConsumer is a subscriber watched by its session
+type slowConsumer struct {
+	lagging   atomic.Bool
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// slowConsumers maps subscriber channels to their watchers
+var slowConsumers sync.Map // chan<- models.SseMessage -> *slowConsumer
+
+// WatchSlowConsumer registers a subscriber channel and returns a channel that is closed
+// when the subscriber missed a message and SLOW_CONSUMER_POLICY is "disconnect".
+// From then on the subscriber gets no further messages, so its Last-Event-ID stays
+// before the gap and a reconnect replays everything it missed.
+func WatchSlowConsumer(ch chan<- models.SseMessage) <-chan struct{} {
+	c := &slowConsumer{done: make(chan struct{})}
+	slowConsumers.Store(ch, c)
+	return c.done
+}
+
+// UnwatchSlowConsumer forgets a subscriber channel registered with WatchSlowConsumer
+func UnwatchSlowConsumer(ch chan<- models.SseMessage) {
+	slowConsumers.Delete(ch)
+}
+
+// deliver sends msg to a subscriber without blocking. A message that cannot be
+// delivered is reported with the given reason, see missed.
+func deliver(ch chan<- models.SseMessage, msg models.SseMessage, reason string) {
+	if v, ok := slowConsumers.Load(ch); ok && v.(*slowConsumer).lagging.Load() {
+		dropMessage(msg, dropLagging)
+		return
+	}
+
+	select {
+	case ch <- msg:
+	default:
+		missed(ch, msg, reason)
+	}
+}
+
+// missed records a message the subscriber did not get. Under the disconnect policy
+// the subscriber is marked as lagging and its session is signalled to reconnect.
+func missed(ch chan<- models.SseMessage, msg models.SseMessage, reason string) {
+	dropMessage(msg, reason)
+	if config.Config.SlowConsumerPolicy != "disconnect" {
+		return
+	}
+	if v, ok := slowConsumers.Load(ch); ok {
+		c := v.(*slowConsumer)
+		c.lagging.Store(true)
+		c.closeOnce.Do(func() { close(c.done) })
+	}
+}
+
+// dropMessage counts and logs a message that was not delivered
+func dropMessage(msg models.SseMessage, reason string) {
+	droppedMessagesMetric.WithLabelValues(reason).Inc()
+	log.WithFields(log.Fields{
+		"prefix":   "storagev3.deliver",
+		"to":       msg.To,
+		"event_id": msg.EventId,
+		"reason":   reason,
+	}).Warn("message not delivered to subscriber")
+}
@@ -0,0 +1,64 @@
+package storagev3
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ton-connect/bridge/internal/analytics"
+	"github.com/ton-connect/bridge/internal/config"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+func TestMemStorage_SlowConsumer(t *testing.T) {
+	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
+
+	tests := []struct {
+		name           string
+		policy         string
+		wantDisconnect bool
+		wantIds        []int64
+	}{
+		{name: "drop", policy: "drop", wantDisconnect: false, wantIds: []int64{1, 3}},
+		{name: "disconnect", policy: "disconnect", wantDisconnect: true, wantIds: []int64{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.SlowConsumerPolicy = tt.policy
+			defer func() { config.Config.SlowConsumerPolicy = "drop" }()
+
+			s := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
+			ch := make(chan models.SseMessage, 1)
+			lagging := WatchSlowConsumer(ch)
+			defer UnwatchSlowConsumer(ch)
+			if err := s.Sub(context.Background(), []string{"1"}, 0, ch); err != nil {
+				t.Fatalf("Sub() error = %v", err)
+			}
+
+			_ = s.Pub(context.Background(), models.SseMessage{EventId: 1, To: "1"}, 60)
+			_ = s.Pub(context.Background(), models.SseMessage{EventId: 2, To: "1"}, 60) // buffer is full
+			<-ch
+			_ = s.Pub(context.Background(), models.SseMessage{EventId: 3, To: "1"}, 60)
+
+			select {
+			case <-lagging:
+				if !tt.wantDisconnect {
+					t.Error("subscriber was signalled to disconnect")
+				}
+			default:
+				if tt.wantDisconnect {
+					t.Error("subscriber was not signalled to disconnect")
+				}
+			}
+
+			// A lagging subscriber gets nothing after the gap, so Last-Event-ID stays before it
+			got := []int64{1}
+			for len(ch) > 0 {
+				got = append(got, (<-ch).EventId)
+			}
+			if !reflect.DeepEqual(got, tt.wantIds) {
+				t.Errorf("received messages %v, want %v", got, tt.wantIds)
+			}
+		})
+	}
+}
@@ -1,32 +1,40 @@
 package storagev3
 
 import (
+	"container/list"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/sirupsen/logrus"
 	"github.com/ton-connect/bridge/internal/analytics"
+	"github.com/ton-connect/bridge/internal/config"
 	"github.com/ton-connect/bridge/internal/models"
 )
 
-var expiredMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
-	Name: "number_of_expired_messages",
-	Help: "The total number of expired messages",
-})
+var (
+	expiredMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_expired_messages",
+		Help: "The total number of expired messages",
+	})
+	connectionRecordsMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "number_of_connection_records",
+		Help: "The number of connection records kept by the memory storage",
+	})
+)
 
 type MemStorage struct {
 	db           map[string][]message
 	subscribers  map[string][]chan<- models.SseMessage
-	connections  map[string][]memConnection // clientID -> connections
+	connections  map[string][]*list.Element // clientID -> connection records
+	connOrder    *list.List                 // connection records, least recently seen at the back
+	connLimit    int
 	lock         sync.Mutex
 	analytics    analytics.EventCollector
 	eventBuilder analytics.EventBuilder
+	quota        InboxQuota
+	removals     removalWatch
 }
 
 type message struct {
@@ -35,6 +43,7 @@ type message struct {
 }
 
 type memConnection struct {
+	ClientID  string
 	IP        string
 	Origin    string
 	UserAgent string
@@ -45,16 +54,29 @@ func (m message) IsExpired(now time.Time) bool {
 	return m.expireAt.Before(now)
 }
 
-func NewMemStorage(collector analytics.EventCollector, builder analytics.EventBuilder) *MemStorage {
+func init() {
+	Register("memory", func(opts FactoryOptions) (Storage, error) {
+		return NewMemStorage(opts.Collector, opts.Builder)
+	})
+}
+
+func NewMemStorage(collector analytics.EventCollector, builder analytics.EventBuilder) (*MemStorage, error) {
+	quota, err := inboxQuotaFromConfig()
+	if err != nil {
+		return nil, err
+	}
 	s := MemStorage{
+		quota:        quota,
 		db:           map[string][]message{},
 		subscribers:  make(map[string][]chan<- models.SseMessage),
-		connections:  make(map[string][]memConnection),
+		connections:  make(map[string][]*list.Element),
+		connOrder:    list.New(),
+		connLimit:    config.Config.ConnectCacheSize,
 		analytics:    collector,
 		eventBuilder: builder,
 	}
 	go s.watcher()
-	return &s
+	return &s, nil
 }
 
 func removeExpiredMessages(ms []message, now time.Time) ([]message, []message) {
@@ -80,33 +102,10 @@ func (s *MemStorage) watcher() {
 			s.db[key] = actual
 
 			for _, m := range expired {
-				var bridgeMsg models.BridgeMessage
-				fromID := "unknown"
-				hash := sha256.Sum256(m.Message)
-				messageHash := hex.EncodeToString(hash[:])
-
-				if err := json.Unmarshal(m.Message, &bridgeMsg); err == nil {
-					fromID = bridgeMsg.From
-					contentHash := sha256.Sum256([]byte(bridgeMsg.Message))
-					messageHash = hex.EncodeToString(contentHash[:])
-				}
-				expiredMessagesMetric.Inc()
-				logrus.WithFields(map[string]interface{}{
-					"hash":     messageHash,
-					"from":     fromID,
-					"to":       key,
-					"event_id": m.EventId,
-					"trace_id": bridgeMsg.TraceId,
-				}).Debug("message expired")
-
-				_ = s.analytics.TryAdd(s.eventBuilder.NewBridgeMessageExpiredEvent(
-					key,
-					bridgeMsg.TraceId,
-					m.EventId,
-					messageHash,
-				))
+				reportExpiredMessage(s.analytics, s.eventBuilder, key, m.EventId, m.Message)
 			}
 		}
+		s.cleanExpiredConnections(time.Now())
 		s.lock.Unlock()
 		time.Sleep(time.Second)
 	}
@@ -117,27 +116,64 @@ func (s *MemStorage) Pub(ctx context.Context, mes models.SseMessage, ttl int64)
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	return s.pub(mes, ttl)
+}
+
+// PubBatch publishes messages under a single lock, see BatchPublisher
+func (s *MemStorage) PubBatch(ctx context.Context, messages []BatchMessage) []error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	errs := make([]error, len(messages))
+	for i, m := range messages {
+		errs[i] = s.pub(m.Message, m.TTL)
+	}
+	return errs
+}
+
+// pub stores and delivers a message, the caller holds s.lock
+func (s *MemStorage) pub(mes models.SseMessage, ttl int64) error {
+	// Apply the inbox quota, messages are kept oldest first
+	inbox := s.db[mes.To]
+	sizes := make([]int64, len(inbox))
+	var bytes int64
+	for i, m := range inbox {
+		sizes[i] = int64(len(m.Message))
+		bytes += sizes[i]
+	}
+	evict, err := s.quota.fit(sizes, int64(len(mes.Message)))
+	if err != nil {
+		return rejectInbox()
+	}
+	evicted := make([]int64, evict)
+	for i, m := range inbox[:evict] {
+		bytes -= int64(len(m.Message))
+		evicted[i] = m.EventId
+	}
+	inbox = inbox[evict:]
+
 	// Store message with TTL
-	s.db[mes.To] = append(s.db[mes.To], message{
+	expireAt := time.Now().Add(time.Duration(ttl) * time.Second)
+	mes.ExpireAt = expireAt.Unix()
+	s.db[mes.To] = append(inbox, message{
 		SseMessage: mes,
-		expireAt:   time.Now().Add(time.Duration(ttl) * time.Second),
+		expireAt:   expireAt,
 	})
+	observeInbox(len(s.db[mes.To]), bytes+int64(len(mes.Message)), evict)
+	s.removals.notify(mes.To, evicted)
 
 	// Send to all subscribers for this key
 	if subscribers, exists := s.subscribers[mes.To]; exists {
 		for _, ch := range subscribers {
-			select {
-			case ch <- mes:
-			default:
-				// Channel is full or closed, skip
-			}
+			deliver(ch, mes, dropLiveBufferFull)
 		}
 	}
 
 	return nil
 }
 
-// Sub subscribes to messages for the given keys and sends historical messages after lastEventId
+// Sub subscribes to messages for the given keys and sends historical messages after lastEventId.
+// Pub and Sub share one lock, so a message is either replayed from history or delivered live, never both.
 func (s *MemStorage) Sub(ctx context.Context, keys []string, lastEventId int64, messageCh chan<- models.SseMessage) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -166,11 +202,7 @@ func (s *MemStorage) Sub(ctx context.Context, keys []string, lastEventId int64,
 				continue
 			}
 
-			select {
-			case messageCh <- msg.SseMessage:
-			default:
-				// Channel is full or closed, skip
-			}
+			deliver(messageCh, msg.SseMessage, dropReplayBufferFull)
 		}
 	}
 
@@ -206,25 +238,100 @@ func (s *MemStorage) Unsub(ctx context.Context, keys []string, messageCh chan<-
 	return nil
 }
 
+// Ack removes an acknowledged message from the recipient's inbox
+func (s *MemStorage) Ack(ctx context.Context, clientID string, eventID int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	messages := s.db[clientID]
+	for i, m := range messages {
+		if m.EventId == eventID {
+			s.db[clientID] = append(messages[:i], messages[i+1:]...)
+			s.removals.notify(clientID, []int64{eventID})
+			break
+		}
+	}
+	if len(s.db[clientID]) == 0 {
+		delete(s.db, clientID)
+	}
+	return nil
+}
+
+// WatchRemovals registers fn to be called for messages removed by Ack or the inbox quota, see RemovalWatcher
+func (s *MemStorage) WatchRemovals(fn func(clientID string, eventIDs []int64)) {
+	s.removals.set(fn)
+}
+
 // HealthCheck should be implemented
 func (s *MemStorage) HealthCheck() error {
 	return nil // Always healthy
 }
 
-// AddConnection stores connection info in memory with TTL
+// AddConnection stores connection info in memory with TTL.
+// Records are deduplicated by IP, Origin and User-Agent per client; when CONNECT_CACHE_SIZE
+// records are stored, the least recently seen one is dropped.
 func (s *MemStorage) AddConnection(ctx context.Context, conn ConnectionInfo, ttl time.Duration) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	memConn := memConnection{
+	expiresAt := time.Now().Add(ttl)
+	for _, e := range s.connections[conn.ClientID] {
+		cached := e.Value.(*memConnection)
+		if cached.IP == conn.IP && cached.Origin == conn.Origin && cached.UserAgent == conn.UserAgent {
+			cached.ExpiresAt = expiresAt
+			s.connOrder.MoveToFront(e)
+			return nil
+		}
+	}
+
+	if s.connLimit > 0 && s.connOrder.Len() >= s.connLimit {
+		s.removeConnection(s.connOrder.Back())
+	}
+
+	e := s.connOrder.PushFront(&memConnection{
+		ClientID:  conn.ClientID,
 		IP:        conn.IP,
 		Origin:    conn.Origin,
 		UserAgent: conn.UserAgent,
-		ExpiresAt: time.Now().Add(ttl),
+		ExpiresAt: expiresAt,
+	})
+	s.connections[conn.ClientID] = append(s.connections[conn.ClientID], e)
+	connectionRecordsMetric.Set(float64(s.connOrder.Len()))
+	return nil
+}
+
+// cleanExpiredConnections drops expired connection records, oldest first.
+// Should be called with lock held
+func (s *MemStorage) cleanExpiredConnections(now time.Time) {
+	if s.connOrder == nil {
+		return
 	}
+	for e := s.connOrder.Back(); e != nil; e = s.connOrder.Back() {
+		if !now.After(e.Value.(*memConnection).ExpiresAt) {
+			break
+		}
+		s.removeConnection(e)
+	}
+	connectionRecordsMetric.Set(float64(s.connOrder.Len()))
+}
 
-	s.connections[conn.ClientID] = append(s.connections[conn.ClientID], memConn)
-	return nil
+// removeConnection drops a connection record from the order list and the client index.
+// Should be called with lock held
+func (s *MemStorage) removeConnection(e *list.Element) {
+	s.connOrder.Remove(e)
+	clientID := e.Value.(*memConnection).ClientID
+	elements := s.connections[clientID]
+	for i, elem := range elements {
+		if elem == e {
+			elements = append(elements[:i], elements[i+1:]...)
+			break
+		}
+	}
+	if len(elements) == 0 {
+		delete(s.connections, clientID)
+	} else {
+		s.connections[clientID] = elements
+	}
 }
 
 // VerifyConnection checks if connection matches cached data
@@ -242,7 +349,8 @@ func (s *MemStorage) VerifyConnection(ctx context.Context, conn ConnectionInfo)
 	foundCount := 0
 	leastSuspicious := "danger"
 
-	for _, cachedConn := range conns {
+	for _, e := range conns {
+		cachedConn := e.Value.(*memConnection)
 		if now.After(cachedConn.ExpiresAt) {
 			continue
 		}
@@ -264,3 +372,8 @@ func (s *MemStorage) VerifyConnection(ctx context.Context, conn ConnectionInfo)
 
 	return leastSuspicious, nil
 }
+
+// Name returns the backend name
+func (s *MemStorage) Name() string {
+	return "memory"
+}
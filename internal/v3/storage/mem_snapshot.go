@@ -0,0 +1,192 @@
+package storagev3
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+const memSnapshotVersion = 1
+
+// memSnapshot is the on-disk form of MemStorage. Expiry times are absolute,
+// so restored entries keep their remaining TTL.
+type memSnapshot struct {
+	Version     int                  `json:"version"`
+	CreatedAt   time.Time            `json:"created_at"`
+	Messages    []snapshotMessage    `json:"messages"`
+	Connections []snapshotConnection `json:"connections"`
+}
+
+type snapshotMessage struct {
+	models.SseMessage
+	ExpireAt time.Time `json:"expire_at"`
+	// Delivered keeps the ExpiredCache mark, so a delivered message that expires
+	// after the restart is not reported as expired
+	Delivered bool `json:"delivered,omitempty"`
+}
+
+type snapshotConnection struct {
+	ClientID  string    `json:"client_id"`
+	IP        string    `json:"ip"`
+	Origin    string    `json:"origin"`
+	UserAgent string    `json:"user_agent"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SaveSnapshot writes unexpired messages and connection records to path.
+// The snapshot is written to a temporary file in the same directory and renamed,
+// so a crash never leaves a partially written snapshot behind.
+func (s *MemStorage) SaveSnapshot(path string) error {
+	now := time.Now()
+	snapshot := memSnapshot{Version: memSnapshotVersion, CreatedAt: now}
+
+	s.lock.Lock()
+	for _, msgs := range s.db {
+		for _, m := range msgs {
+			if m.IsExpired(now) {
+				continue
+			}
+			snapshot.Messages = append(snapshot.Messages, snapshotMessage{
+				SseMessage: m.SseMessage,
+				ExpireAt:   m.expireAt,
+				Delivered:  ExpiredCache.IsMarked(m.EventId),
+			})
+		}
+	}
+	if s.connOrder != nil {
+		// Least recently seen first, so restoring keeps the eviction order
+		for e := s.connOrder.Back(); e != nil; e = e.Prev() {
+			c := e.Value.(*memConnection)
+			if now.After(c.ExpiresAt) {
+				continue
+			}
+			snapshot.Connections = append(snapshot.Connections, snapshotConnection{
+				ClientID:  c.ClientID,
+				IP:        c.IP,
+				Origin:    c.Origin,
+				UserAgent: c.UserAgent,
+				ExpiresAt: c.ExpiresAt,
+			})
+		}
+	}
+	s.lock.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name()) // no-op after a successful rename
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot restores messages and connection records saved by SaveSnapshot.
+// Messages that expired while the bridge was down are reported like the watcher reports
+// them, expired connection records are skipped and CONNECT_CACHE_SIZE applies as in
+// AddConnection. A missing file is not an error.
+func (s *MemStorage) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snapshot memSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
+	if snapshot.Version != memSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	messages := 0
+	for _, m := range snapshot.Messages {
+		if m.Delivered {
+			ExpiredCache.Mark(m.EventId)
+		}
+		if m.ExpireAt.Before(now) {
+			if !m.Delivered {
+				reportExpiredMessage(s.analytics, s.eventBuilder, m.To, m.EventId, m.Message)
+			}
+			continue
+		}
+		m.SseMessage.ExpireAt = m.ExpireAt.Unix()
+		s.db[m.To] = append(s.db[m.To], message{SseMessage: m.SseMessage, expireAt: m.ExpireAt})
+		messages++
+	}
+
+	connections := 0
+	for _, c := range snapshot.Connections {
+		if now.After(c.ExpiresAt) {
+			continue
+		}
+		if s.connLimit > 0 && s.connOrder.Len() >= s.connLimit {
+			s.removeConnection(s.connOrder.Back())
+			connections--
+		}
+		e := s.connOrder.PushFront(&memConnection{
+			ClientID:  c.ClientID,
+			IP:        c.IP,
+			Origin:    c.Origin,
+			UserAgent: c.UserAgent,
+			ExpiresAt: c.ExpiresAt,
+		})
+		s.connections[c.ClientID] = append(s.connections[c.ClientID], e)
+		connections++
+	}
+	connectionRecordsMetric.Set(float64(s.connOrder.Len()))
+
+	logrus.WithField("prefix", "MemStorage.LoadSnapshot").Infof("restored %d messages and %d connection records from snapshot taken at %v", messages, connections, snapshot.CreatedAt)
+	return nil
+}
+
+// StartSnapshots saves a snapshot to path every interval. With a zero or negative
+// interval no periodic snapshots are taken, only the one saved on shutdown.
+func (s *MemStorage) StartSnapshots(path string, interval time.Duration) {
+	log := logrus.WithField("prefix", "MemStorage.StartSnapshots")
+	if interval <= 0 {
+		log.Info("periodic snapshots disabled, the snapshot is saved on shutdown only")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.SaveSnapshot(path); err != nil {
+				log.Errorf("failed to save snapshot: %v", err)
+			}
+		}
+	}()
+}
@@ -2,6 +2,10 @@ package storagev3
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -11,6 +15,24 @@ import (
 	"github.com/ton-connect/bridge/internal/models"
 )
 
+func newTestMemStorage(t *testing.T, collector analytics.EventCollector, builder analytics.EventBuilder) *MemStorage {
+	t.Helper()
+	s, err := NewMemStorage(collector, builder)
+	if err != nil {
+		t.Fatalf("NewMemStorage() error = %v", err)
+	}
+	return s
+}
+
+func TestNewMemStorage_InvalidOverflowPolicy(t *testing.T) {
+	config.Config.InboxOverflowPolicy = "drop-newest"
+	defer func() { config.Config.InboxOverflowPolicy = "" }()
+
+	if _, err := NewMemStorage(nil, nil); err == nil {
+		t.Error("NewMemStorage() accepted an unsupported INBOX_OVERFLOW_POLICY")
+	}
+}
+
 func newMessage(expire time.Time, i int) message {
 	return message{
 		SseMessage: models.SseMessage{EventId: int64(i)},
@@ -123,7 +145,7 @@ func TestMemStorage_watcher(t *testing.T) {
 
 func TestMemStorage_PubSub(t *testing.T) {
 	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
-	s := NewMemStorage(analytics.NewCollector(10, nil, 0), builder)
+	s := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
 
 	// Create channels to receive messages
 	ch1 := make(chan models.SseMessage, 10)
@@ -205,7 +227,7 @@ func TestMemStorage_PubSub(t *testing.T) {
 
 func TestMemStorage_LastEventId(t *testing.T) {
 	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
-	s := NewMemStorage(analytics.NewCollector(10, nil, 0), builder)
+	s := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
 
 	// Store some messages first
 	_ = s.Pub(context.Background(), models.SseMessage{EventId: 1, To: "1"}, 60)
@@ -239,3 +261,261 @@ done:
 		t.Errorf("Expected to receive messages %v, got %v", expected, receivedIds)
 	}
 }
+
+func TestMemStorage_SubDuringPub(t *testing.T) {
+	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
+	s := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
+
+	const total = 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= total; i++ {
+			_ = s.Pub(context.Background(), models.SseMessage{EventId: int64(i), To: "1"}, 60)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// Subscribers joining at different points must see every message exactly once
+	channels := make([]chan models.SseMessage, 0)
+	for i := 0; i < 5; i++ {
+		ch := make(chan models.SseMessage, total)
+		if err := s.Sub(context.Background(), []string{"1"}, 0, ch); err != nil {
+			t.Fatalf("Sub() error = %v", err)
+		}
+		channels = append(channels, ch)
+		time.Sleep(7 * time.Millisecond)
+	}
+	<-done
+
+	for i, ch := range channels {
+		seen := make(map[int64]int)
+		for len(ch) > 0 {
+			seen[(<-ch).EventId]++
+		}
+		for id := int64(1); id <= total; id++ {
+			if seen[id] != 1 {
+				t.Errorf("subscriber %d received message %d %d times", i, id, seen[id])
+			}
+		}
+	}
+}
+
+func TestMemStorage_Ack(t *testing.T) {
+	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
+	s := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
+
+	for i := int64(1); i <= 3; i++ {
+		_ = s.Pub(context.Background(), models.SseMessage{EventId: i, To: "1"}, 60)
+	}
+	if err := s.Ack(context.Background(), "1", 2); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	// Unknown messages are acked without error
+	if err := s.Ack(context.Background(), "1", 42); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+
+	ch := make(chan models.SseMessage, 10)
+	if err := s.Sub(context.Background(), []string{"1"}, 0, ch); err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	close(ch)
+
+	var receivedIds []int64
+	for msg := range ch {
+		receivedIds = append(receivedIds, msg.EventId)
+	}
+	if expected := []int64{1, 3}; !reflect.DeepEqual(receivedIds, expected) {
+		t.Errorf("Expected to receive messages %v, got %v", expected, receivedIds)
+	}
+}
+
+func TestMemStorage_InboxQuota(t *testing.T) {
+	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
+
+	tests := []struct {
+		name    string
+		quota   InboxQuota
+		wantErr bool
+		wantIds []int64
+	}{
+		{"reject newest", InboxQuota{MaxMessages: 2}, true, []int64{1, 2}},
+		{"evict oldest", InboxQuota{MaxMessages: 2, EvictOldest: true}, false, []int64{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
+			s.quota = tt.quota
+
+			var lastErr error
+			for i := int64(1); i <= 3; i++ {
+				lastErr = s.Pub(context.Background(), models.SseMessage{EventId: i, To: "1", Message: []byte("msg")}, 60)
+			}
+			if tt.wantErr != errors.Is(lastErr, ErrInboxFull) {
+				t.Errorf("Pub() error = %v, want ErrInboxFull: %v", lastErr, tt.wantErr)
+			}
+
+			ch := make(chan models.SseMessage, 10)
+			if err := s.Sub(context.Background(), []string{"1"}, 0, ch); err != nil {
+				t.Fatalf("Sub() error = %v", err)
+			}
+			close(ch)
+			var receivedIds []int64
+			for msg := range ch {
+				receivedIds = append(receivedIds, msg.EventId)
+			}
+			if !reflect.DeepEqual(receivedIds, tt.wantIds) {
+				t.Errorf("Expected inbox %v, got %v", tt.wantIds, receivedIds)
+			}
+		})
+	}
+}
+
+func TestMemStorage_ConnectionRecords(t *testing.T) {
+	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
+	s := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
+	s.connLimit = 2
+	ctx := context.Background()
+
+	conn := ConnectionInfo{ClientID: "1", IP: "192.168.1.1", Origin: "https://example.com", UserAgent: "TestAgent/1.0"}
+	for i := 0; i < 5; i++ {
+		_ = s.AddConnection(ctx, conn, time.Minute)
+	}
+	if got := s.connOrder.Len(); got != 1 {
+		t.Fatalf("expected reconnects to be deduplicated into 1 record, got %d", got)
+	}
+
+	// The cap drops the least recently seen record
+	_ = s.AddConnection(ctx, ConnectionInfo{ClientID: "2", IP: "192.168.1.2", Origin: "https://example.com"}, time.Minute)
+	_ = s.AddConnection(ctx, ConnectionInfo{ClientID: "3", IP: "192.168.1.3", Origin: "https://example.com"}, time.Minute)
+	if got := s.connOrder.Len(); got != 2 {
+		t.Fatalf("expected %d records, got %d", 2, got)
+	}
+	if status, _ := s.VerifyConnection(ctx, conn); status != "unknown" {
+		t.Errorf("expected evicted record to be unknown, got %s", status)
+	}
+
+	if status, _ := s.VerifyConnection(ctx, ConnectionInfo{ClientID: "2", IP: "192.168.1.2", Origin: "https://example.com"}); status != "ok" {
+		t.Errorf("expected status ok, got %s", status)
+	}
+
+	s.lock.Lock()
+	s.cleanExpiredConnections(time.Now().Add(30 * time.Second))
+	if got := s.connOrder.Len(); got != 2 {
+		t.Errorf("expected unexpired records to be kept, got %d", got)
+	}
+	s.cleanExpiredConnections(time.Now().Add(2 * time.Minute))
+	if got := len(s.connections); s.connOrder.Len() != 0 || got != 0 {
+		t.Errorf("expected expired records to be removed, got %d records for %d clients", s.connOrder.Len(), got)
+	}
+	s.lock.Unlock()
+}
+
+func TestMemStorage_Snapshot(t *testing.T) {
+	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "bridge.snapshot")
+
+	s := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
+	_ = s.Pub(ctx, models.SseMessage{EventId: 1, To: "1", Message: []byte("msg1")}, 60)
+	_ = s.Pub(ctx, models.SseMessage{EventId: 2, To: "1", Message: []byte("msg2")}, 60)
+	s.lock.Lock()
+	s.db["1"] = append(s.db["1"], newMessage(time.Now().Add(-time.Second), 3))
+	s.lock.Unlock()
+	conn := ConnectionInfo{ClientID: "1", IP: "192.168.1.1", Origin: "https://example.com"}
+	_ = s.AddConnection(ctx, conn, time.Minute)
+
+	if err := s.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+
+	restored := newTestMemStorage(t, analytics.NewCollector(10, nil, 0), builder)
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+
+	ch := make(chan models.SseMessage, 10)
+	if err := restored.Sub(ctx, []string{"1"}, 0, ch); err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	close(ch)
+	var receivedIds []int64
+	for msg := range ch {
+		receivedIds = append(receivedIds, msg.EventId)
+	}
+	if expected := []int64{1, 2}; !reflect.DeepEqual(receivedIds, expected) {
+		t.Errorf("Expected restored messages %v, got %v", expected, receivedIds)
+	}
+
+	restored.lock.Lock()
+	remaining := time.Until(restored.db["1"][0].expireAt)
+	restored.lock.Unlock()
+	if remaining <= 50*time.Second || remaining > 60*time.Second {
+		t.Errorf("Expected remaining TTL close to 60s, got %v", remaining)
+	}
+
+	if status, _ := restored.VerifyConnection(ctx, conn); status != "ok" {
+		t.Errorf("Expected restored connection status ok, got %s", status)
+	}
+
+	if err := newTestMemStorage(t, nil, nil).LoadSnapshot(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("LoadSnapshot() of a missing file error = %v", err)
+	}
+}
+
+func TestMemStorage_LoadSnapshot_Downtime(t *testing.T) {
+	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "bridge.snapshot")
+
+	// A snapshot taken before messages 1 and 2 expired and the connection records were seen
+	now := time.Now()
+	snapshot := memSnapshot{
+		Version:   memSnapshotVersion,
+		CreatedAt: now.Add(-time.Minute),
+		Messages: []snapshotMessage{
+			{SseMessage: models.SseMessage{EventId: 1, To: "1", Message: []byte("msg1")}, ExpireAt: now.Add(-time.Second)},
+			{SseMessage: models.SseMessage{EventId: 2, To: "1", Message: []byte("msg2")}, ExpireAt: now.Add(-time.Second), Delivered: true},
+			{SseMessage: models.SseMessage{EventId: 3, To: "1", Message: []byte("msg3")}, ExpireAt: now.Add(time.Minute)},
+		},
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		snapshot.Connections = append(snapshot.Connections, snapshotConnection{ClientID: id, IP: "192.168.1." + id, Origin: "https://example.com", ExpiresAt: now.Add(time.Minute)})
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := analytics.NewCollector(10, nil, 0)
+	s := newTestMemStorage(t, collector, builder)
+	s.connLimit = 2
+	if err := s.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+
+	// Only the undelivered message that expired during the downtime is reported
+	if got := collector.Len(); got != 1 {
+		t.Errorf("expected 1 expired message event, got %d", got)
+	}
+	s.lock.Lock()
+	if got := len(s.db["1"]); got != 1 || s.db["1"][0].EventId != 3 {
+		t.Errorf("expected only message 3 to be restored, got %v", s.db["1"])
+	}
+	s.lock.Unlock()
+
+	// The cap drops the least recently seen record
+	if got := s.connOrder.Len(); got != 2 {
+		t.Errorf("expected %d records, got %d", 2, got)
+	}
+	if status, _ := s.VerifyConnection(ctx, ConnectionInfo{ClientID: "1", IP: "192.168.1.1", Origin: "https://example.com"}); status != "unknown" {
+		t.Errorf("expected evicted record to be unknown, got %s", status)
+	}
+	if status, _ := s.VerifyConnection(ctx, ConnectionInfo{ClientID: "3", IP: "192.168.1.3", Origin: "https://example.com"}); status != "ok" {
+		t.Errorf("expected status ok, got %s", status)
+	}
+}
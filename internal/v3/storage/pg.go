@@ -0,0 +1,662 @@
+package storagev3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/analytics"
+	"github.com/ton-connect/bridge/internal/models"
+	common_storage "github.com/ton-connect/bridge/internal/storage"
+)
+
+const (
+	pgNotifyChannel = "bridge_messages"
+	// pgRemovalChannel announces messages removed by Ack or the inbox quota, see RemovalWatcher
+	pgRemovalChannel = "bridge_removals"
+
+	// Postgres limits NOTIFY payloads to 8000 bytes and inlined messages grow by
+	// a third after base64 encoding. Larger messages are announced by reference
+	// and fetched from bridge.messages by listeners.
+	pgMaxInlinePayload = 5000
+)
+
+// pgNotification is the payload sent with NOTIFY on pgNotifyChannel
+type pgNotification struct {
+	To       string `json:"to"`
+	EventId  int64  `json:"event_id"`
+	ExpireAt int64  `json:"expire_at,omitempty"`
+	Message  []byte `json:"message,omitempty"`
+}
+
+// pgRemoval is the payload sent with NOTIFY on pgRemovalChannel
+type pgRemoval struct {
+	To       string  `json:"to"`
+	EventIds []int64 `json:"event_ids"`
+}
+
+type PgStorage struct {
+	postgres     *pgxpool.Pool
+	subscribers  map[string][]chan<- models.SseMessage
+	subMutex     sync.RWMutex
+	replay       *replayGate
+	cursors      *deliveryCursors
+	listening    atomic.Bool
+	analytics    analytics.EventCollector
+	eventBuilder analytics.EventBuilder
+	quota        InboxQuota
+	removals     removalWatch
+}
+
+func init() {
+	Register("postgres", func(opts FactoryOptions) (Storage, error) {
+		return NewPgStorage(opts.Config.PostgresURI, opts.Collector, opts.Builder)
+	})
+}
+
+// NewPgStorage creates a PostgreSQL-backed storage.
+// Messages are kept in bridge.messages and fanned out across bridge
+// instances with LISTEN/NOTIFY on a dedicated connection.
+func NewPgStorage(postgresURI string, collector analytics.EventCollector, builder analytics.EventBuilder) (*PgStorage, error) {
+	log := log.WithField("prefix", "NewPgStorage")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	quota, err := inboxQuotaFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	poolConfig, err := common_storage.ConfigurePoolSettings(postgresURI)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("connection failed: %w", err)
+	}
+
+	if err := common_storage.MigrateDb(postgresURI); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	s := &PgStorage{
+		postgres:     pool,
+		subscribers:  make(map[string][]chan<- models.SseMessage),
+		replay:       newReplayGate(),
+		cursors:      newDeliveryCursors(),
+		analytics:    collector,
+		eventBuilder: builder,
+		quota:        quota,
+	}
+	go s.listen()
+	go s.worker()
+
+	log.Info("Successfully connected to PostgreSQL")
+	return s, nil
+}
+
+// listen keeps a dedicated LISTEN connection open and reconnects on failure
+func (s *PgStorage) listen() {
+	log := log.WithField("prefix", "PgStorage.listen")
+
+	backoff := time.Second
+	for {
+		err := s.listenOnce(context.Background())
+		if s.listening.Swap(false) {
+			// The connection was up, so this is a new outage rather than a failed reconnect
+			backoff = time.Second
+		}
+		log.Errorf("listener stopped: %v, reconnecting in %v", err, backoff)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (s *PgStorage) listenOnce(ctx context.Context) error {
+	poolConn, err := s.postgres.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	// LISTEN state is bound to the session, so keep the connection out of the pool
+	conn := poolConn.Hijack()
+	defer func() {
+		_ = conn.Close(context.Background())
+	}()
+
+	for _, channel := range []string{pgNotifyChannel, pgRemovalChannel} {
+		if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+	}
+	s.listening.Store(true)
+
+	// Notifications sent while no LISTEN was active are lost. Live messages are held back
+	// from here on until the subscribers got the stored messages they missed.
+	if subscribers := s.openCatchUp(); len(subscribers) > 0 {
+		go s.catchUp(subscribers)
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if notification.Channel == pgRemovalChannel {
+			s.handleRemoval(notification.Payload)
+			continue
+		}
+		s.handleNotification(ctx, notification.Payload)
+	}
+}
+
+// handleNotification delivers a NOTIFY payload to local subscribers
+func (s *PgStorage) handleNotification(ctx context.Context, payload string) {
+	log := log.WithField("prefix", "PgStorage.handleNotification")
+
+	var n pgNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		log.Errorf("failed to unmarshal notification: %v", err)
+		droppedMessagesMetric.WithLabelValues(dropDecodeError).Inc()
+		return
+	}
+
+	s.subMutex.RLock()
+	_, exists := s.subscribers[n.To]
+	s.subMutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	if n.Message == nil {
+		err := s.postgres.QueryRow(ctx, `SELECT bridge_message
+			FROM bridge.messages
+			WHERE client_id = $1 AND event_id = $2`, n.To, n.EventId).Scan(&n.Message)
+		if err != nil {
+			log.Errorf("failed to fetch message %d for client %s: %v", n.EventId, n.To, err)
+			s.subMutex.RLock()
+			for _, ch := range s.subscribers[n.To] {
+				missed(ch, models.SseMessage{EventId: n.EventId, To: n.To}, dropFetchError)
+			}
+			s.subMutex.RUnlock()
+			return
+		}
+	}
+
+	msg := models.SseMessage{EventId: n.EventId, Message: n.Message, To: n.To, ExpireAt: n.ExpireAt}
+
+	s.subMutex.RLock()
+	for _, ch := range s.subscribers[n.To] {
+		if s.replay.hold(ch, msg) {
+			continue
+		}
+		deliver(ch, msg, dropLiveBufferFull)
+		s.cursors.advance(ch, msg)
+	}
+	s.subMutex.RUnlock()
+}
+
+// handleRemoval reports a NOTIFY payload of pgRemovalChannel to the removal watcher
+func (s *PgStorage) handleRemoval(payload string) {
+	var r pgRemoval
+	if err := json.Unmarshal([]byte(payload), &r); err != nil {
+		log.WithField("prefix", "PgStorage.handleRemoval").Errorf("failed to unmarshal removal: %v", err)
+		return
+	}
+	s.removals.notify(r.To, r.EventIds)
+}
+
+// notifyRemoval announces removed messages to all bridge instances when tx commits
+func notifyRemoval(ctx context.Context, tx pgx.Tx, clientID string, eventIDs []int64) error {
+	payload, err := json.Marshal(pgRemoval{To: clientID, EventIds: eventIDs})
+	if err != nil {
+		return fmt.Errorf("failed to marshal removal: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `SELECT pg_notify($1, $2)`, pgRemovalChannel, string(payload)); err != nil {
+		return fmt.Errorf("failed to notify removal: %w", err)
+	}
+	return nil
+}
+
+// WatchRemovals registers fn to be called for messages removed by Ack or the inbox quota
+// on any bridge instance, see RemovalWatcher
+func (s *PgStorage) WatchRemovals(fn func(clientID string, eventIDs []int64)) {
+	s.removals.set(fn)
+}
+
+// openCatchUp starts holding back live messages for the current subscribers and
+// returns their keys. Subscribers still in Sub get the history there.
+func (s *PgStorage) openCatchUp() map[chan<- models.SseMessage][]string {
+	s.subMutex.RLock()
+	defer s.subMutex.RUnlock()
+
+	subscribers := make(map[chan<- models.SseMessage][]string)
+	opened := make(map[chan<- models.SseMessage]bool)
+	for key, chans := range s.subscribers {
+		for _, ch := range chans {
+			if _, ok := opened[ch]; !ok {
+				opened[ch] = s.replay.tryOpen(ch)
+			}
+			if opened[ch] {
+				subscribers[ch] = append(subscribers[ch], key)
+			}
+		}
+	}
+	return subscribers
+}
+
+// catchUp sends the subscribers the stored messages after the last event ID each of them
+// got per key, followed by the live messages held back since the LISTEN was restored
+func (s *PgStorage) catchUp(subscribers map[chan<- models.SseMessage][]string) {
+	log := log.WithField("prefix", "PgStorage.catchUp")
+	ctx, cancel := context.WithTimeout(context.Background(), catchUpTimeout)
+	defer cancel()
+
+	var keys []string
+	for _, chKeys := range subscribers {
+		for _, key := range chKeys {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	// Removals announced while the listener was down were missed as well
+	for _, key := range keys {
+		s.removals.notify(key, nil)
+	}
+	history, err := s.loadHistory(ctx, keys, 0)
+	if err != nil {
+		log.Errorf("failed to get stored messages for clients %v: %v", keys, err)
+	}
+	byKey := make(map[string][]models.SseMessage)
+	for _, msg := range history {
+		byKey[msg.To] = append(byKey[msg.To], msg)
+	}
+
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	for ch, chKeys := range subscribers {
+		buffered := s.replay.release(ch)
+		subscribed := false
+		var missedMsgs []models.SseMessage
+		for _, key := range chKeys {
+			if !slices.Contains(s.subscribers[key], ch) {
+				continue
+			}
+			subscribed = true
+			cursor := s.cursors.get(ch, key)
+			for _, msg := range byKey[key] {
+				if msg.EventId > cursor {
+					missedMsgs = append(missedMsgs, msg)
+				}
+			}
+		}
+		if !subscribed {
+			// Unsubscribed meanwhile, the channel may be closed already
+			continue
+		}
+		replayHistory(ch, missedMsgs, buffered, 0)
+		s.cursors.advance(ch, missedMsgs...)
+		s.cursors.advance(ch, buffered...)
+	}
+
+	log.Debugf("replayed %d stored messages to %d subscribers after the listener reconnected", len(history), len(subscribers))
+}
+
+// worker removes expired messages and connection records and reports undelivered expired messages
+func (s *PgStorage) worker() {
+	log := log.WithField("prefix", "PgStorage.worker")
+	for {
+		<-time.NewTimer(time.Minute).C
+
+		expiredCleaned := ExpiredCache.Cleanup()
+		log.Debugf("cleaned %d expired cache entries", expiredCleaned)
+
+		expired, err := s.popExpired(context.TODO())
+		if err != nil {
+			log.Errorf("remove expired messages error: %v", err)
+		}
+		for _, msg := range expired {
+			if ExpiredCache.IsMarked(msg.EventId) {
+				continue
+			}
+			reportExpiredMessage(s.analytics, s.eventBuilder, msg.To, msg.EventId, msg.Message)
+		}
+
+		_, err = s.postgres.Exec(context.TODO(),
+			`DELETE FROM bridge.connections
+			 WHERE current_timestamp > end_time`)
+		if err != nil {
+			log.Errorf("remove expired connections error: %v", err)
+		}
+	}
+}
+
+// popExpired deletes expired messages and returns those no bridge instance marked delivered.
+// Each expired message is returned to the one instance that deleted it,
+// so bridge instances do not report the same message.
+func (s *PgStorage) popExpired(ctx context.Context) ([]models.SseMessage, error) {
+	rows, err := s.postgres.Query(ctx,
+		`DELETE FROM bridge.messages
+		 WHERE current_timestamp > end_time
+		 RETURNING event_id, client_id, bridge_message, delivered`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []models.SseMessage
+	for rows.Next() {
+		var msg models.SseMessage
+		var delivered bool
+		if err := rows.Scan(&msg.EventId, &msg.To, &msg.Message, &delivered); err != nil {
+			return expired, fmt.Errorf("failed to scan expired message: %w", err)
+		}
+		if !delivered {
+			expired = append(expired, msg)
+		}
+	}
+	return expired, rows.Err()
+}
+
+// MarkDelivered records in bridge.messages that the message reached its recipient,
+// so no bridge instance reports it as expired
+func (s *PgStorage) MarkDelivered(ctx context.Context, eventID int64) error {
+	_, err := s.postgres.Exec(ctx, `UPDATE bridge.messages
+		SET delivered = true
+		WHERE event_id = $1`, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to mark message %d as delivered: %w", eventID, err)
+	}
+	return nil
+}
+
+// Pub stores the message with TTL and notifies all bridge instances in one transaction
+func (s *PgStorage) Pub(ctx context.Context, message models.SseMessage, ttl int64) error {
+	log := log.WithField("prefix", "PgStorage.Pub")
+
+	message.ExpireAt = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	n := pgNotification{To: message.To, EventId: message.EventId, ExpireAt: message.ExpireAt}
+	if len(message.Message) <= pgMaxInlinePayload {
+		n.Message = message.Message
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	// NOTIFY is delivered on commit, so listeners never see a message that was not stored
+	err = s.postgres.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if s.quota.Enabled() {
+			if err := s.applyQuota(ctx, tx, message); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO bridge.messages
+			(
+			client_id,
+			event_id,
+			end_time,
+			bridge_message
+			)
+			VALUES ($1, $2, to_timestamp($3), $4)
+		`, message.To, message.EventId, message.ExpireAt, message.Message)
+		if err != nil {
+			return fmt.Errorf("failed to store message: %w", err)
+		}
+		if _, err := tx.Exec(ctx, `SELECT pg_notify($1, $2)`, pgNotifyChannel, string(payload)); err != nil {
+			return fmt.Errorf("failed to notify: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("published and stored message for client %s with TTL %d seconds", message.To, ttl)
+	return nil
+}
+
+// applyQuota enforces the inbox quota for the message recipient inside the publish transaction.
+// Publishes to the same recipient are serialized with a transaction-level advisory lock.
+func (s *PgStorage) applyQuota(ctx context.Context, tx pgx.Tx, message models.SseMessage) error {
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, message.To); err != nil {
+		return fmt.Errorf("failed to lock inbox: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, `SELECT event_id, length(bridge_message)
+		FROM bridge.messages
+		WHERE client_id = $1 AND current_timestamp < end_time
+		ORDER BY event_id`, message.To)
+	if err != nil {
+		return fmt.Errorf("failed to get inbox size: %w", err)
+	}
+	var ids []int64
+	var sizes []int64
+	var bytes int64
+	for rows.Next() {
+		var id, size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan inbox size: %w", err)
+		}
+		ids = append(ids, id)
+		sizes = append(sizes, size)
+		bytes += size
+	}
+	rows.Close()
+
+	evict, err := s.quota.fit(sizes, int64(len(message.Message)))
+	if err != nil {
+		return rejectInbox()
+	}
+	if evict > 0 {
+		_, err := tx.Exec(ctx, `DELETE FROM bridge.messages
+			WHERE client_id = $1 AND event_id = any($2)`, message.To, ids[:evict])
+		if err != nil {
+			return fmt.Errorf("failed to evict messages: %w", err)
+		}
+		if err := notifyRemoval(ctx, tx, message.To, ids[:evict]); err != nil {
+			return err
+		}
+		for _, size := range sizes[:evict] {
+			bytes -= size
+		}
+	}
+	observeInbox(len(ids)-evict+1, bytes+int64(len(message.Message)), evict)
+	return nil
+}
+
+// Sub subscribes to messages for the given keys and sends historical messages after lastEventId.
+// Notifications arriving while history is read are held back and deduplicated against it.
+func (s *PgStorage) Sub(ctx context.Context, keys []string, lastEventId int64, messageCh chan<- models.SseMessage) error {
+	log := log.WithField("prefix", "PgStorage.Sub")
+
+	s.subMutex.Lock()
+	for _, key := range keys {
+		s.subscribers[key] = append(s.subscribers[key], messageCh)
+	}
+	s.cursors.track(messageCh, keys, lastEventId)
+	s.replay.open(messageCh)
+	s.subMutex.Unlock()
+
+	history, err := s.loadHistory(ctx, keys, lastEventId)
+	if err != nil {
+		log.Errorf("failed to get historical messages for clients %v: %v", keys, err)
+	}
+
+	s.subMutex.Lock()
+	buffered := s.replay.release(messageCh)
+	replayHistory(messageCh, history, buffered, lastEventId)
+	s.cursors.advance(messageCh, history...)
+	s.cursors.advance(messageCh, buffered...)
+	s.subMutex.Unlock()
+
+	log.Debugf("subscribed to keys: %v", keys)
+	return nil
+}
+
+// loadHistory reads the unexpired stored messages of keys after lastEventId
+func (s *PgStorage) loadHistory(ctx context.Context, keys []string, lastEventId int64) ([]models.SseMessage, error) {
+	// end_time has no time zone and was written with to_timestamp in the session zone
+	rows, err := s.postgres.Query(ctx, `SELECT event_id, client_id, bridge_message,
+		extract(epoch from end_time AT TIME ZONE current_setting('TimeZone'))::bigint
+		FROM bridge.messages
+		WHERE current_timestamp < end_time
+		AND event_id > $1
+		AND client_id = any($2)
+		ORDER BY event_id`, lastEventId, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]models.SseMessage, 0)
+	for rows.Next() {
+		var msg models.SseMessage
+		if err := rows.Scan(&msg.EventId, &msg.To, &msg.Message, &msg.ExpireAt); err != nil {
+			return history, fmt.Errorf("failed to scan historical message: %w", err)
+		}
+		history = append(history, msg)
+	}
+	return history, rows.Err()
+}
+
+// Unsub unsubscribes from messages for the given keys
+func (s *PgStorage) Unsub(ctx context.Context, keys []string, messageCh chan<- models.SseMessage) error {
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+
+	s.cursors.untrack(messageCh, keys)
+	for _, key := range keys {
+		subscribers, exists := s.subscribers[key]
+		if !exists {
+			continue
+		}
+
+		newSubscribers := make([]chan<- models.SseMessage, 0, len(subscribers))
+		for _, ch := range subscribers {
+			if ch != messageCh {
+				newSubscribers = append(newSubscribers, ch)
+			}
+		}
+
+		if len(newSubscribers) == 0 {
+			delete(s.subscribers, key)
+		} else {
+			s.subscribers[key] = newSubscribers
+		}
+	}
+
+	return nil
+}
+
+// AddConnection stores connection info in bridge.connections with TTL
+func (s *PgStorage) AddConnection(ctx context.Context, conn ConnectionInfo, ttl time.Duration) error {
+	_, err := s.postgres.Exec(ctx, `
+		INSERT INTO bridge.connections
+		(
+		client_id,
+		ip,
+		origin,
+		user_agent,
+		end_time
+		)
+		VALUES ($1, $2, $3, $4, to_timestamp($5))
+		ON CONFLICT (client_id, ip, origin)
+		DO UPDATE SET user_agent = EXCLUDED.user_agent, end_time = EXCLUDED.end_time
+	`, conn.ClientID, conn.IP, conn.Origin, conn.UserAgent, time.Now().Add(ttl).Unix())
+	if err != nil {
+		return fmt.Errorf("failed to store connection: %w", err)
+	}
+	return nil
+}
+
+// VerifyConnection checks if connection matches cached data
+// Returns: "ok" (exact match), "warning" (same origin different IP), "danger" (different origin), or "unknown" (no cached data)
+func (s *PgStorage) VerifyConnection(ctx context.Context, conn ConnectionInfo) (string, error) {
+	rows, err := s.postgres.Query(ctx, `SELECT ip, origin
+		FROM bridge.connections
+		WHERE client_id = $1
+		AND current_timestamp < end_time`, conn.ClientID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get connections: %w", err)
+	}
+	defer rows.Close()
+
+	foundCount := 0
+	leastSuspicious := "danger"
+	for rows.Next() {
+		var ip, origin string
+		if err := rows.Scan(&ip, &origin); err != nil {
+			return "", fmt.Errorf("failed to scan connection: %w", err)
+		}
+
+		foundCount++
+
+		if origin == conn.Origin && ip == conn.IP {
+			return "ok", nil
+		}
+		if origin == conn.Origin {
+			leastSuspicious = "warning"
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to read connections: %w", err)
+	}
+
+	if foundCount == 0 {
+		return "unknown", nil
+	}
+	return leastSuspicious, nil
+}
+
+// Ack removes an acknowledged message from the recipient's inbox
+func (s *PgStorage) Ack(ctx context.Context, clientID string, eventID int64) error {
+	err := s.postgres.BeginFunc(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `DELETE FROM bridge.messages
+			WHERE client_id = $1 AND event_id = $2`, clientID, eventID)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		return notifyRemoval(ctx, tx, clientID, []int64{eventID})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete message %d for client %s: %w", eventID, clientID, err)
+	}
+	return nil
+}
+
+// HealthCheck verifies the database connection and the LISTEN connection
+func (s *PgStorage) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var result int
+	if err := s.postgres.QueryRow(ctx, "SELECT 1").Scan(&result); err != nil {
+		return fmt.Errorf("postgres health check failed: %w", err)
+	}
+	if !s.listening.Load() {
+		return errors.New("postgres health check failed: notification listener is not connected")
+	}
+	return nil
+}
+
+// Name returns the backend name
+func (s *PgStorage) Name() string {
+	return "postgres"
+}
@@ -0,0 +1,248 @@
+package storagev3
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ton-connect/bridge/internal/analytics"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+// getTestPostgresURI returns the PostgreSQL URI from environment or skips the test
+func getTestPostgresURI(t *testing.T) string {
+	t.Helper()
+	uri := os.Getenv("POSTGRES_URI")
+	if uri == "" {
+		t.Skip("Skipping PostgreSQL integration test: POSTGRES_URI not set")
+	}
+	return uri
+}
+
+func newTestPgStorage(t *testing.T) *PgStorage {
+	t.Helper()
+	builder := analytics.NewEventBuilder("http://test", "test", "bridge", "1.0.0", "-239")
+	s, err := NewPgStorage(getTestPostgresURI(t), analytics.NewCollector(10, nil, 0), builder)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	// Wait for the LISTEN connection before publishing
+	deadline := time.Now().Add(5 * time.Second)
+	for s.HealthCheck() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("listener did not start: %v", s.HealthCheck())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return s
+}
+
+func TestPgStorage_PubSub(t *testing.T) {
+	s := newTestPgStorage(t)
+	ctx := context.Background()
+	key := "pg-test-pubsub-" + time.Now().Format("150405.000000")
+
+	ch := make(chan models.SseMessage, 10)
+	if err := s.Sub(ctx, []string{key}, 0, ch); err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	defer func() { _ = s.Unsub(ctx, []string{key}, ch) }()
+
+	small := models.SseMessage{EventId: 1, To: key, Message: []byte("small")}
+	large := models.SseMessage{EventId: 2, To: key, Message: make([]byte, pgMaxInlinePayload+1)}
+	for _, m := range []models.SseMessage{small, large} {
+		if err := s.Pub(ctx, m, 60); err != nil {
+			t.Fatalf("Pub() error = %v", err)
+		}
+	}
+
+	for _, want := range []models.SseMessage{small, large} {
+		select {
+		case got := <-ch:
+			if got.EventId != want.EventId || len(got.Message) != len(want.Message) {
+				t.Errorf("expected event %d with %d bytes, got event %d with %d bytes", want.EventId, len(want.Message), got.EventId, len(got.Message))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected to receive message %d", want.EventId)
+		}
+	}
+}
+
+func TestPgStorage_LastEventId(t *testing.T) {
+	s := newTestPgStorage(t)
+	ctx := context.Background()
+	key := "pg-test-history-" + time.Now().Format("150405.000000")
+
+	for i := int64(1); i <= 4; i++ {
+		if err := s.Pub(ctx, models.SseMessage{EventId: i, To: key, Message: []byte("msg")}, 60); err != nil {
+			t.Fatalf("Pub() error = %v", err)
+		}
+	}
+
+	ch := make(chan models.SseMessage, 10)
+	if err := s.Sub(ctx, []string{key}, 2, ch); err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	defer func() { _ = s.Unsub(ctx, []string{key}, ch) }()
+
+	for _, want := range []int64{3, 4} {
+		select {
+		case got := <-ch:
+			if got.EventId != want {
+				t.Errorf("expected EventId %d, got %d", want, got.EventId)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected to receive message %d", want)
+		}
+	}
+}
+
+func TestPgStorage_ConnectionVerification(t *testing.T) {
+	s := newTestPgStorage(t)
+	ctx := context.Background()
+	clientID := "pg-test-conn-" + time.Now().Format("150405.000000")
+
+	conn := ConnectionInfo{ClientID: clientID, IP: "192.168.1.1", Origin: "https://example.com", UserAgent: "TestAgent/1.0"}
+	if err := s.AddConnection(ctx, conn, 10*time.Second); err != nil {
+		t.Fatalf("AddConnection failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		conn ConnectionInfo
+		want string
+	}{
+		{"exact match", conn, "ok"},
+		{"same origin different IP", ConnectionInfo{ClientID: clientID, IP: "192.168.1.2", Origin: "https://example.com"}, "warning"},
+		{"different origin", ConnectionInfo{ClientID: clientID, IP: "192.168.1.2", Origin: "https://malicious.com"}, "danger"},
+		{"unknown client", ConnectionInfo{ClientID: clientID + "-unknown", IP: "192.168.1.1", Origin: "https://example.com"}, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := s.VerifyConnection(ctx, tt.conn)
+			if err != nil {
+				t.Fatalf("VerifyConnection failed: %v", err)
+			}
+			if status != tt.want {
+				t.Errorf("expected status '%s', got '%s'", tt.want, status)
+			}
+		})
+	}
+}
+
+func TestPgStorage_CatchUp(t *testing.T) {
+	s := newTestPgStorage(t)
+	ctx := context.Background()
+	key := "pg-test-catchup-" + time.Now().Format("150405.000000")
+
+	ch := make(chan models.SseMessage, 10)
+	if err := s.Sub(ctx, []string{key}, 0, ch); err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	defer func() { _ = s.Unsub(ctx, []string{key}, ch) }()
+
+	// Message 1 is stored while the listener is down, so its notification is lost
+	_, err := s.postgres.Exec(ctx, `INSERT INTO bridge.messages (client_id, event_id, end_time, bridge_message)
+		VALUES ($1, 1, to_timestamp($2), 'missed')`, key, time.Now().Add(time.Minute).Unix())
+	if err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	// The listener reconnects and message 2 arrives live before the catch-up ran
+	subscribers := s.openCatchUp()
+	live, _ := json.Marshal(pgNotification{To: key, EventId: 2, Message: []byte("live")})
+	s.handleNotification(ctx, string(live))
+	select {
+	case got := <-ch:
+		t.Fatalf("expected live message to be held back until the catch-up, got %d", got.EventId)
+	default:
+	}
+	s.catchUp(subscribers)
+
+	for _, want := range []int64{1, 2} {
+		select {
+		case got := <-ch:
+			if got.EventId != want {
+				t.Errorf("expected EventId %d, got %d", want, got.EventId)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected to receive message %d", want)
+		}
+	}
+	if got := s.cursors.get(ch, key); got != 2 {
+		t.Errorf("expected cursor 2, got %d", got)
+	}
+}
+
+func TestPgStorage_ExpireAt_SessionTimeZone(t *testing.T) {
+	uri, err := url.Parse(getTestPostgresURI(t))
+	if err != nil || uri.Scheme == "" {
+		t.Skip("Skipping time zone test: needs a postgres:// URI")
+	}
+	// A zone with a non-whole-hour offset shows any shift of the expiry
+	query := uri.Query()
+	query.Set("timezone", "Asia/Kathmandu")
+	uri.RawQuery = query.Encode()
+
+	builder := analytics.NewEventBuilder("http://test", "test", "bridge", "1.0.0", "-239")
+	s, err := NewPgStorage(uri.String(), analytics.NewCollector(10, nil, 0), builder)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	ctx := context.Background()
+	key := "pg-test-timezone-" + time.Now().Format("150405.000000")
+
+	before := time.Now().Unix()
+	if err := s.Pub(ctx, models.SseMessage{EventId: 1, To: key, Message: []byte("msg")}, 60); err != nil {
+		t.Fatalf("Pub() error = %v", err)
+	}
+	after := time.Now().Unix()
+
+	history, err := s.loadHistory(ctx, []string{key}, 0)
+	if err != nil {
+		t.Fatalf("loadHistory() error = %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(history))
+	}
+	if got := history[0].ExpireAt; got < before+60 || got > after+60 {
+		t.Errorf("ExpireAt = %d, want between %d and %d", got, before+60, after+60)
+	}
+}
+
+func TestPgStorage_DeliveredMarkIsShared(t *testing.T) {
+	s := newTestPgStorage(t)
+	other := newTestPgStorage(t)
+	ctx := context.Background()
+	key := "pg-test-delivered-" + time.Now().Format("150405.000000")
+
+	base := time.Now().UnixNano()
+	for _, id := range []int64{base, base + 1} {
+		if err := s.Pub(ctx, models.SseMessage{EventId: id, To: key, Message: []byte("msg")}, 0); err != nil {
+			t.Fatalf("Pub() error = %v", err)
+		}
+	}
+	// Delivered through another bridge instance
+	if err := other.MarkDelivered(ctx, base); err != nil {
+		t.Fatalf("MarkDelivered() error = %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	expired, err := s.popExpired(ctx)
+	if err != nil {
+		t.Fatalf("popExpired() error = %v", err)
+	}
+	var undelivered []int64
+	for _, msg := range expired {
+		if msg.To == key {
+			undelivered = append(undelivered, msg.EventId)
+		}
+	}
+	if len(undelivered) != 1 || undelivered[0] != base+1 {
+		t.Errorf("expected only message %d to be reported, got %v", base+1, undelivered)
+	}
+}
@@ -0,0 +1,119 @@
+package storagev3
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/ton-connect/bridge/internal/config"
+)
+
+// ErrInboxFull is returned by Pub when the recipient's inbox is over quota and the policy rejects new messages
+var ErrInboxFull = errors.New("recipient inbox is full")
+
+var (
+	inboxMessagesMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "inbox_messages",
+		Help:    "Number of messages in the recipient inbox after publish",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+	inboxBytesMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "inbox_bytes",
+		Help:    "Size in bytes of the recipient inbox after publish",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8), // 1 KiB .. 16 MiB
+	})
+	inboxOverflowMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_inbox_overflows",
+		Help: "The total number of messages rejected or evicted because of inbox quotas",
+	}, []string{"action"})
+)
+
+// Inbox overflow policies
+const (
+	overflowReject = "reject"
+	overflowEvict  = "evict"
+)
+
+// InboxQuota bounds a single recipient's inbox. Zero limits are disabled.
+// Sizes are measured on the stored form of messages.
+type InboxQuota struct {
+	MaxMessages int
+	MaxBytes    int64
+	EvictOldest bool
+}
+
+// inboxQuotaFromConfig reads INBOX_MAX_MESSAGES, INBOX_MAX_BYTES and INBOX_OVERFLOW_POLICY
+func inboxQuotaFromConfig() (InboxQuota, error) {
+	q := InboxQuota{
+		MaxMessages: config.Config.InboxMaxMessages,
+		MaxBytes:    config.Config.InboxMaxBytes,
+	}
+	switch strings.ToLower(strings.TrimSpace(config.Config.InboxOverflowPolicy)) {
+	case "", overflowReject:
+	case overflowEvict:
+		q.EvictOldest = true
+	default:
+		return q, fmt.Errorf("unsupported inbox overflow policy %q, expected one of: reject, evict", config.Config.InboxOverflowPolicy)
+	}
+	return q, nil
+}
+
+// RejectsOverQuota reports whether Pub may fail with ErrInboxFull under the configured quota
+func RejectsOverQuota() bool {
+	q, err := inboxQuotaFromConfig()
+	return err == nil && q.Enabled() && !q.EvictOldest
+}
+
+// Enabled reports whether any limit is set
+func (q InboxQuota) Enabled() bool {
+	return q.MaxMessages > 0 || q.MaxBytes > 0
+}
+
+// policy is the overflow policy name, also used by the Valkey publish script
+func (q InboxQuota) policy() string {
+	if q.EvictOldest {
+		return overflowEvict
+	}
+	return overflowReject
+}
+
+// fit returns how many of the oldest messages must be evicted to store a message
+// of newSize next to messages of the given sizes (oldest first), or ErrInboxFull
+func (q InboxQuota) fit(sizes []int64, newSize int64) (int, error) {
+	count := len(sizes)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+
+	evict := 0
+	for (q.MaxMessages > 0 && count+1 > q.MaxMessages) || (q.MaxBytes > 0 && total+newSize > q.MaxBytes) {
+		if !q.EvictOldest || evict == len(sizes) {
+			return 0, ErrInboxFull
+		}
+		total -= sizes[evict]
+		count--
+		evict++
+	}
+	return evict, nil
+}
+
+// observeInbox records the inbox size after a publish and the messages dropped by the quota.
+// Negative bytes mean the size was not measured.
+func observeInbox(messages int, bytes int64, evicted int) {
+	inboxMessagesMetric.Observe(float64(messages))
+	if bytes >= 0 {
+		inboxBytesMetric.Observe(float64(bytes))
+	}
+	if evicted > 0 {
+		inboxOverflowMetric.WithLabelValues("evicted").Add(float64(evicted))
+	}
+}
+
+// rejectInbox counts a message rejected by the quota and returns ErrInboxFull
+func rejectInbox() error {
+	inboxOverflowMetric.WithLabelValues("rejected").Inc()
+	return ErrInboxFull
+}
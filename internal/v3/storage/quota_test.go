@@ -0,0 +1,37 @@
+package storagev3
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInboxQuota_fit(t *testing.T) {
+	tests := []struct {
+		name      string
+		quota     InboxQuota
+		sizes     []int64
+		newSize   int64
+		wantEvict int
+		wantErr   error
+	}{
+		{"disabled", InboxQuota{}, []int64{10, 10, 10}, 10, 0, nil},
+		{"under count", InboxQuota{MaxMessages: 4}, []int64{10, 10, 10}, 10, 0, nil},
+		{"count reject", InboxQuota{MaxMessages: 3}, []int64{10, 10, 10}, 10, 0, ErrInboxFull},
+		{"count evict", InboxQuota{MaxMessages: 3, EvictOldest: true}, []int64{10, 10, 10}, 10, 1, nil},
+		{"bytes reject", InboxQuota{MaxBytes: 35}, []int64{10, 10, 10}, 10, 0, ErrInboxFull},
+		{"bytes evict", InboxQuota{MaxBytes: 35, EvictOldest: true}, []int64{20, 5, 5}, 20, 1, nil},
+		{"message larger than quota", InboxQuota{MaxBytes: 15, EvictOldest: true}, []int64{10}, 20, 0, ErrInboxFull},
+		{"both limits", InboxQuota{MaxMessages: 10, MaxBytes: 30, EvictOldest: true}, []int64{10, 10, 10}, 15, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evict, err := tt.quota.fit(tt.sizes, tt.newSize)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("fit() error = %v, want %v", err, tt.wantErr)
+			}
+			if evict != tt.wantEvict {
+				t.Errorf("fit() evict = %d, want %d", evict, tt.wantEvict)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package storagev3
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ton-connect/bridge/internal/analytics"
+	"github.com/ton-connect/bridge/internal/config"
+)
+
+// FactoryOptions are passed to a storage factory by NewStorage
+type FactoryOptions struct {
+	Config    *config.BridgeConfig
+	Collector analytics.EventCollector
+	Builder   analytics.EventBuilder
+}
+
+// Factory creates a storage backend
+type Factory func(opts FactoryOptions) (Storage, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a storage backend available under the given STORAGE name.
+// It is meant to be called from init and panics if the name is already taken.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("storagev3: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("storagev3: Register called twice for storage " + name)
+	}
+	factories[name] = factory
+}
+
+// Backends returns the sorted names of the registered storage backends
+func Backends() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStorage creates the storage backend registered under storageType
+func NewStorage(storageType string, collector analytics.EventCollector, builder analytics.EventBuilder) (Storage, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[storageType]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage type: %s (available: %s)", storageType, strings.Join(Backends(), ", "))
+	}
+
+	s, err := factory(FactoryOptions{
+		Config:    &config.Config,
+		Collector: collector,
+		Builder:   builder,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s storage: %w", storageType, err)
+	}
+	return s, nil
+}
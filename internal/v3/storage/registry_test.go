@@ -0,0 +1,53 @@
+package storagev3
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type namedStorage struct {
+	*MemStorage
+}
+
+func (s *namedStorage) Name() string {
+	return "custom"
+}
+
+func TestRegister(t *testing.T) {
+	Register("custom", func(opts FactoryOptions) (Storage, error) {
+		if opts.Config == nil {
+			return nil, errors.New("config is not passed")
+		}
+		s, err := NewMemStorage(opts.Collector, opts.Builder)
+		if err != nil {
+			return nil, err
+		}
+		return &namedStorage{s}, nil
+	})
+
+	s, err := NewStorage("custom", nil, nil)
+	if err != nil {
+		t.Fatalf("NewStorage() error = %v", err)
+	}
+	if s.Name() != "custom" {
+		t.Errorf("Name() = %v, want custom", s.Name())
+	}
+
+	want := []string{"custom", "memory", "postgres", "redis", "sqlite", "valkey"}
+	if got := Backends(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Backends() = %v, want %v", got, want)
+	}
+
+	if _, err := NewStorage("unknown", nil, nil); err == nil || !strings.Contains(err.Error(), "unsupported storage type") {
+		t.Errorf("NewStorage() error = %v, want unsupported storage type", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() with a taken name did not panic")
+		}
+	}()
+	Register("memory", func(opts FactoryOptions) (Storage, error) { return nil, nil })
+}
@@ -0,0 +1,153 @@
+package storagev3
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+// replayGate holds back live messages for subscribers whose history replay is
+// still running. Sub subscribes first, replays history and then releases the
+// buffered live messages, skipping the ones already sent from history.
+type replayGate struct {
+	mu      sync.Mutex
+	pending map[chan<- models.SseMessage][]models.SseMessage
+}
+
+func newReplayGate() *replayGate {
+	return &replayGate{pending: make(map[chan<- models.SseMessage][]models.SseMessage)}
+}
+
+// open starts buffering live messages for ch
+func (g *replayGate) open(ch chan<- models.SseMessage) {
+	g.mu.Lock()
+	g.pending[ch] = nil
+	g.mu.Unlock()
+}
+
+// hold buffers msg if ch is still replaying history. Returns false if msg should be sent right away
+func (g *replayGate) hold(ch chan<- models.SseMessage, msg models.SseMessage) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	buffered, replaying := g.pending[ch]
+	if !replaying {
+		return false
+	}
+	g.pending[ch] = append(buffered, msg)
+	return true
+}
+
+// tryOpen starts buffering live messages for ch unless it is buffering already
+func (g *replayGate) tryOpen(ch chan<- models.SseMessage) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, replaying := g.pending[ch]; replaying {
+		return false
+	}
+	g.pending[ch] = nil
+	return true
+}
+
+// release stops buffering for ch and returns the live messages received meanwhile
+func (g *replayGate) release(ch chan<- models.SseMessage) []models.SseMessage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	buffered := g.pending[ch]
+	delete(g.pending, ch)
+	return buffered
+}
+
+// replayHistory sends history messages after lastEventId in event ID order, followed by
+// the buffered live messages that were not part of the history. The order lets a subscriber
+// disconnected as a slow consumer resume from its Last-Event-ID without skipping messages.
+// Returns the highest event ID sent, or lastEventId if nothing was sent.
+func replayHistory(messageCh chan<- models.SseMessage, history []models.SseMessage, buffered []models.SseMessage, lastEventId int64) int64 {
+	sent := lastEventId
+	sort.SliceStable(history, func(i, j int) bool { return history[i].EventId < history[j].EventId })
+	seen := make(map[int64]struct{}, len(history))
+	for _, msg := range history {
+		if msg.EventId <= lastEventId {
+			continue
+		}
+		seen[msg.EventId] = struct{}{}
+		deliver(messageCh, msg, dropReplayBufferFull)
+		sent = max(sent, msg.EventId)
+	}
+	for _, msg := range buffered {
+		if _, ok := seen[msg.EventId]; ok {
+			continue
+		}
+		seen[msg.EventId] = struct{}{}
+		deliver(messageCh, msg, dropLiveBufferFull)
+		sent = max(sent, msg.EventId)
+	}
+	return sent
+}
+
+// deliveryCursors records the last event ID sent to each subscriber channel per key.
+// After a lost subscription they are the Last-Event-IDs of the catch-up replay. Tracking
+// them per key keeps a live message of one key from skipping missed messages of another.
+type deliveryCursors struct {
+	mu      sync.Mutex
+	cursors map[chan<- models.SseMessage]map[string]int64
+}
+
+func newDeliveryCursors() *deliveryCursors {
+	return &deliveryCursors{cursors: make(map[chan<- models.SseMessage]map[string]int64)}
+}
+
+// track starts the cursors of ch for keys at lastEventId
+func (c *deliveryCursors) track(ch chan<- models.SseMessage, keys []string, lastEventId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cursors, ok := c.cursors[ch]
+	if !ok {
+		cursors = make(map[string]int64, len(keys))
+		c.cursors[ch] = cursors
+	}
+	for _, key := range keys {
+		cursors[key] = max(cursors[key], lastEventId)
+	}
+}
+
+// untrack drops the cursors of ch for keys
+func (c *deliveryCursors) untrack(ch chan<- models.SseMessage, keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cursors, ok := c.cursors[ch]
+	if !ok {
+		return
+	}
+	for _, key := range keys {
+		delete(cursors, key)
+	}
+	if len(cursors) == 0 {
+		delete(c.cursors, ch)
+	}
+}
+
+// advance records messages sent to ch
+func (c *deliveryCursors) advance(ch chan<- models.SseMessage, msgs ...models.SseMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cursors, ok := c.cursors[ch]
+	if !ok {
+		return
+	}
+	for _, msg := range msgs {
+		if cursor, tracked := cursors[msg.To]; tracked && msg.EventId > cursor {
+			cursors[msg.To] = msg.EventId
+		}
+	}
+}
+
+// get returns the last event ID of key sent to ch
+func (c *deliveryCursors) get(ch chan<- models.SseMessage, key string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cursors[ch][key]
+}
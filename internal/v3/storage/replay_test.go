@@ -0,0 +1,76 @@
+package storagev3
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+func TestReplayGate(t *testing.T) {
+	g := newReplayGate()
+	ch := make(chan models.SseMessage, 10)
+
+	if g.hold(ch, models.SseMessage{EventId: 1}) {
+		t.Error("hold() should not buffer for a channel that is not replaying")
+	}
+
+	g.open(ch)
+	if !g.hold(ch, models.SseMessage{EventId: 2}) {
+		t.Error("hold() should buffer while replaying")
+	}
+	buffered := g.release(ch)
+	if len(buffered) != 1 || buffered[0].EventId != 2 {
+		t.Errorf("release() = %v, want message 2", buffered)
+	}
+	if g.hold(ch, models.SseMessage{EventId: 3}) {
+		t.Error("hold() should not buffer after release")
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	history := []models.SseMessage{{EventId: 1}, {EventId: 2}, {EventId: 3}}
+	// Live messages 2 and 3 were published after SUBSCRIBE but before history was read
+	buffered := []models.SseMessage{{EventId: 2}, {EventId: 3}, {EventId: 4}}
+
+	ch := make(chan models.SseMessage, 10)
+	replayHistory(ch, history, buffered, 1)
+	close(ch)
+
+	var got []int64
+	for msg := range ch {
+		got = append(got, msg.EventId)
+	}
+	if want := []int64{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayHistory() sent %v, want %v", got, want)
+	}
+}
+
+func TestDeliveryCursors(t *testing.T) {
+	c := newDeliveryCursors()
+	ch := make(chan models.SseMessage, 10)
+
+	c.track(ch, []string{"a", "b"}, 5)
+	c.advance(ch,
+		models.SseMessage{EventId: 8, To: "a"},
+		models.SseMessage{EventId: 3, To: "b"},
+		models.SseMessage{EventId: 9, To: "untracked"},
+	)
+	if got := c.get(ch, "a"); got != 8 {
+		t.Errorf("get(a) = %d, want 8", got)
+	}
+	// A message of one key does not move the cursor of another
+	if got := c.get(ch, "b"); got != 5 {
+		t.Errorf("get(b) = %d, want 5", got)
+	}
+
+	c.untrack(ch, []string{"a"})
+	c.advance(ch, models.SseMessage{EventId: 10, To: "a"})
+	if got := c.get(ch, "a"); got != 0 {
+		t.Errorf("get(a) after untrack = %d, want 0", got)
+	}
+	c.untrack(ch, []string{"b"})
+	if len(c.cursors) != 0 {
+		t.Errorf("expected the channel to be dropped with its last key, got %v", c.cursors)
+	}
+}
@@ -0,0 +1,413 @@
+package storagev3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/analytics"
+	"github.com/ton-connect/bridge/internal/models"
+	_ "modernc.org/sqlite" // registers the pure-Go "sqlite" driver
+)
+
+const sqliteSweepInterval = 5 * time.Second
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS messages (
+		client_id      TEXT    NOT NULL,
+		event_id       INTEGER NOT NULL,
+		end_time       INTEGER NOT NULL,
+		bridge_message BLOB,
+		PRIMARY KEY (client_id, event_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS messages_end_time_index ON messages (end_time)`,
+	`CREATE TABLE IF NOT EXISTS connections (
+		client_id  TEXT    NOT NULL,
+		ip         TEXT    NOT NULL,
+		origin     TEXT    NOT NULL,
+		user_agent TEXT    NOT NULL DEFAULT '',
+		end_time   INTEGER NOT NULL,
+		PRIMARY KEY (client_id, ip, origin)
+	)`,
+	`CREATE INDEX IF NOT EXISTS connections_end_time_index ON connections (end_time)`,
+}
+
+// SqliteStorage keeps messages and connection records in a local SQLite file
+// and fans messages out to subscribers of this process. It is meant for
+// single-node deployments that need durability without an external database.
+type SqliteStorage struct {
+	db           *sql.DB
+	subscribers  map[string][]chan<- models.SseMessage
+	lock         sync.Mutex // serializes Pub and Sub, so history and live delivery never overlap
+	analytics    analytics.EventCollector
+	eventBuilder analytics.EventBuilder
+	quota        InboxQuota
+	removals     removalWatch
+}
+
+func init() {
+	Register("sqlite", func(opts FactoryOptions) (Storage, error) {
+		return NewSqliteStorage(opts.Config.SqlitePath, opts.Collector, opts.Builder)
+	})
+}
+
+// NewSqliteStorage opens (or creates) the SQLite database at path
+func NewSqliteStorage(path string, collector analytics.EventCollector, builder analytics.EventBuilder) (*SqliteStorage, error) {
+	log := log.WithField("prefix", "NewSqliteStorage")
+
+	quota, err := inboxQuotaFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", "journal_mode(WAL)")
+	pragmas.Add("_pragma", "synchronous(NORMAL)")
+	pragmas.Add("_pragma", "busy_timeout(5000)")
+	// Path is escaped, so "?", "#" and "%" in it stay part of the file name
+	dsn := url.URL{Scheme: "file", Path: path, OmitHost: true, RawQuery: pragmas.Encode()}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// SQLite has a single writer; one connection avoids SQLITE_BUSY between our own goroutines
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, stmt := range sqliteSchema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	s := &SqliteStorage{
+		db:           db,
+		subscribers:  make(map[string][]chan<- models.SseMessage),
+		analytics:    collector,
+		eventBuilder: builder,
+		quota:        quota,
+	}
+	go s.worker()
+
+	log.Infof("Successfully opened SQLite database %s", path)
+	return s, nil
+}
+
+// worker removes expired messages and connection records and reports undelivered expired messages
+func (s *SqliteStorage) worker() {
+	log := log.WithField("prefix", "SqliteStorage.worker")
+	for {
+		time.Sleep(sqliteSweepInterval)
+		if err := s.sweepExpired(context.Background(), time.Now()); err != nil {
+			log.Errorf("failed to sweep expired records: %v", err)
+		}
+	}
+}
+
+// sweepExpired deletes records that expired by now, reporting undelivered messages
+func (s *SqliteStorage) sweepExpired(ctx context.Context, now time.Time) error {
+	type expiredMessage struct {
+		clientID string
+		eventID  int64
+		message  []byte
+	}
+	var expired []expiredMessage
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT client_id, event_id, bridge_message
+			FROM messages
+			WHERE end_time <= ?`, now.Unix())
+		if err != nil {
+			return fmt.Errorf("failed to get expired messages: %w", err)
+		}
+		for rows.Next() {
+			var m expiredMessage
+			if err := rows.Scan(&m.clientID, &m.eventID, &m.message); err != nil {
+				_ = rows.Close()
+				return fmt.Errorf("failed to scan expired message: %w", err)
+			}
+			expired = append(expired, m)
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to read expired messages: %w", err)
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE end_time <= ?`, now.Unix()); err != nil {
+			return fmt.Errorf("failed to remove expired messages: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM connections WHERE end_time <= ?`, now.Unix()); err != nil {
+			return fmt.Errorf("failed to remove expired connections: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ExpiredCache.Cleanup()
+	for _, m := range expired {
+		if ExpiredCache.IsMarked(m.eventID) {
+			continue
+		}
+		reportExpiredMessage(s.analytics, s.eventBuilder, m.clientID, m.eventID, m.message)
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, committing on success
+func (s *SqliteStorage) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Pub stores the message with TTL and sends it to local subscribers
+func (s *SqliteStorage) Pub(ctx context.Context, message models.SseMessage, ttl int64) error {
+	log := log.WithField("prefix", "SqliteStorage.Pub")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	message.ExpireAt = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	var evicted []int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if s.quota.Enabled() {
+			var err error
+			if evicted, err = s.applyQuota(ctx, tx, message); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO messages (client_id, event_id, end_time, bridge_message)
+			VALUES (?, ?, ?, ?)`,
+			message.To, message.EventId, message.ExpireAt, message.Message)
+		if err != nil {
+			return fmt.Errorf("failed to store message: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.removals.notify(message.To, evicted)
+
+	for _, ch := range s.subscribers[message.To] {
+		deliver(ch, message, dropLiveBufferFull)
+	}
+
+	log.Debugf("published and stored message for client %s with TTL %d seconds", message.To, ttl)
+	return nil
+}
+
+// applyQuota enforces the inbox quota for the message recipient inside the publish transaction.
+// Returns the event IDs of evicted messages.
+func (s *SqliteStorage) applyQuota(ctx context.Context, tx *sql.Tx, message models.SseMessage) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT event_id, COALESCE(length(bridge_message), 0)
+		FROM messages
+		WHERE client_id = ? AND end_time > ?
+		ORDER BY event_id`, message.To, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inbox size: %w", err)
+	}
+	var ids []int64
+	var sizes []int64
+	var bytes int64
+	for rows.Next() {
+		var id, size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to scan inbox size: %w", err)
+		}
+		ids = append(ids, id)
+		sizes = append(sizes, size)
+		bytes += size
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, fmt.Errorf("failed to read inbox size: %w", err)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	evict, err := s.quota.fit(sizes, int64(len(message.Message)))
+	if err != nil {
+		return nil, rejectInbox()
+	}
+	for i := 0; i < evict; i++ {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE client_id = ? AND event_id = ?`, message.To, ids[i]); err != nil {
+			return nil, fmt.Errorf("failed to evict messages: %w", err)
+		}
+		bytes -= sizes[i]
+	}
+	observeInbox(len(ids)-evict+1, bytes+int64(len(message.Message)), evict)
+	return ids[:evict], nil
+}
+
+// Sub subscribes to messages for the given keys and sends historical messages after lastEventId.
+// Pub and Sub share one lock, so a message is either replayed from history or delivered live, never both.
+func (s *SqliteStorage) Sub(ctx context.Context, keys []string, lastEventId int64, messageCh chan<- models.SseMessage) error {
+	log := log.WithField("prefix", "SqliteStorage.Sub")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, key := range keys {
+		s.subscribers[key] = append(s.subscribers[key], messageCh)
+	}
+
+	now := time.Now().Unix()
+	for _, key := range keys {
+		rows, err := s.db.QueryContext(ctx, `SELECT event_id, bridge_message, end_time
+			FROM messages
+			WHERE client_id = ? AND event_id > ? AND end_time > ?
+			ORDER BY event_id`, key, lastEventId, now)
+		if err != nil {
+			log.Errorf("failed to get historical messages for client %s: %v", key, err)
+			continue
+		}
+		for rows.Next() {
+			msg := models.SseMessage{To: key}
+			if err := rows.Scan(&msg.EventId, &msg.Message, &msg.ExpireAt); err != nil {
+				log.Errorf("failed to scan historical message: %v", err)
+				continue
+			}
+			deliver(messageCh, msg, dropReplayBufferFull)
+		}
+		if err := rows.Err(); err != nil {
+			log.Errorf("failed to read historical messages for client %s: %v", key, err)
+		}
+		_ = rows.Close()
+	}
+
+	log.Debugf("subscribed to keys: %v", keys)
+	return nil
+}
+
+// Unsub unsubscribes from messages for the given keys
+func (s *SqliteStorage) Unsub(ctx context.Context, keys []string, messageCh chan<- models.SseMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, key := range keys {
+		subscribers, exists := s.subscribers[key]
+		if !exists {
+			continue
+		}
+
+		newSubscribers := make([]chan<- models.SseMessage, 0, len(subscribers))
+		for _, ch := range subscribers {
+			if ch != messageCh {
+				newSubscribers = append(newSubscribers, ch)
+			}
+		}
+
+		if len(newSubscribers) == 0 {
+			delete(s.subscribers, key)
+		} else {
+			s.subscribers[key] = newSubscribers
+		}
+	}
+	return nil
+}
+
+// Ack removes an acknowledged message from the recipient's inbox
+func (s *SqliteStorage) Ack(ctx context.Context, clientID string, eventID int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM messages WHERE client_id = ? AND event_id = ?`, clientID, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to delete message %d for client %s: %w", eventID, clientID, err)
+	}
+	if removed, err := res.RowsAffected(); err == nil && removed > 0 {
+		s.removals.notify(clientID, []int64{eventID})
+	}
+	return nil
+}
+
+// WatchRemovals registers fn to be called for messages removed by Ack or the inbox quota, see RemovalWatcher
+func (s *SqliteStorage) WatchRemovals(fn func(clientID string, eventIDs []int64)) {
+	s.removals.set(fn)
+}
+
+// AddConnection stores connection info with TTL
+func (s *SqliteStorage) AddConnection(ctx context.Context, conn ConnectionInfo, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO connections (client_id, ip, origin, user_agent, end_time)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (client_id, ip, origin)
+		DO UPDATE SET user_agent = excluded.user_agent, end_time = excluded.end_time`,
+		conn.ClientID, conn.IP, conn.Origin, conn.UserAgent, time.Now().Add(ttl).Unix())
+	if err != nil {
+		return fmt.Errorf("failed to store connection: %w", err)
+	}
+	return nil
+}
+
+// VerifyConnection checks if connection matches cached data
+// Returns: "ok" (exact match), "warning" (same origin different IP), "danger" (different origin), or "unknown" (no cached data)
+func (s *SqliteStorage) VerifyConnection(ctx context.Context, conn ConnectionInfo) (string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT ip, origin
+		FROM connections
+		WHERE client_id = ? AND end_time > ?`, conn.ClientID, time.Now().Unix())
+	if err != nil {
+		return "", fmt.Errorf("failed to get connections: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	foundCount := 0
+	leastSuspicious := "danger"
+	for rows.Next() {
+		var ip, origin string
+		if err := rows.Scan(&ip, &origin); err != nil {
+			return "", fmt.Errorf("failed to scan connection: %w", err)
+		}
+
+		foundCount++
+
+		if origin == conn.Origin && ip == conn.IP {
+			return "ok", nil
+		}
+		if origin == conn.Origin {
+			leastSuspicious = "warning"
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to read connections: %w", err)
+	}
+
+	if foundCount == 0 {
+		return "unknown", nil
+	}
+	return leastSuspicious, nil
+}
+
+// HealthCheck verifies the database is reachable
+func (s *SqliteStorage) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("sqlite health check failed: %w", err)
+	}
+	return nil
+}
+
+// Name returns the backend name
+func (s *SqliteStorage) Name() string {
+	return "sqlite"
+}
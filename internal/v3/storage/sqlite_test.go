@@ -0,0 +1,154 @@
+package storagev3
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ton-connect/bridge/internal/analytics"
+	"github.com/ton-connect/bridge/internal/config"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+func newTestSqliteStorage(t *testing.T) *SqliteStorage {
+	t.Helper()
+	builder := analytics.NewEventBuilder(config.Config.TonAnalyticsBridgeURL, "bridge", "bridge", config.Config.TonAnalyticsBridgeVersion, config.Config.TonAnalyticsNetworkId)
+	s, err := NewSqliteStorage(filepath.Join(t.TempDir(), "bridge.db"), analytics.NewCollector(10, nil, 0), builder)
+	if err != nil {
+		t.Fatalf("NewSqliteStorage() error = %v", err)
+	}
+	t.Cleanup(func() { _ = s.db.Close() })
+	return s
+}
+
+func TestNewSqliteStorage_SpecialCharactersInPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data?v=1#x%41 y")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	path := filepath.Join(dir, "bridge.db")
+	s, err := NewSqliteStorage(path, nil, nil)
+	if err != nil {
+		t.Fatalf("NewSqliteStorage() error = %v", err)
+	}
+	t.Cleanup(func() { _ = s.db.Close() })
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("database not created at %q: %v", path, err)
+	}
+	// The pragmas after the path still apply
+	var mode string
+	if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatalf("failed to read journal mode: %v", err)
+	}
+	if mode != "wal" {
+		t.Errorf("journal_mode = %q, want wal", mode)
+	}
+}
+
+func TestSqliteStorage_PubSub(t *testing.T) {
+	s := newTestSqliteStorage(t)
+	ctx := context.Background()
+
+	_ = s.Pub(ctx, models.SseMessage{EventId: 1, To: "1", Message: []byte("one")}, 60)
+	_ = s.Pub(ctx, models.SseMessage{EventId: 2, To: "1", Message: []byte("two")}, 60)
+	_ = s.Pub(ctx, models.SseMessage{EventId: 3, To: "2", Message: []byte("other")}, 60)
+
+	// History after lastEventId is replayed, then live messages follow
+	ch := make(chan models.SseMessage, 10)
+	if err := s.Sub(ctx, []string{"1"}, 1, ch); err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	_ = s.Pub(ctx, models.SseMessage{EventId: 4, To: "1", Message: []byte("four")}, 60)
+	if err := s.Unsub(ctx, []string{"1"}, ch); err != nil {
+		t.Fatalf("Unsub() error = %v", err)
+	}
+	_ = s.Pub(ctx, models.SseMessage{EventId: 5, To: "1", Message: []byte("five")}, 60)
+	close(ch)
+
+	var received []models.SseMessage
+	for msg := range ch {
+		// The expiry is set for inbox caches, check it apart from the rest
+		if msg.ExpireAt == 0 {
+			t.Errorf("message %d has no expiry", msg.EventId)
+		}
+		msg.ExpireAt = 0
+		received = append(received, msg)
+	}
+	expected := []models.SseMessage{
+		{EventId: 2, To: "1", Message: []byte("two")},
+		{EventId: 4, To: "1", Message: []byte("four")},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected to receive %v, got %v", expected, received)
+	}
+}
+
+func TestSqliteStorage_AckAndExpiry(t *testing.T) {
+	s := newTestSqliteStorage(t)
+	ctx := context.Background()
+
+	for i := int64(1); i <= 3; i++ {
+		_ = s.Pub(ctx, models.SseMessage{EventId: i, To: "1"}, 60)
+	}
+	_ = s.Pub(ctx, models.SseMessage{EventId: 4, To: "1"}, 0)
+	if err := s.Ack(ctx, "1", 2); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	if err := s.sweepExpired(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("sweepExpired() error = %v", err)
+	}
+
+	ch := make(chan models.SseMessage, 10)
+	if err := s.Sub(ctx, []string{"1"}, 0, ch); err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	close(ch)
+
+	var receivedIds []int64
+	for msg := range ch {
+		receivedIds = append(receivedIds, msg.EventId)
+	}
+	if expected := []int64{1, 3}; !reflect.DeepEqual(receivedIds, expected) {
+		t.Errorf("Expected to receive messages %v, got %v", expected, receivedIds)
+	}
+}
+
+func TestSqliteStorage_VerifyConnection(t *testing.T) {
+	s := newTestSqliteStorage(t)
+	ctx := context.Background()
+
+	known := ConnectionInfo{ClientID: "1", IP: "10.0.0.1", Origin: "https://app.example", UserAgent: "ua"}
+	if err := s.AddConnection(ctx, known, time.Minute); err != nil {
+		t.Fatalf("AddConnection() error = %v", err)
+	}
+	// Re-adding the same connection refreshes the record instead of failing
+	if err := s.AddConnection(ctx, known, time.Minute); err != nil {
+		t.Fatalf("AddConnection() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		conn ConnectionInfo
+		want string
+	}{
+		{"exact match", known, "ok"},
+		{"same origin", ConnectionInfo{ClientID: "1", IP: "10.0.0.2", Origin: "https://app.example"}, "warning"},
+		{"other origin", ConnectionInfo{ClientID: "1", IP: "10.0.0.1", Origin: "https://evil.example"}, "danger"},
+		{"no records", ConnectionInfo{ClientID: "2", IP: "10.0.0.1", Origin: "https://app.example"}, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.VerifyConnection(ctx, tt.conn)
+			if err != nil {
+				t.Fatalf("VerifyConnection() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("VerifyConnection() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,13 @@ package storagev3
 
 import (
 	"context"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/ton-connect/bridge/internal/analytics"
 	"github.com/ton-connect/bridge/internal/config"
 	"github.com/ton-connect/bridge/internal/models"
@@ -28,23 +32,85 @@ type Storage interface {
 	Pub(ctx context.Context, message models.SseMessage, ttl int64) error
 	Sub(ctx context.Context, keys []string, lastEventId int64, messageCh chan<- models.SseMessage) error
 	Unsub(ctx context.Context, keys []string, messageCh chan<- models.SseMessage) error
+	// Ack drops a message the recipient has processed, before its TTL expires.
+	// Acked messages are not replayed and not reported as expired.
+	Ack(ctx context.Context, clientID string, eventID int64) error
 
 	// Connection verification methods
 	AddConnection(ctx context.Context, conn ConnectionInfo, ttl time.Duration) error
 	VerifyConnection(ctx context.Context, conn ConnectionInfo) (string, error)
 
 	HealthCheck() error
+	// Name is the backend name reported in the bridge_info metric
+	Name() string
 }
 
-func NewStorage(storageType string, uri string, collector analytics.EventCollector, builder analytics.EventBuilder) (Storage, error) {
-	switch storageType {
-	case "valkey", "redis":
-		return NewValkeyStorage(uri)
-	case "postgres":
-		return nil, fmt.Errorf("postgres storage does not support pub-sub functionality yet")
-	case "memory":
-		return NewMemStorage(collector, builder), nil
-	default:
-		return nil, fmt.Errorf("unsupported storage type: %s", storageType)
+// DeliveryTracker is implemented by storages that share delivered marks between
+// bridge instances, so expiry reporting does not depend on the per-process ExpiredCache
+type DeliveryTracker interface {
+	MarkDelivered(ctx context.Context, eventID int64) error
+}
+
+// RemovalWatcher is implemented by storages that report messages removed from an inbox
+// before they expired, by Ack or by the inbox quota, on any bridge instance. Nil eventIDs
+// mean removals may have been missed, e.g. while the connection to the backend was down.
+// CachedStorage uses it to keep cached inboxes in step with the backend.
+type RemovalWatcher interface {
+	WatchRemovals(fn func(clientID string, eventIDs []int64))
+}
+
+// removalWatch holds the function registered with WatchRemovals
+type removalWatch struct {
+	mu sync.RWMutex
+	fn func(clientID string, eventIDs []int64)
+}
+
+func (w *removalWatch) set(fn func(clientID string, eventIDs []int64)) {
+	w.mu.Lock()
+	w.fn = fn
+	w.mu.Unlock()
+}
+
+// notify reports removed messages of the inbox, see RemovalWatcher
+func (w *removalWatch) notify(clientID string, eventIDs []int64) {
+	w.mu.RLock()
+	fn := w.fn
+	w.mu.RUnlock()
+	if fn != nil && (eventIDs == nil || len(eventIDs) > 0) {
+		fn(clientID, eventIDs)
+	}
+}
+
+// reportExpiredMessage logs an undelivered expired message, counts it and sends the expiry analytics event
+func reportExpiredMessage(collector analytics.EventCollector, builder analytics.EventBuilder, clientID string, eventID int64, message []byte) {
+	fromID := "unknown"
+	traceID := ""
+	hash := sha256.Sum256(message)
+	messageHash := hex.EncodeToString(hash[:])
+
+	var bridgeMsg models.BridgeMessage
+	if err := json.Unmarshal(message, &bridgeMsg); err == nil {
+		fromID = bridgeMsg.From
+		traceID = bridgeMsg.TraceId
+		contentHash := sha256.Sum256([]byte(bridgeMsg.Message))
+		messageHash = hex.EncodeToString(contentHash[:])
+	}
+
+	expiredMessagesMetric.Inc()
+	log.WithFields(log.Fields{
+		"hash":     messageHash,
+		"from":     fromID,
+		"to":       clientID,
+		"event_id": eventID,
+		"trace_id": traceID,
+	}).Debug("message expired")
+
+	if collector != nil {
+		_ = collector.TryAdd(builder.NewBridgeMessageExpiredEvent(
+			clientID,
+			traceID,
+			eventID,
+			messageHash,
+		))
 	}
 }
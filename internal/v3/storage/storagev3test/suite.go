@@ -0,0 +1,355 @@
+// Package storagev3test provides a behavioural test suite that every storagev3.Storage
+// implementation is expected to pass.
+package storagev3test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ton-connect/bridge/internal/models"
+	storagev3 "github.com/ton-connect/bridge/internal/v3/storage"
+)
+
+const (
+	// deliveryTimeout bounds how long a message may take to reach a subscriber
+	deliveryTimeout = 5 * time.Second
+	// quietPeriod is how long a subscriber is watched for messages it must not get
+	quietPeriod = 300 * time.Millisecond
+)
+
+// Factory returns a fresh storage for one subtest. Storages backed by a shared
+// server may keep data between subtests, the suite uses unique client IDs.
+type Factory func(t *testing.T) storagev3.Storage
+
+// Run runs the conformance suite against storages created by newStorage
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s storagev3.Storage)
+	}{
+		{"PubSub", testPubSub},
+		{"TTLExpiry", testTTLExpiry},
+		{"LastEventId", testLastEventId},
+		{"MultiKey", testMultiKey},
+		{"PubBatch", testPubBatch},
+		{"UnsubOneKey", testUnsubOneKey},
+		{"UnsubOneSubscriber", testUnsubOneSubscriber},
+		{"Ack", testAck},
+		{"VerifyConnection", testVerifyConnection},
+		{"ConcurrentPubSub", testConcurrentPubSub},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newStorage(t))
+		})
+	}
+}
+
+// clientIDs returns n client IDs that are unique to this test run
+func clientIDs(t *testing.T, n int) []string {
+	prefix := fmt.Sprintf("%s-%d", strings.ReplaceAll(t.Name(), "/", "-"), time.Now().UnixNano())
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%s-%d", prefix, i)
+	}
+	return ids
+}
+
+// eventIDs returns a base for event IDs that grow between test runs
+func eventIDs() int64 {
+	return time.Now().UnixNano() / int64(time.Microsecond)
+}
+
+func message(to string, eventID int64) models.SseMessage {
+	return models.SseMessage{
+		EventId: eventID,
+		To:      to,
+		Message: []byte(fmt.Sprintf(`{"from":"sender","message":"payload %d"}`, eventID)),
+	}
+}
+
+func pub(t *testing.T, s storagev3.Storage, msg models.SseMessage, ttl int64) {
+	t.Helper()
+	if err := s.Pub(context.Background(), msg, ttl); err != nil {
+		t.Fatalf("Pub() error = %v", err)
+	}
+}
+
+func sub(t *testing.T, s storagev3.Storage, keys []string, lastEventId int64) chan models.SseMessage {
+	t.Helper()
+	ch := make(chan models.SseMessage, 1000)
+	if err := s.Sub(context.Background(), keys, lastEventId, ch); err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = s.Unsub(context.Background(), keys, ch)
+	})
+	return ch
+}
+
+// receive waits for n messages and then checks that nothing else arrives
+func receive(t *testing.T, ch <-chan models.SseMessage, n int) []models.SseMessage {
+	t.Helper()
+	received := make([]models.SseMessage, 0, n)
+	timeout := time.After(deliveryTimeout)
+	for len(received) < n {
+		select {
+		case msg := <-ch:
+			received = append(received, msg)
+		case <-timeout:
+			t.Fatalf("received %d of %d messages: %v", len(received), n, eventIDsOf(received))
+		}
+	}
+	select {
+	case msg := <-ch:
+		t.Fatalf("received unexpected message %d for %s", msg.EventId, msg.To)
+	case <-time.After(quietPeriod):
+	}
+	return received
+}
+
+func eventIDsOf(messages []models.SseMessage) []int64 {
+	ids := make([]int64, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.EventId
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func expectEventIDs(t *testing.T, received []models.SseMessage, want ...int64) {
+	t.Helper()
+	got := eventIDsOf(received)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("received messages %v, want %v", got, want)
+	}
+}
+
+func testPubSub(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 1)
+	base := eventIDs()
+
+	stored := message(ids[0], base+1)
+	pub(t, s, stored, 60)
+	ch := sub(t, s, ids, 0)
+	live := message(ids[0], base+2)
+	pub(t, s, live, 60)
+
+	received := receive(t, ch, 2)
+	expectEventIDs(t, received, base+1, base+2)
+	for _, msg := range received {
+		want := stored
+		if msg.EventId == live.EventId {
+			want = live
+		}
+		if msg.To != want.To || string(msg.Message) != string(want.Message) {
+			t.Errorf("received %+v, want %+v", msg, want)
+		}
+	}
+}
+
+func testTTLExpiry(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 1)
+	base := eventIDs()
+
+	pub(t, s, message(ids[0], base+1), 1)
+	pub(t, s, message(ids[0], base+2), 60)
+	time.Sleep(2100 * time.Millisecond)
+
+	ch := sub(t, s, ids, 0)
+	expectEventIDs(t, receive(t, ch, 1), base+2)
+}
+
+func testLastEventId(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 1)
+	base := eventIDs()
+
+	for i := int64(1); i <= 4; i++ {
+		pub(t, s, message(ids[0], base+i), 60)
+	}
+
+	ch := sub(t, s, ids, base+2)
+	expectEventIDs(t, receive(t, ch, 2), base+3, base+4)
+}
+
+func testMultiKey(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 3)
+	base := eventIDs()
+
+	pub(t, s, message(ids[0], base+1), 60)
+	pub(t, s, message(ids[1], base+2), 60)
+	pub(t, s, message(ids[2], base+3), 60)
+	ch := sub(t, s, ids[:2], 0)
+	pub(t, s, message(ids[0], base+4), 60)
+	pub(t, s, message(ids[1], base+5), 60)
+	pub(t, s, message(ids[2], base+6), 60)
+
+	expectEventIDs(t, receive(t, ch, 4), base+1, base+2, base+4, base+5)
+}
+
+func testPubBatch(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 3)
+	base := eventIDs()
+
+	ch := sub(t, s, ids[:2], 0)
+	errs := storagev3.PubBatch(context.Background(), s, []storagev3.BatchMessage{
+		{Message: message(ids[0], base+1), TTL: 60},
+		{Message: message(ids[1], base+2), TTL: 60},
+		{Message: message(ids[2], base+3), TTL: 60},
+		{Message: message(ids[0], base+4), TTL: 1},
+	})
+	if len(errs) != 4 {
+		t.Fatalf("PubBatch() returned %d results for 4 messages", len(errs))
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("PubBatch() message %d error = %v", i, err)
+		}
+	}
+	expectEventIDs(t, receive(t, ch, 3), base+1, base+2, base+4)
+
+	// Every message is stored with its own TTL
+	time.Sleep(2100 * time.Millisecond)
+	stored := sub(t, s, ids, 0)
+	expectEventIDs(t, receive(t, stored, 3), base+1, base+2, base+3)
+}
+
+func testUnsubOneKey(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 2)
+	base := eventIDs()
+
+	ch := sub(t, s, ids, 0)
+	if err := s.Unsub(context.Background(), ids[:1], ch); err != nil {
+		t.Fatalf("Unsub() error = %v", err)
+	}
+	pub(t, s, message(ids[0], base+1), 60)
+	pub(t, s, message(ids[1], base+2), 60)
+
+	expectEventIDs(t, receive(t, ch, 1), base+2)
+}
+
+func testUnsubOneSubscriber(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 1)
+	base := eventIDs()
+
+	first := sub(t, s, ids, 0)
+	second := sub(t, s, ids, 0)
+	if err := s.Unsub(context.Background(), ids, first); err != nil {
+		t.Fatalf("Unsub() error = %v", err)
+	}
+	pub(t, s, message(ids[0], base+1), 60)
+
+	expectEventIDs(t, receive(t, second, 1), base+1)
+	receive(t, first, 0)
+}
+
+func testAck(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 1)
+	base := eventIDs()
+
+	for i := int64(1); i <= 3; i++ {
+		pub(t, s, message(ids[0], base+i), 60)
+	}
+	if err := s.Ack(context.Background(), ids[0], base+2); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	// Unknown messages are acked without error
+	if err := s.Ack(context.Background(), ids[0], base+42); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+
+	ch := sub(t, s, ids, 0)
+	expectEventIDs(t, receive(t, ch, 2), base+1, base+3)
+}
+
+func testVerifyConnection(t *testing.T, s storagev3.Storage) {
+	ids := clientIDs(t, 2)
+	ctx := context.Background()
+
+	known := storagev3.ConnectionInfo{
+		ClientID:  ids[0],
+		IP:        "192.0.2.1",
+		Origin:    "https://app.example.com",
+		UserAgent: "Conformance/1.0",
+	}
+	if err := s.AddConnection(ctx, known, time.Minute); err != nil {
+		t.Fatalf("AddConnection() error = %v", err)
+	}
+	// Re-adding the same connection refreshes it
+	if err := s.AddConnection(ctx, known, time.Minute); err != nil {
+		t.Fatalf("AddConnection() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		conn storagev3.ConnectionInfo
+		want string
+	}{
+		{"ok", known, "ok"},
+		{"warning", storagev3.ConnectionInfo{ClientID: ids[0], IP: "192.0.2.2", Origin: known.Origin}, "warning"},
+		{"danger", storagev3.ConnectionInfo{ClientID: ids[0], IP: known.IP, Origin: "https://other.example.com"}, "danger"},
+		{"unknown", storagev3.ConnectionInfo{ClientID: ids[1], IP: known.IP, Origin: known.Origin}, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.VerifyConnection(ctx, tt.conn)
+			if err != nil {
+				t.Fatalf("VerifyConnection() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("VerifyConnection() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testConcurrentPubSub checks that subscribers joining while messages are being
+// published get every message exactly once, either from history or live
+func testConcurrentPubSub(t *testing.T, s storagev3.Storage) {
+	const (
+		publishers   = 4
+		perPublisher = 25
+		subscribers  = 5
+	)
+	ids := clientIDs(t, 1)
+	base := eventIDs()
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perPublisher; i++ {
+				eventID := base + int64(p*perPublisher+i) + 1
+				if err := s.Pub(context.Background(), message(ids[0], eventID), 60); err != nil {
+					t.Errorf("Pub() error = %v", err)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(p)
+	}
+
+	channels := make([]chan models.SseMessage, subscribers)
+	for i := range channels {
+		channels[i] = sub(t, s, ids, 0)
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+
+	for i, ch := range channels {
+		seen := make(map[int64]int)
+		for _, msg := range receive(t, ch, publishers*perPublisher) {
+			seen[msg.EventId]++
+		}
+		for id := base + 1; id <= base+publishers*perPublisher; id++ {
+			if seen[id] != 1 {
+				t.Errorf("subscriber %d received message %d %d times", i, id, seen[id])
+			}
+		}
+	}
+}
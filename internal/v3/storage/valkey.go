@@ -4,71 +4,167 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	log "github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/analytics"
+	"github.com/ton-connect/bridge/internal/config"
 	"github.com/ton-connect/bridge/internal/models"
 )
 
 type ValkeyStorage struct {
-	client      redis.UniversalClient
-	pubSubConn  *redis.PubSub
-	subscribers map[string][]chan<- models.SseMessage
-	subMutex    sync.RWMutex
+	client       redis.UniversalClient
+	master       redis.UniversalClient // reads that must see the latest writes; client unless reads go to replicas
+	analytics    analytics.EventCollector
+	eventBuilder analytics.EventBuilder
+	quota        InboxQuota
+	keys         valkeyKeys
+	topology     valkeyTopology
+	options      *redis.UniversalOptions
+	pubSubConn   *redis.PubSub // classic pub/sub for standalone and sentinel
+	pubSubLink   *pubSubLink
+	subscribers  map[string][]chan<- models.SseMessage
+	subMutex     sync.RWMutex
+	replay       *replayGate
+
+	// Waiters for subscribe confirmations, in the order the commands were sent
+	confirmations map[string][]chan struct{}
+	confirmMutex  sync.Mutex
+
+	// Waiters for pongs of sync pings sent by syncPubSub, guarded by confirmMutex
+	pongs   map[string]chan struct{}
+	pingSeq atomic.Int64
+
+	// Last event ID sent to each subscriber channel per key, for catch-up replays after resubscription
+	cursors  *deliveryCursors
+	catchUps catchUpQueue
+
+	// Set when the server refuses scripts; Pub then falls back to MULTI/EXEC
+	scriptingDisabled atomic.Bool
+
+	removals removalWatch
+
+	// Sharded pub/sub for cluster mode: one connection per shard
+	cluster       *redis.ClusterClient
+	shards        map[string]*pubSubShard // master addr -> shard
+	channelShards map[string]*pubSubShard // channel -> shard
+}
+
+func init() {
+	factory := func(opts FactoryOptions) (Storage, error) {
+		return NewValkeyStorage(opts.Config.ValkeyURI, opts.Collector, opts.Builder)
+	}
+	Register("valkey", factory)
+	Register("redis", factory)
 }
 
 // NewValkeyStorage creates a Valkey-backed storage client.
-// Expects a Redis cluster URL (parsed by redis.ParseURL) and requires
-// Redis Cluster + Redis 7+ sharded pub/sub. Returns *ValkeyStorage or error.
-func NewValkeyStorage(valkeyURI string) (*ValkeyStorage, error) {
+// The topology (standalone, sentinel or cluster) is taken from VALKEY_MODE,
+// then from the URI scheme (see parseValkeyURI), and is auto-detected otherwise.
+// Cluster mode requires Redis 7+ sharded pub/sub. Returns *ValkeyStorage or error.
+func NewValkeyStorage(valkeyURI string, collector analytics.EventCollector, builder analytics.EventBuilder) (*ValkeyStorage, error) {
 	log := log.WithField("prefix", "NewValkeyStorage")
 
-	opts, err := redis.ParseURL(strings.TrimSpace(valkeyURI))
+	opts, topology, err := parseValkeyURI(valkeyURI)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse URI: %w", err)
 	}
 
-	if err := detectClusterMode(opts); err != nil {
-		return nil, fmt.Errorf("failed to detect cluster mode or redis endpoint is not in cluster mode: %w", err)
+	configTopology, err := parseValkeyTopology(config.Config.ValkeyMode)
+	if err != nil {
+		return nil, err
+	}
+	if configTopology != topologyAuto {
+		topology = configTopology
 	}
+	if opts.MasterName == "" {
+		opts.MasterName = config.Config.ValkeySentinelMaster
+	}
+	opts.SentinelPassword = config.Config.ValkeySentinelPassword
 
-	clusterClient := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs:          []string{opts.Addr},
-		Username:       opts.Username,
-		Password:       opts.Password,
-		TLSConfig:      opts.TLSConfig,
-		ReadOnly:       false,
-		RouteByLatency: true,
-		MaxRedirects:   3,
-		ReadTimeout:    30 * time.Second,
-		WriteTimeout:   30 * time.Second,
-		DialTimeout:    10 * time.Second,
-		PoolTimeout:    30 * time.Second,
-	})
+	quota, err := inboxQuotaFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newValkeyKeys(config.Config.ValkeyKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	topology, err = resolveTopology(opts, topology)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newTopologyClient(opts, topology, config.Config.ValkeyReadFromReplicas)
+	if err != nil {
+		return nil, err
+	}
+	master := client
+	if config.Config.ValkeyReadFromReplicas && topology != topologyStandalone {
+		// History, connection records and delivered marks are read right after they are
+		// written; a lagging replica would lose messages or verify fresh connections as unknown
+		masterOpts := *opts
+		if master, err = newTopologyClient(&masterOpts, topology, false); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := clusterClient.Ping(ctx).Err(); err != nil {
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		if master != client {
+			_ = master.Close()
+		}
 		return nil, fmt.Errorf("connection failed: %w", err)
 	}
 
-	logDiscoveredNodes(ctx, clusterClient)
+	// Sentinel with replica routing is served by a ClusterClient too, so rely on the topology
+	clusterClient, _ := client.(*redis.ClusterClient)
+	isCluster := topology == topologyCluster && clusterClient != nil
+	if isCluster {
+		logDiscoveredNodes(ctx, clusterClient)
+	}
 
-	if !supportsShardedPubSub(ctx, clusterClient) {
+	if isCluster && !supportsShardedPubSub(ctx, client) {
+		_ = client.Close()
 		return nil, fmt.Errorf("redis server does not support sharded pub/sub; requires redis >= 7.0")
 	}
 
-	log.Info("Successfully connected to Valkey/Redis")
-
-	return &ValkeyStorage{
-		client:      clusterClient,
-		subscribers: make(map[string][]chan<- models.SseMessage),
-	}, nil
+	log.Infof("Successfully connected to Valkey/Redis in %s mode", topology)
+
+	s := &ValkeyStorage{
+		client:       client,
+		master:       master,
+		analytics:    collector,
+		eventBuilder: builder,
+		quota:        quota,
+		keys:         keys,
+		topology:     topology,
+		options:      opts,
+		subscribers:  make(map[string][]chan<- models.SseMessage),
+		replay:       newReplayGate(),
+
+		confirmations: make(map[string][]chan struct{}),
+		pongs:         make(map[string]chan struct{}),
+		cursors:       newDeliveryCursors(),
+		catchUps:      catchUpQueue{pending: make(map[chan<- models.SseMessage][]string)},
+	}
+	if isCluster {
+		s.cluster = clusterClient
+		s.shards = make(map[string]*pubSubShard)
+		s.channelShards = make(map[string]*pubSubShard)
+	}
+	s.loadPublishScript(ctx)
+	go s.expirySweeper()
+	return s, nil
 }
 
 // detectClusterMode checks if the Redis endpoint is in cluster mode
@@ -120,42 +216,38 @@ func (s *ValkeyStorage) Pub(ctx context.Context, message models.SseMessage, ttl
 	log := log.WithField("prefix", "ValkeyStorage.Pub")
 
 	// Publish to Redis channel
-	channel := fmt.Sprintf("client:%s", message.To)
+	channel := s.keys.inbox(message.To)
+	expireAt := time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	message.ExpireAt = expireAt
 	messageData, err := json.Marshal(message)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	err = s.client.Publish(ctx, channel, messageData).Err()
-	if err != nil {
+	// Store message with TTL as backup for offline clients and publish it in one step
+	keyTTL := ttl + inboxKeyTTLSlack
+	if err := s.storeAndPublish(ctx, channel, messageData, expireAt, keyTTL); err != nil {
 		return fmt.Errorf("failed to publish message to channel %s: %w", channel, err)
 	}
 
-	// Store message with TTL as backup for offline clients
-	expireTime := time.Now().Add(time.Duration(ttl) * time.Second).Unix()
-	err = s.client.ZAdd(ctx, channel, redis.Z{
-		Score:  float64(expireTime),
-		Member: messageData,
-	}).Err()
-
-	if err != nil {
-		return fmt.Errorf("failed to store message in sorted set for channel %s: %w", channel, err)
-	}
-
-	// Set expiration on the key itself
-	s.client.Expire(ctx, channel, time.Duration(ttl+60)*time.Second) // TODO remove 60 seconds buffer?
-
 	log.Debugf("published and stored message for client %s with TTL %d seconds", message.To, ttl)
 	return nil
 }
 
-// Sub subscribes to Redis channels for the given keys and sends historical messages after lastEventId
+// Sub subscribes to Redis channels for the given keys and sends historical messages after lastEventId.
+// The subscription is confirmed by the server before history is read, and live messages
+// arriving during the replay are held back and deduplicated against it, so no message
+// published around the call is lost or sent twice.
 func (s *ValkeyStorage) Sub(ctx context.Context, keys []string, lastEventId int64, messageCh chan<- models.SseMessage) error {
 	log := log.WithField("prefix", "ValkeyStorage.Sub")
 
-	s.subMutex.Lock()
-	defer s.subMutex.Unlock()
+	// Create channels list for subscription
+	channels := make([]string, len(keys))
+	for i, key := range keys {
+		channels[i] = s.keys.inbox(key)
+	}
 
+	s.subMutex.Lock()
 	// Add messageCh to subscribers for each key
 	for _, key := range keys {
 		if s.subscribers[key] == nil {
@@ -163,65 +255,75 @@ func (s *ValkeyStorage) Sub(ctx context.Context, keys []string, lastEventId int6
 		}
 		s.subscribers[key] = append(s.subscribers[key], messageCh)
 	}
+	s.replay.open(messageCh)
+	s.cursors.track(messageCh, keys, lastEventId)
+	waiters, err := s.subscribe(ctx, channels)
+	s.subMutex.Unlock()
 
-	// Send historical messages for each key
+	confirmed := false
+	if err != nil {
+		log.Errorf("failed to subscribe to channels: %v", err)
+	} else if err := awaitConfirmations(ctx, waiters); err != nil {
+		log.Warnf("subscription to %v not confirmed before history replay: %v", keys, err)
+	} else {
+		confirmed = true
+	}
+
+	history := s.loadHistory(ctx, keys)
+	if confirmed {
+		if err := s.syncPubSub(ctx, channels); err != nil {
+			log.Warnf("pub/sub for %v not synced before releasing live messages: %v", keys, err)
+		}
+	}
+
+	s.subMutex.Lock()
+	buffered := s.replay.release(messageCh)
+	replayHistory(messageCh, history, buffered, lastEventId)
+	s.cursors.advance(messageCh, history...)
+	s.cursors.advance(messageCh, buffered...)
+	s.subMutex.Unlock()
+
+	log.Debugf("subscribed to channels for keys: %v", keys)
+	return nil
+}
+
+// loadHistory reads stored, not yet expired messages for the given keys
+func (s *ValkeyStorage) loadHistory(ctx context.Context, keys []string) []models.SseMessage {
+	log := log.WithField("prefix", "ValkeyStorage.loadHistory")
+
+	history := make([]models.SseMessage, 0)
 	now := time.Now().Unix()
 	for _, key := range keys {
-		clientKey := fmt.Sprintf("client:%s", key)
-
-		// Remove expired messages first
-		// TODO support expired messages but not delivered log
-		s.client.ZRemRangeByScore(ctx, clientKey, "0", fmt.Sprintf("%d", now))
+		clientKey := s.keys.inbox(key)
 
-		// Get all remaining messages
-		messages, err := s.client.ZRange(ctx, clientKey, 0, -1).Result()
+		// Expired messages are left to the sweeper, which reports the undelivered ones
+		messages, err := s.master.ZRangeByScoreWithScores(ctx, clientKey, &redis.ZRangeBy{
+			Min: fmt.Sprintf("(%d", now),
+			Max: "+inf",
+		}).Result()
 		if err != nil {
 			if err != redis.Nil {
 				log.Errorf("failed to get historical messages for client %s: %v", key, err)
 			}
-			continue // No messages for this client or error occurred
+			continue
 		}
 
-		// Parse and send historical messages
-		for _, msgData := range messages {
+		for _, z := range messages {
+			msgData, _ := z.Member.(string)
 			var msg models.SseMessage
 			err := json.Unmarshal([]byte(msgData), &msg)
 			if err != nil {
 				log.Errorf("failed to unmarshal historical message: %v", err)
 				continue
 			}
-
-			// Filter by event ID - only send messages after lastEventId
-			if msg.EventId > lastEventId {
-				select {
-				case messageCh <- msg:
-				default:
-					// Channel is full or closed, skip
-				}
+			if msg.ExpireAt == 0 {
+				// Stored by an older bridge, the score is the expiry
+				msg.ExpireAt = int64(z.Score)
 			}
+			history = append(history, msg)
 		}
 	}
-
-	// Create channels list for subscription
-	channels := make([]string, len(keys))
-	for i, key := range keys {
-		channels[i] = fmt.Sprintf("client:%s", key)
-	}
-
-	// If this is the first subscription, start the pub-sub connection
-	if s.pubSubConn == nil {
-		s.pubSubConn = s.client.Subscribe(ctx, channels...)
-		go s.handlePubSub()
-	} else {
-		// Subscribe to additional channels
-		err := s.pubSubConn.Subscribe(ctx, channels...)
-		if err != nil {
-			log.Errorf("failed to subscribe to additional channels: %v", err)
-		}
-	}
-
-	log.Debugf("subscribed to channels for keys: %v", keys)
-	return nil
+	return history
 }
 
 // Unsub unsubscribes from Redis channels for the given keys
@@ -250,7 +352,7 @@ func (s *ValkeyStorage) Unsub(ctx context.Context, keys []string, messageCh chan
 		if len(newSubscribers) == 0 {
 			// No more subscribers for this key, clean up
 			delete(s.subscribers, key)
-			channel := fmt.Sprintf("client:%s", key)
+			channel := s.keys.inbox(key)
 			channelsToUnsub = append(channelsToUnsub, channel)
 		} else {
 			// Still have subscribers, just update the list
@@ -258,10 +360,11 @@ func (s *ValkeyStorage) Unsub(ctx context.Context, keys []string, messageCh chan
 		}
 	}
 
+	s.cursors.untrack(messageCh, keys)
+
 	// Only unsubscribe from Redis channels that have NO subscribers left
-	if s.pubSubConn != nil && len(channelsToUnsub) > 0 {
-		err := s.pubSubConn.Unsubscribe(ctx, channelsToUnsub...)
-		if err != nil {
+	if len(channelsToUnsub) > 0 {
+		if err := s.unsubscribe(ctx, channelsToUnsub); err != nil {
 			return fmt.Errorf("failed to unsubscribe from channels: %w", err)
 		}
 	}
@@ -270,131 +373,298 @@ func (s *ValkeyStorage) Unsub(ctx context.Context, keys []string, messageCh chan
 	return nil
 }
 
-// handlePubSub processes incoming Redis pub-sub messages
-func (s *ValkeyStorage) handlePubSub() {
-	log := log.WithField("prefix", "ValkeyStorage.handlePubSub")
+// subscribe sends a subscribe command for every channel, including already subscribed ones,
+// and returns waiters released when the server confirms them.
+// Should be called with subMutex locked
+func (s *ValkeyStorage) subscribe(ctx context.Context, channels []string) ([]chan struct{}, error) {
+	waiters := s.expectConfirmations(channels)
+
+	var err error
+	if s.cluster != nil {
+		err = s.sSubscribe(ctx, channels)
+	} else if s.pubSubConn == nil {
+		// If this is the first subscription, start the pub-sub connection
+		s.startPubSub(ctx, channels)
+	} else {
+		err = s.pubSubConn.Subscribe(ctx, channels...)
+	}
+	if err != nil {
+		s.dropConfirmations(channels, waiters)
+		return nil, err
+	}
+	return waiters, nil
+}
+
+// expectConfirmations queues one waiter per channel for the subscribe command about to be sent
+func (s *ValkeyStorage) expectConfirmations(channels []string) []chan struct{} {
+	s.confirmMutex.Lock()
+	defer s.confirmMutex.Unlock()
 
-	for msg := range s.pubSubConn.Channel() {
-		// Parse channel name to get client key
-		var key string
-		if len(msg.Channel) > 7 && msg.Channel[:7] == "client:" {
-			key = msg.Channel[7:]
+	waiters := make([]chan struct{}, len(channels))
+	for i, channel := range channels {
+		waiters[i] = make(chan struct{})
+		s.confirmations[channel] = append(s.confirmations[channel], waiters[i])
+	}
+	return waiters
+}
+
+// dropConfirmations removes waiters of a subscribe command that was not sent
+func (s *ValkeyStorage) dropConfirmations(channels []string, waiters []chan struct{}) {
+	s.confirmMutex.Lock()
+	defer s.confirmMutex.Unlock()
+
+	for i, channel := range channels {
+		queue := s.confirmations[channel]
+		for j, w := range queue {
+			if w == waiters[i] {
+				queue = append(queue[:j], queue[j+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(s.confirmations, channel)
 		} else {
-			continue
+			s.confirmations[channel] = queue
 		}
+	}
+}
 
-		// Parse message
-		var sseMessage models.SseMessage
-		err := json.Unmarshal([]byte(msg.Payload), &sseMessage)
-		if err != nil {
-			log.Errorf("failed to unmarshal pub-sub message: %v", err)
-			continue
+// confirm releases the oldest waiter for the channel; confirmations arrive in command order
+func (s *ValkeyStorage) confirm(channel string) {
+	s.confirmMutex.Lock()
+	queue := s.confirmations[channel]
+	if len(queue) == 0 {
+		s.confirmMutex.Unlock()
+		// Resubscription after reconnect or slot migration, messages and removals may have been missed.
+		// Called from the receive loop, so the catch-up holds back live messages from here on.
+		if key, ok := s.keys.inboxClientID(channel); ok {
+			s.removals.notify(key, nil)
+			s.requestCatchUp(key)
 		}
+		return
+	}
+	close(queue[0])
+	if len(queue) == 1 {
+		delete(s.confirmations, channel)
+	} else {
+		s.confirmations[channel] = queue[1:]
+	}
+	s.confirmMutex.Unlock()
+}
 
-		// Send to all subscribers for this key
-		s.subMutex.RLock()
-		subscribers, exists := s.subscribers[key]
-		if exists {
-			for _, ch := range subscribers {
-				select {
-				case ch <- sseMessage:
-				default:
-					// Channel is full or closed, skip
-				}
-			}
+// awaitConfirmations waits until the server has confirmed every subscription
+func awaitConfirmations(ctx context.Context, waiters []chan struct{}) error {
+	timeout := time.NewTimer(5 * time.Second)
+	defer timeout.Stop()
+
+	for _, w := range waiters {
+		select {
+		case <-w:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("timed out waiting for subscribe confirmation")
 		}
-		s.subMutex.RUnlock()
 	}
+	return nil
+}
+
+// unsubscribe removes Redis subscriptions for the channels.
+// Should be called with subMutex locked
+func (s *ValkeyStorage) unsubscribe(ctx context.Context, channels []string) error {
+	if s.cluster != nil {
+		return s.sUnsubscribe(ctx, channels)
+	}
+	if s.pubSubConn == nil {
+		return nil
+	}
+	return s.pubSubConn.Unsubscribe(ctx, channels...)
 }
 
-// AddConnection stores connection info in Valkey with TTL
-// Key pattern: conn:full:{clientID}:{ip}:{urlEncodedOrigin}
-func (s *ValkeyStorage) AddConnection(ctx context.Context, conn ConnectionInfo, ttl time.Duration) error {
-	log := log.WithField("prefix", "ValkeyStorage.AddConnection")
+// handlePubSub processes an incoming Redis pub-sub message or subscribe confirmation
+func (s *ValkeyStorage) handlePubSub(msg interface{}) {
+	switch m := msg.(type) {
+	case *redis.Message:
+		s.dispatch(m.Channel, m.Payload)
+	case *redis.Subscription:
+		if m.Kind == "subscribe" {
+			s.confirm(m.Channel)
+		}
+	case *redis.Pong:
+		s.pong(m.Payload)
+	}
+}
 
-	key := fmt.Sprintf("conn:full:%s:%s:%s", conn.ClientID, conn.IP, url.QueryEscape(conn.Origin))
+// dispatch delivers a pub-sub payload to all local subscribers of the channel
+func (s *ValkeyStorage) dispatch(channel string, payload string) {
+	log := log.WithField("prefix", "ValkeyStorage.dispatch")
 
-	data := map[string]interface{}{
-		"user_agent": conn.UserAgent,
-		"created_at": time.Now().Unix(),
+	// Parse channel name to get client key
+	key, ok := s.keys.inboxClientID(channel)
+	if !ok {
+		return
 	}
 
-	pipe := s.client.Pipeline()
-	pipe.HSet(ctx, key, data)
-	pipe.Expire(ctx, key, ttl)
-
-	// Also add to clientID index for efficient lookup
-	indexKey := fmt.Sprintf("conn:idx:%s", conn.ClientID)
-	pipe.SAdd(ctx, indexKey, key)
-	pipe.Expire(ctx, indexKey, ttl)
+	if strings.HasPrefix(payload, valkeyRemovalPrefix) {
+		s.handleRemoval(key, payload)
+		return
+	}
 
-	_, err := pipe.Exec(ctx)
+	// Parse message
+	var sseMessage models.SseMessage
+	err := json.Unmarshal([]byte(payload), &sseMessage)
 	if err != nil {
-		return fmt.Errorf("failed to store connection: %w", err)
+		log.Errorf("failed to unmarshal pub-sub message: %v", err)
+		s.subMutex.RLock()
+		for _, ch := range s.subscribers[key] {
+			missed(ch, models.SseMessage{To: key}, dropDecodeError)
+		}
+		s.subMutex.RUnlock()
+		return
 	}
 
-	log.Debugf("stored connection for client %s from %s", conn.ClientID, conn.IP)
-	return nil
+	// Send to all subscribers for this key
+	s.subMutex.RLock()
+	subscribers, exists := s.subscribers[key]
+	if exists {
+		for _, ch := range subscribers {
+			if s.replay.hold(ch, sseMessage) {
+				continue
+			}
+			deliver(ch, sseMessage, dropLiveBufferFull)
+			s.cursors.advance(ch, sseMessage)
+		}
+	}
+	s.subMutex.RUnlock()
 }
 
-// VerifyConnection checks if connection matches cached data
-// Returns: "ok" (exact match), "warning" (same origin different IP), "danger" (different origin), or "unknown" (no cached data)
-func (s *ValkeyStorage) VerifyConnection(ctx context.Context, conn ConnectionInfo) (string, error) {
-	log := log.WithField("prefix", "ValkeyStorage.VerifyConnection")
-
-	// Check for exact match first
-	exactKey := fmt.Sprintf("conn:full:%s:%s:%s", conn.ClientID, conn.IP, url.QueryEscape(conn.Origin))
-	exists, err := s.client.Exists(ctx, exactKey).Result()
-	if err != nil {
-		return "", fmt.Errorf("failed to check connection existence: %w", err)
+// valkeyAckRetries bounds the optimistic transactions of Ack without scripting
+const valkeyAckRetries = 3
+
+// ackScript removes a message from the inbox by event ID and announces the removal
+// in one step, so a concurrent Pub or Ack cannot interleave.
+//
+//	KEYS[1] - inbox key, see valkeyKeys
+//	ARGV[1] - event ID, ARGV[2] - removal payload, ARGV[3] - PUBLISH or SPUBLISH
+//
+// Returns 1 if the message was removed, 0 if it was not in the inbox.
+var ackScript = redis.NewScript(`
+local id = tonumber(ARGV[1])
+local needle = '"EventId":' .. ARGV[1] .. ','
+for _, m in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if string.find(m, needle, 1, true) then
+		local ok, decoded = pcall(cjson.decode, m)
+		if ok and type(decoded) == 'table' and decoded['EventId'] == id then
+			redis.call('ZREM', KEYS[1], m)
+			redis.call(ARGV[3], KEYS[1], ARGV[2])
+			return 1
+		end
+	end
+end
+return 0
+`)
+
+// Ack removes an acknowledged message from the recipient's sorted set and announces
+// the removal to the other instances. The message is marked delivered once removed,
+// in case a sweeper has already read it as expired.
+func (s *ValkeyStorage) Ack(ctx context.Context, clientID string, eventID int64) error {
+	clientKey := s.keys.inbox(clientID)
+
+	var removed bool
+	var err error
+	if !s.scriptingDisabled.Load() {
+		var res int64
+		res, err = ackScript.Run(ctx, s.client, []string{clientKey}, eventID, valkeyRemovalPayload([]int64{eventID}), s.publishCommand()).Int64()
+		if isScriptingUnavailable(err) {
+			s.scriptingDisabled.Store(true)
+		}
+		removed = res == 1
 	}
-	if exists > 0 {
-		log.Debugf("connection verified OK for client %s", conn.ClientID)
-		return "ok", nil
+	if s.scriptingDisabled.Load() {
+		removed, err = s.ackWatched(ctx, clientKey, eventID)
 	}
-
-	// Get all connections for this clientID
-	indexKey := fmt.Sprintf("conn:idx:%s", conn.ClientID)
-	keys, err := s.client.SMembers(ctx, indexKey).Result()
 	if err != nil {
-		if err == redis.Nil {
-			log.Debugf("no cached connections for client %s", conn.ClientID)
-			return "unknown", nil
-		}
-		return "", fmt.Errorf("failed to get connection index: %w", err)
+		return fmt.Errorf("failed to remove message %d for client %s: %w", eventID, clientID, err)
+	}
+	if !removed {
+		return nil
 	}
 
-	if len(keys) == 0 {
-		log.Debugf("no cached connections for client %s", conn.ClientID)
-		return "unknown", nil
+	if err := s.MarkDelivered(ctx, eventID); err != nil {
+		return fmt.Errorf("failed to mark message %d as delivered: %w", eventID, err)
 	}
+	return nil
+}
 
-	// Check for partial matches
-	leastSuspicious := "danger"
-	for _, key := range keys {
-		// Extract origin from key: conn:full:{clientID}:{ip}:{urlEncodedOrigin}
-		parts := strings.Split(key, ":")
-		if len(parts) < 5 {
-			continue
+// ackWatched is Ack for servers without scripting: the removal is retried if the
+// inbox changes between the lookup and MULTI/EXEC
+func (s *ValkeyStorage) ackWatched(ctx context.Context, clientKey string, eventID int64) (bool, error) {
+	removed := false
+	txf := func(tx *redis.Tx) error {
+		members, err := tx.ZRange(ctx, clientKey, 0, -1).Result()
+		if err != nil && err != redis.Nil {
+			return err
 		}
+		for _, member := range members {
+			var msg models.SseMessage
+			if err := json.Unmarshal([]byte(member), &msg); err != nil || msg.EventId != eventID {
+				continue
+			}
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.ZRem(ctx, clientKey, member)
+				pipe.Do(ctx, s.publishCommand(), clientKey, valkeyRemovalPayload([]int64{eventID}))
+				return nil
+			})
+			removed = err == nil
+			return err
+		}
+		return nil
+	}
 
-		encodedOrigin := parts[4]
-		cachedOrigin, err := url.QueryUnescape(encodedOrigin)
-		if err != nil {
-			log.Warnf("failed to decode origin from key %s: %v", key, err)
-			continue
+	var err error
+	for i := 0; i < valkeyAckRetries; i++ {
+		err = s.client.Watch(ctx, txf, clientKey)
+		if err != redis.TxFailedErr {
+			return removed, err
 		}
+	}
+	return false, err
+}
 
-		if cachedOrigin == conn.Origin {
-			leastSuspicious = "warning"
+// valkeyRemovalPayload is the pub/sub payload announcing removed messages of an inbox
+func valkeyRemovalPayload(eventIDs []int64) string {
+	ids := make([]string, len(eventIDs))
+	for i, id := range eventIDs {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	return valkeyRemovalPrefix + strings.Join(ids, ",")
+}
+
+// handleRemoval reports a removal payload of the inbox channel to the removal watcher
+func (s *ValkeyStorage) handleRemoval(key string, payload string) {
+	fields := strings.Split(strings.TrimPrefix(payload, valkeyRemovalPrefix), ",")
+	eventIDs := make([]int64, 0, len(fields))
+	for _, field := range fields {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			log.WithField("prefix", "ValkeyStorage.handleRemoval").Errorf("invalid removal payload %q: %v", payload, err)
+			s.removals.notify(key, nil)
+			return
 		}
+		eventIDs = append(eventIDs, id)
 	}
+	s.removals.notify(key, eventIDs)
+}
 
-	log.Debugf("connection verification result: %s for client %s", leastSuspicious, conn.ClientID)
-	return leastSuspicious, nil
+// WatchRemovals registers fn to be called for messages removed by Ack or the inbox quota
+// on any bridge instance, see RemovalWatcher
+func (s *ValkeyStorage) WatchRemovals(fn func(clientID string, eventIDs []int64)) {
+	s.removals.set(fn)
 }
 
-// HealthCheck verifies the connection to Valkey
+// HealthCheck verifies the connection to Valkey according to its topology:
+// standalone nodes must answer PING, Sentinel must resolve the master and
+// clusters must report cluster_state:ok with every master reachable
 func (s *ValkeyStorage) HealthCheck() error {
 	log := log.WithField("prefix", "ValkeyStorage.HealthCheck")
 
@@ -406,6 +676,28 @@ func (s *ValkeyStorage) HealthCheck() error {
 		return fmt.Errorf("valkey health check failed: %w", err)
 	}
 
+	switch s.topology {
+	case topologySentinel:
+		if err := sentinelHealthCheck(ctx, s.options); err != nil {
+			return fmt.Errorf("valkey sentinel health check failed: %w", err)
+		}
+	case topologyCluster:
+		if clusterClient, ok := s.client.(*redis.ClusterClient); ok {
+			if err := clusterHealthCheck(ctx, clusterClient); err != nil {
+				return fmt.Errorf("valkey cluster health check failed: %w", err)
+			}
+		}
+	}
+
+	if err := s.pubSubHealth(); err != nil {
+		return fmt.Errorf("valkey health check failed: %w", err)
+	}
+
 	log.Info("Valkey is healthy")
 	return nil
 }
+
+// Name returns the backend name
+func (s *ValkeyStorage) Name() string {
+	return "valkey"
+}
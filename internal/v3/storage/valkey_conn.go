@@ -0,0 +1,147 @@
+package storagev3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// connRecordVersion is the schema of connection records. Version 1 listed the record
+// keys in a set and parsed the origin back out of them; such indexes are still read
+// until they expire.
+const connRecordVersion = 2
+
+// connRecord is a connection as listed in the per-client record index
+type connRecord struct {
+	Version int    `json:"v"`
+	IP      string `json:"ip"`
+	Origin  string `json:"origin"`
+}
+
+// AddConnection stores connection info in Valkey with TTL.
+// The record is a hash under valkeyKeys.conn for exact lookups, and is listed in the
+// client's record index, a sorted set of connRecord members scored by their expiry.
+// The index expires together with the last record it lists.
+func (s *ValkeyStorage) AddConnection(ctx context.Context, conn ConnectionInfo, ttl time.Duration) error {
+	log := log.WithField("prefix", "ValkeyStorage.AddConnection")
+
+	record, err := json.Marshal(connRecord{Version: connRecordVersion, IP: conn.IP, Origin: conn.Origin})
+	if err != nil {
+		return fmt.Errorf("failed to encode connection record: %w", err)
+	}
+
+	now := time.Now()
+	key := s.keys.conn(conn.ClientID, conn.IP, conn.Origin)
+	data := map[string]interface{}{
+		"v":          connRecordVersion,
+		"ip":         conn.IP,
+		"origin":     conn.Origin,
+		"user_agent": conn.UserAgent,
+		"created_at": now.Unix(),
+	}
+
+	pipe := s.client.Pipeline()
+	pipe.HSet(ctx, key, data)
+	pipe.Expire(ctx, key, ttl)
+
+	recordsKey := s.keys.connRecords(conn.ClientID)
+	pipe.ZAdd(ctx, recordsKey, redis.Z{Score: float64(now.Add(ttl).UnixMilli()), Member: record})
+	pipe.ZRemRangeByScore(ctx, recordsKey, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	last := pipe.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{Key: recordsKey, Start: 0, Stop: 0, Rev: true})
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store connection: %w", err)
+	}
+	if latest := last.Val(); len(latest) > 0 {
+		if err := s.client.PExpireAt(ctx, recordsKey, time.UnixMilli(int64(latest[0].Score))).Err(); err != nil {
+			return fmt.Errorf("failed to set connection index expiry: %w", err)
+		}
+	}
+
+	log.Debugf("stored connection for client %s from %s", conn.ClientID, conn.IP)
+	return nil
+}
+
+// VerifyConnection checks if connection matches cached data
+// Returns: "ok" (exact match), "warning" (same origin different IP), "danger" (different origin), or "unknown" (no cached data)
+func (s *ValkeyStorage) VerifyConnection(ctx context.Context, conn ConnectionInfo) (string, error) {
+	log := log.WithField("prefix", "ValkeyStorage.VerifyConnection")
+
+	// Check for exact match first
+	exactKey := s.keys.conn(conn.ClientID, conn.IP, conn.Origin)
+	exists, err := s.master.Exists(ctx, exactKey).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to check connection existence: %w", err)
+	}
+	if exists > 0 {
+		log.Debugf("connection verified OK for client %s", conn.ClientID)
+		return "ok", nil
+	}
+
+	records, err := s.connRecords(ctx, conn.ClientID)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		log.Debugf("no cached connections for client %s", conn.ClientID)
+		return "unknown", nil
+	}
+
+	// Check for partial matches
+	leastSuspicious := "danger"
+	for _, record := range records {
+		if record.Origin == conn.Origin {
+			leastSuspicious = "warning"
+		}
+	}
+
+	log.Debugf("connection verification result: %s for client %s", leastSuspicious, conn.ClientID)
+	return leastSuspicious, nil
+}
+
+// connRecords returns the unexpired connection records of a client, including the
+// ones of a version 1 index, which only carry the origin
+func (s *ValkeyStorage) connRecords(ctx context.Context, clientID string) ([]connRecord, error) {
+	log := log.WithField("prefix", "ValkeyStorage.connRecords")
+
+	members, err := s.master.ZRangeByScore(ctx, s.keys.connRecords(clientID), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get connection records: %w", err)
+	}
+
+	records := make([]connRecord, 0, len(members))
+	for _, member := range members {
+		var record connRecord
+		if err := json.Unmarshal([]byte(member), &record); err != nil {
+			log.Warnf("failed to decode connection record %q: %v", member, err)
+			continue
+		}
+		if record.Version != connRecordVersion {
+			log.Warnf("skipping connection record of unsupported version %d", record.Version)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	keys, err := s.master.SMembers(ctx, s.keys.connIndex(clientID)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get connection index: %w", err)
+	}
+	for _, key := range keys {
+		origin, err := s.keys.connOrigin(key)
+		if err != nil {
+			log.Warnf("failed to decode origin from key %s: %v", key, err)
+			continue
+		}
+		records = append(records, connRecord{Version: 1, Origin: origin})
+	}
+	return records, nil
+}
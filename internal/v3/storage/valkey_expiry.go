@@ -0,0 +1,182 @@
+package storagev3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+const (
+	valkeySweepInterval = 10 * time.Second
+	// valkeySweepTimeout bounds one sweep, a longer sweep resumes from its SCAN cursors
+	valkeySweepTimeout = 30 * time.Second
+	// The sweep lock outlives a sweep, so no other instance starts one meanwhile
+	valkeySweepLockTTL = valkeySweepTimeout + 10*time.Second
+	// Saved SCAN cursors of an abandoned sweep are dropped after a while
+	valkeySweepCursorTTL = time.Hour
+	// Delivered marks outlive any message TTL, like ExpiredCache entries
+	valkeyDeliveredTTL = time.Hour
+)
+
+// popExpiredScript removes and returns messages of a client whose score (expire time) has passed.
+// Only one caller gets each message, so concurrent sweepers never report a message twice.
+//
+//	KEYS[1] - inbox key, see valkeyKeys
+//	ARGV[1] - now (unix seconds)
+var popExpiredScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if #expired > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+end
+return expired
+`)
+
+// MarkDelivered records in Valkey that the message reached its recipient,
+// so no bridge instance reports it as expired
+func (s *ValkeyStorage) MarkDelivered(ctx context.Context, eventID int64) error {
+	return s.client.Set(ctx, s.keys.delivered(eventID), 1, valkeyDeliveredTTL).Err()
+}
+
+// expirySweeper periodically removes expired messages and reports undelivered ones.
+// Instances take turns via a lock, and each message is popped atomically,
+// so every expired message is reported exactly once across the deployment.
+func (s *ValkeyStorage) expirySweeper() {
+	log := log.WithField("prefix", "ValkeyStorage.expirySweeper")
+
+	ticker := time.NewTicker(valkeySweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), valkeySweepTimeout)
+		lock, err := s.tryLock(ctx, s.keys.sweepLock(), valkeySweepLockTTL)
+		if err != nil {
+			log.Errorf("failed to acquire sweeper lock: %v", err)
+		} else if lock != nil {
+			if err := s.sweepExpired(ctx, time.Now()); err != nil {
+				log.Errorf("failed to sweep expired messages: %v", err)
+			}
+			releaseCtx, cancelRelease := context.WithTimeout(context.Background(), time.Second)
+			if err := lock.release(releaseCtx); err != nil {
+				log.Warnf("failed to release sweeper lock: %v", err)
+			}
+			cancelRelease()
+		}
+		cancel()
+	}
+}
+
+// sweepExpired scans client keys on every master and reports their expired, undelivered messages.
+// Each master's SCAN cursor is saved after every batch, so a sweep cut short by ctx
+// resumes where it stopped instead of starting over.
+func (s *ValkeyStorage) sweepExpired(ctx context.Context, now time.Time) error {
+	return s.forEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		cursorKey := s.keys.sweepCursor(node.Options().Addr)
+		cursor, err := s.client.Get(ctx, cursorKey).Uint64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		for {
+			keys, next, err := node.ScanType(ctx, cursor, s.keys.inboxPattern(), 1000, "zset").Result()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				expired, err := s.popExpired(ctx, key, now)
+				if err != nil {
+					log.WithField("prefix", "ValkeyStorage.sweepExpired").Errorf("failed to pop expired messages from %s: %v", key, err)
+					continue
+				}
+				s.reportUndelivered(ctx, expired)
+			}
+			if next == 0 {
+				return s.client.Del(ctx, cursorKey).Err()
+			}
+			cursor = next
+			if err := s.client.Set(ctx, cursorKey, cursor, valkeySweepCursorTTL).Err(); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// forEachMaster runs fn on every master node; standalone and Sentinel have a single one
+func (s *ValkeyStorage) forEachMaster(ctx context.Context, fn func(ctx context.Context, node *redis.Client) error) error {
+	switch c := s.client.(type) {
+	case *redis.ClusterClient:
+		return c.ForEachMaster(ctx, fn)
+	case *redis.Client:
+		return fn(ctx, c)
+	default:
+		return fmt.Errorf("unsupported client type %T", s.client)
+	}
+}
+
+// popExpired atomically removes and returns expired messages of a client key
+func (s *ValkeyStorage) popExpired(ctx context.Context, key string, now time.Time) ([]models.SseMessage, error) {
+	max := strconv.FormatInt(now.Unix(), 10)
+
+	var members []string
+	var err error
+	if !s.scriptingDisabled.Load() {
+		members, err = popExpiredScript.Run(ctx, s.client, []string{key}, max).StringSlice()
+		if isScriptingUnavailable(err) {
+			s.scriptingDisabled.Store(true)
+		}
+	}
+	if s.scriptingDisabled.Load() {
+		var rangeCmd *redis.StringSliceCmd
+		_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			rangeCmd = pipe.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: "-inf", Max: max})
+			pipe.ZRemRangeByScore(ctx, key, "-inf", max)
+			return nil
+		})
+		if err == nil {
+			members = rangeCmd.Val()
+		}
+	}
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	messages := make([]models.SseMessage, 0, len(members))
+	for _, member := range members {
+		var msg models.SseMessage
+		if err := json.Unmarshal([]byte(member), &msg); err != nil {
+			log.WithField("prefix", "ValkeyStorage.popExpired").Errorf("failed to unmarshal expired message: %v", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// reportUndelivered reports the messages that no bridge instance marked as delivered
+func (s *ValkeyStorage) reportUndelivered(ctx context.Context, messages []models.SseMessage) {
+	if len(messages) == 0 {
+		return
+	}
+
+	cmds, err := s.master.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, msg := range messages {
+			pipe.Exists(ctx, s.keys.delivered(msg.EventId))
+		}
+		return nil
+	})
+	if err != nil {
+		// Without delivered marks the messages are still reported rather than lost silently
+		log.WithField("prefix", "ValkeyStorage.reportUndelivered").Warnf("failed to check delivered marks: %v", err)
+	}
+
+	for i, msg := range messages {
+		if err == nil && cmds[i].(*redis.IntCmd).Val() > 0 {
+			continue
+		}
+		reportExpiredMessage(s.analytics, s.eventBuilder, msg.To, msg.EventId, msg.Message)
+	}
+}
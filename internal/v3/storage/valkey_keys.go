@@ -0,0 +1,114 @@
+package storagev3
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// valkeyKeys builds the names of all keys and channels used by ValkeyStorage.
+//
+// Without a prefix the legacy layout is kept:
+//
+//	client:<id>, conn:full:<id>:<ip>:<origin>, conn:records:<id>, delivered:<event id>
+//
+// With a prefix every name starts with "<prefix>:" and the client ID is wrapped in a
+// hash tag, e.g. "mainnet:client:{<id>}", so all keys of one client share a cluster slot
+// while different clients still spread over the cluster. Deployments with different
+// prefixes can share one Valkey without seeing each other's keys or messages.
+type valkeyKeys struct {
+	prefix string // "" or "<prefix>:"
+}
+
+func newValkeyKeys(prefix string) (valkeyKeys, error) {
+	prefix = strings.TrimSuffix(prefix, ":")
+	if prefix == "" {
+		return valkeyKeys{}, nil
+	}
+	if i := strings.IndexAny(prefix, "{}*?[]\\ \t\r\n"); i >= 0 {
+		return valkeyKeys{}, fmt.Errorf("invalid key prefix %q: character %q is not allowed", prefix, prefix[i])
+	}
+	return valkeyKeys{prefix: prefix + ":"}, nil
+}
+
+// tag wraps the client ID in a hash tag when a prefix is set
+func (k valkeyKeys) tag(clientID string) string {
+	if k.prefix == "" {
+		return clientID
+	}
+	return "{" + clientID + "}"
+}
+
+// untag reverses tag, reporting false for IDs not in the expected form
+func (k valkeyKeys) untag(s string) (string, bool) {
+	if k.prefix != "" {
+		if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+			return "", false
+		}
+		s = s[1 : len(s)-1]
+	}
+	return s, s != ""
+}
+
+// inbox is the sorted set of messages for a client, also used as its pub/sub channel
+func (k valkeyKeys) inbox(clientID string) string {
+	return k.prefix + "client:" + k.tag(clientID)
+}
+
+// inboxClientID returns the client ID of an inbox key or channel
+func (k valkeyKeys) inboxClientID(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, k.prefix+"client:")
+	if !ok {
+		return "", false
+	}
+	return k.untag(rest)
+}
+
+// inboxPattern matches all inbox keys, for SCAN
+func (k valkeyKeys) inboxPattern() string {
+	return k.prefix + "client:*"
+}
+
+// conn is the record of a client connection from an IP and origin
+func (k valkeyKeys) conn(clientID, ip, origin string) string {
+	return fmt.Sprintf("%sconn:full:%s:%s:%s", k.prefix, k.tag(clientID), ip, url.QueryEscape(origin))
+}
+
+// connOrigin returns the origin of a connection record key. The origin is query
+// escaped and therefore always the last colon separated part, even for IPv6 addresses.
+func (k valkeyKeys) connOrigin(key string) (string, error) {
+	if !strings.HasPrefix(key, k.prefix+"conn:full:") {
+		return "", fmt.Errorf("not a connection key")
+	}
+	return url.QueryUnescape(key[strings.LastIndex(key, ":")+1:])
+}
+
+// connRecords is the index of connection records of a client, see connRecord
+func (k valkeyKeys) connRecords(clientID string) string {
+	return k.prefix + "conn:records:" + k.tag(clientID)
+}
+
+// connIndex is the version 1 index, a set of connection record keys of a client
+func (k valkeyKeys) connIndex(clientID string) string {
+	return k.prefix + "conn:idx:" + k.tag(clientID)
+}
+
+// delivered marks a message sent to its recipient by any bridge instance
+func (k valkeyKeys) delivered(eventID int64) string {
+	return fmt.Sprintf("%sdelivered:%d", k.prefix, eventID)
+}
+
+// sweepLock is held by the instance currently sweeping expired messages
+func (k valkeyKeys) sweepLock() string {
+	return k.prefix + "bridge:expiry-sweeper"
+}
+
+// migrateLock is held by the instance currently running MigrateKeys
+func (k valkeyKeys) migrateLock() string {
+	return k.prefix + "bridge:key-migration"
+}
+
+// sweepCursor is the SCAN cursor of an unfinished sweep of a master node
+func (k valkeyKeys) sweepCursor(node string) string {
+	return k.prefix + "bridge:expiry-sweeper:cursor:" + node
+}
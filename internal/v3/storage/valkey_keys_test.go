@@ -0,0 +1,87 @@
+package storagev3
+
+import (
+	"testing"
+)
+
+func TestValkeyKeys(t *testing.T) {
+	tests := []struct {
+		prefix    string
+		wantInbox string
+		wantConn  string
+		wantIndex string
+	}{
+		{
+			prefix:    "",
+			wantInbox: "client:abc",
+			wantConn:  "conn:full:abc:2001:db8::1:https%3A%2F%2Fexample.com",
+			wantIndex: "conn:idx:abc",
+		},
+		{
+			prefix:    "mainnet",
+			wantInbox: "mainnet:client:{abc}",
+			wantConn:  "mainnet:conn:full:{abc}:2001:db8::1:https%3A%2F%2Fexample.com",
+			wantIndex: "mainnet:conn:idx:{abc}",
+		},
+		{
+			prefix:    "testnet:",
+			wantInbox: "testnet:client:{abc}",
+			wantConn:  "testnet:conn:full:{abc}:2001:db8::1:https%3A%2F%2Fexample.com",
+			wantIndex: "testnet:conn:idx:{abc}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			k, err := newValkeyKeys(tt.prefix)
+			if err != nil {
+				t.Fatalf("newValkeyKeys(%q) error = %v", tt.prefix, err)
+			}
+			if got := k.inbox("abc"); got != tt.wantInbox {
+				t.Errorf("inbox() = %q, want %q", got, tt.wantInbox)
+			}
+			if got, ok := k.inboxClientID(tt.wantInbox); !ok || got != "abc" {
+				t.Errorf("inboxClientID(%q) = %q, %v", tt.wantInbox, got, ok)
+			}
+			if got := k.conn("abc", "2001:db8::1", "https://example.com"); got != tt.wantConn {
+				t.Errorf("conn() = %q, want %q", got, tt.wantConn)
+			}
+			if got, err := k.connOrigin(tt.wantConn); err != nil || got != "https://example.com" {
+				t.Errorf("connOrigin(%q) = %q, %v", tt.wantConn, got, err)
+			}
+			if got := k.connIndex("abc"); got != tt.wantIndex {
+				t.Errorf("connIndex() = %q, want %q", got, tt.wantIndex)
+			}
+		})
+	}
+
+	if _, ok := (valkeyKeys{prefix: "mainnet:"}).inboxClientID("testnet:client:{abc}"); ok {
+		t.Error("inboxClientID() accepted a channel of another prefix")
+	}
+	for _, prefix := range []string{"{mainnet}", "main*", "main net"} {
+		if _, err := newValkeyKeys(prefix); err == nil {
+			t.Errorf("newValkeyKeys(%q) expected error", prefix)
+		}
+	}
+}
+
+func TestRenameConn(t *testing.T) {
+	legacy, _ := newValkeyKeys("")
+	mainnet, _ := newValkeyKeys("mainnet")
+
+	tests := []struct {
+		from, to valkeyKeys
+		key      string
+		want     string
+	}{
+		{legacy, mainnet, "conn:full:abc:10.0.0.1:https%3A%2F%2Fa.com", "mainnet:conn:full:{abc}:10.0.0.1:https%3A%2F%2Fa.com"},
+		{mainnet, legacy, "mainnet:conn:full:{abc}:2001:db8::1:https%3A%2F%2Fa.com", "conn:full:abc:2001:db8::1:https%3A%2F%2Fa.com"},
+	}
+	for _, tt := range tests {
+		if got, ok := renameConn(tt.from, tt.to, tt.key); !ok || got != tt.want {
+			t.Errorf("renameConn(%q) = %q, %v, want %q", tt.key, got, ok, tt.want)
+		}
+	}
+	if _, ok := renameConn(mainnet, legacy, "conn:full:abc:10.0.0.1:x"); ok {
+		t.Error("renameConn() accepted a key of another layout")
+	}
+}
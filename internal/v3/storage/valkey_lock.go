@@ -0,0 +1,67 @@
+package storagev3
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+var errLockLost = errors.New("lock expired and was taken by another instance")
+
+// valkeyLock is a lock shared by bridge instances, taken with SET NX. Only the holder
+// releases it; a holder that outlives the TTL loses the lock to the next instance.
+type valkeyLock struct {
+	client redis.UniversalClient
+	key    string
+	token  string
+}
+
+// tryLock takes the lock key for ttl, returning nil when another instance holds it.
+// ttl must be longer than the work done under the lock.
+func (s *ValkeyStorage) tryLock(ctx context.Context, key string, ttl time.Duration) (*valkeyLock, error) {
+	token := uuid.NewString()
+	acquired, err := s.client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !acquired {
+		return nil, err
+	}
+	return &valkeyLock{client: s.client, key: key, token: token}, nil
+}
+
+// release drops the lock unless it expired and another instance took it since
+func (l *valkeyLock) release(ctx context.Context) error {
+	return l.client.Watch(ctx, func(tx *redis.Tx) error {
+		token, err := tx.Get(ctx, l.key).Result()
+		if err == redis.Nil || (err == nil && token != l.token) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, l.key)
+			return nil
+		})
+		return err
+	}, l.key)
+}
+
+// refresh extends a held lock to ttl, failing when the lock was lost
+func (l *valkeyLock) refresh(ctx context.Context, ttl time.Duration) error {
+	return l.client.Watch(ctx, func(tx *redis.Tx) error {
+		token, err := tx.Get(ctx, l.key).Result()
+		if err == redis.Nil || (err == nil && token != l.token) {
+			return errLockLost
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.PExpire(ctx, l.key, ttl)
+			return nil
+		})
+		return err
+	}, l.key)
+}
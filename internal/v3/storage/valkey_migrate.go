@@ -0,0 +1,234 @@
+package storagev3
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// The migration lock is refreshed while keys are moved, so it only outlives an instance
+// that stopped mid-migration by valkeyMigrateLockTTL
+const valkeyMigrateLockTTL = time.Minute
+
+// migrationFamily is a kind of key moved by MigrateKeys
+type migrationFamily struct {
+	name    string
+	pattern func(k valkeyKeys) string
+	// rename maps a key of the from layout to the to layout
+	rename func(from, to valkeyKeys, key string) (string, bool)
+	// copy writes the value of oldKey to newKey, merging with or keeping an existing newKey
+	copy func(ctx context.Context, s *ValkeyStorage, from valkeyKeys, oldKey, newKey string) error
+}
+
+var migrationFamilies = []migrationFamily{
+	{
+		name:    "inbox",
+		pattern: func(k valkeyKeys) string { return k.inboxPattern() },
+		rename: func(from, to valkeyKeys, key string) (string, bool) {
+			clientID, ok := from.inboxClientID(key)
+			return to.inbox(clientID), ok
+		},
+		copy: copySortedSet,
+	},
+	{
+		name:    "connection",
+		pattern: func(k valkeyKeys) string { return k.prefix + "conn:full:*" },
+		rename:  renameConn,
+		copy: func(ctx context.Context, s *ValkeyStorage, _ valkeyKeys, oldKey, newKey string) error {
+			fields, err := s.client.HGetAll(ctx, oldKey).Result()
+			if err != nil || len(fields) == 0 {
+				return err
+			}
+			if n, err := s.client.Exists(ctx, newKey).Result(); err != nil || n > 0 {
+				return err
+			}
+			return s.client.HSet(ctx, newKey, fields).Err()
+		},
+	},
+	{
+		name:    "connection records",
+		pattern: func(k valkeyKeys) string { return k.prefix + "conn:records:*" },
+		rename: func(from, to valkeyKeys, key string) (string, bool) {
+			rest, ok := strings.CutPrefix(key, from.prefix+"conn:records:")
+			if !ok {
+				return "", false
+			}
+			clientID, ok := from.untag(rest)
+			return to.connRecords(clientID), ok
+		},
+		copy: copySortedSet,
+	},
+	{
+		name:    "connection index",
+		pattern: func(k valkeyKeys) string { return k.prefix + "conn:idx:*" },
+		rename: func(from, to valkeyKeys, key string) (string, bool) {
+			rest, ok := strings.CutPrefix(key, from.prefix+"conn:idx:")
+			if !ok {
+				return "", false
+			}
+			clientID, ok := from.untag(rest)
+			return to.connIndex(clientID), ok
+		},
+		copy: func(ctx context.Context, s *ValkeyStorage, from valkeyKeys, oldKey, newKey string) error {
+			members, err := s.client.SMembers(ctx, oldKey).Result()
+			if err != nil {
+				return err
+			}
+			renamed := make([]interface{}, 0, len(members))
+			for _, member := range members {
+				if newMember, ok := renameConn(from, s.keys, member); ok {
+					renamed = append(renamed, newMember)
+				}
+			}
+			if len(renamed) == 0 {
+				return nil
+			}
+			return s.client.SAdd(ctx, newKey, renamed...).Err()
+		},
+	},
+	{
+		name:    "delivered mark",
+		pattern: func(k valkeyKeys) string { return k.prefix + "delivered:*" },
+		rename: func(from, to valkeyKeys, key string) (string, bool) {
+			rest, ok := strings.CutPrefix(key, from.prefix+"delivered:")
+			if !ok {
+				return "", false
+			}
+			eventID, err := strconv.ParseInt(rest, 10, 64)
+			return to.delivered(eventID), err == nil
+		},
+		copy: func(ctx context.Context, s *ValkeyStorage, _ valkeyKeys, _, newKey string) error {
+			return s.client.SetNX(ctx, newKey, 1, 0).Err()
+		},
+	},
+}
+
+// copySortedSet merges the members of oldKey into newKey
+func copySortedSet(ctx context.Context, s *ValkeyStorage, _ valkeyKeys, oldKey, newKey string) error {
+	members, err := s.client.ZRangeWithScores(ctx, oldKey, 0, -1).Result()
+	if err != nil || len(members) == 0 {
+		return err
+	}
+	return s.client.ZAdd(ctx, newKey, members...).Err()
+}
+
+// renameConn maps a connection record key, keeping the IP and origin part as is
+func renameConn(from, to valkeyKeys, key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, from.prefix+"conn:full:")
+	if !ok {
+		return "", false
+	}
+	end := strings.Index(rest, ":")
+	if from.prefix != "" {
+		end = strings.Index(rest, "}:") + 1
+	}
+	if end <= 0 {
+		return "", false
+	}
+	clientID, ok := from.untag(rest[:end])
+	return to.prefix + "conn:full:" + to.tag(clientID) + rest[end:], ok
+}
+
+// MigrateKeys moves the keys written under another key prefix to the prefix of this
+// storage (VALKEY_KEY_PREFIX); an empty from is the legacy layout without a prefix.
+// Keys keep their TTL and version 1 connection indexes are rewritten to the moved records.
+// Inboxes present under both prefixes are merged, other keys already present under
+// the new prefix win. Messages published under the old prefix after the scan are not
+// moved, so run it once every instance uses the new prefix. Instances take a lock, so
+// when several start with VALKEY_MIGRATE_KEYS only one migrates and the others skip it.
+// Returns the number of keys moved.
+func (s *ValkeyStorage) MigrateKeys(ctx context.Context, from string) (int, error) {
+	log := log.WithField("prefix", "ValkeyStorage.MigrateKeys")
+
+	old, err := newValkeyKeys(from)
+	if err != nil {
+		return 0, err
+	}
+	if old == s.keys {
+		return 0, nil
+	}
+
+	lock, err := s.tryLock(ctx, s.keys.migrateLock(), valkeyMigrateLockTTL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	if lock == nil {
+		log.Info("another instance is migrating keys, skipping")
+		return 0, nil
+	}
+	defer func() {
+		if err := lock.release(context.Background()); err != nil {
+			log.Warnf("failed to release migration lock: %v", err)
+		}
+	}()
+	refreshed := time.Now()
+
+	moved := 0
+	for _, family := range migrationFamilies {
+		err := s.forEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			iter := node.Scan(ctx, 0, family.pattern(old), 1000).Iterator()
+			for iter.Next(ctx) {
+				key := iter.Val()
+				// The old pattern may also match keys already in the new layout
+				if _, ok := family.rename(s.keys, s.keys, key); ok {
+					continue
+				}
+				newKey, ok := family.rename(old, s.keys, key)
+				if !ok {
+					continue
+				}
+				if time.Since(refreshed) > valkeyMigrateLockTTL/3 {
+					if err := lock.refresh(ctx, valkeyMigrateLockTTL); err != nil {
+						return fmt.Errorf("failed to refresh migration lock: %w", err)
+					}
+					refreshed = time.Now()
+				}
+				if err := s.moveKey(ctx, family, old, key, newKey); err != nil {
+					return fmt.Errorf("failed to move %s %s: %w", family.name, key, err)
+				}
+				moved++
+			}
+			return iter.Err()
+		})
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	log.Infof("moved %d keys from prefix %q to %q", moved, old.prefix, s.keys.prefix)
+	return moved, nil
+}
+
+// moveKey copies a key to its new name, extends the TTL of the copy to the one of the
+// original and deletes the original. Keys of both layouts are in different cluster
+// slots, so they cannot be renamed.
+func (s *ValkeyStorage) moveKey(ctx context.Context, family migrationFamily, from valkeyKeys, oldKey, newKey string) error {
+	ttl, err := s.client.PTTL(ctx, oldKey).Result()
+	if err != nil {
+		return err
+	}
+	if ttl == -2 {
+		return nil // expired meanwhile
+	}
+	if err := family.copy(ctx, s, from, oldKey, newKey); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		newTTL, err := s.client.PTTL(ctx, newKey).Result()
+		if err != nil {
+			return err
+		}
+		// Copies that just created the key have no TTL yet (-1)
+		if newTTL < ttl {
+			if err := s.client.PExpire(ctx, newKey, ttl).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return s.client.Del(ctx, oldKey).Err()
+}
@@ -0,0 +1,298 @@
+package storagev3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+// valkeyRemovalPrefix starts the pub/sub payloads that announce messages removed from
+// an inbox, followed by their comma-separated event IDs. Messages are JSON objects.
+const valkeyRemovalPrefix = "removed:"
+
+// inboxKeyTTLSlack keeps an inbox key this many seconds longer than its newest message,
+// so the key does not expire before the expiry sweep reported the message
+const inboxKeyTTLSlack = 60
+
+// publishScript applies the inbox quota, stores a message in the client's sorted set,
+// refreshes the key expiry and publishes the message, all in one atomic step.
+// The channel name equals the key, so SPUBLISH stays within the key's slot.
+// The set is scored by expiry, so evicting reads the event IDs from the members
+// and drops the oldest messages first, announcing them like Ack does. Inbox bytes
+// are only counted when a byte limit is set and are reported as -1 otherwise.
+//
+//	KEYS[1] - inbox key, see valkeyKeys
+//	ARGV[1] - message, ARGV[2] - expire at (unix seconds), ARGV[3] - key TTL (seconds)
+//	ARGV[4] - PUBLISH or SPUBLISH
+//	ARGV[5] - max messages, ARGV[6] - max bytes (0 disables), ARGV[7] - reject or evict
+//	ARGV[8] - valkeyRemovalPrefix
+//
+// Returns {evicted, messages, bytes}; evicted is -1 when the message was rejected.
+var publishScript = redis.NewScript(`
+local maxCount = tonumber(ARGV[5])
+local maxBytes = tonumber(ARGV[6])
+local size = string.len(ARGV[1])
+
+local count = redis.call('ZCARD', KEYS[1])
+local members = nil
+local bytes = -1
+if maxBytes > 0 then
+	bytes = 0
+	members = redis.call('ZRANGE', KEYS[1], 0, -1)
+	for _, m in ipairs(members) do
+		bytes = bytes + string.len(m)
+	end
+end
+
+local evicted = 0
+local queue = nil
+while (maxCount > 0 and count + 1 > maxCount) or (maxBytes > 0 and bytes + size > maxBytes) do
+	if ARGV[7] ~= 'evict' or count == 0 then
+		return {-1, count, bytes}
+	end
+	if queue == nil then
+		queue = {}
+		for _, m in ipairs(members or redis.call('ZRANGE', KEYS[1], 0, -1)) do
+			local ok, decoded = pcall(cjson.decode, m)
+			local id = 0
+			if ok and type(decoded) == 'table' and type(decoded['EventId']) == 'number' then
+				id = decoded['EventId']
+			end
+			queue[#queue + 1] = {id, m}
+		end
+		table.sort(queue, function(a, b) return a[1] < b[1] end)
+	end
+	local oldest = queue[evicted + 1][2]
+	redis.call('ZREM', KEYS[1], oldest)
+	count = count - 1
+	if maxBytes > 0 then
+		bytes = bytes - string.len(oldest)
+	end
+	evicted = evicted + 1
+end
+if evicted > 0 then
+	local ids = {}
+	for i = 1, evicted do
+		ids[i] = string.format('%.0f', queue[i][1])
+	end
+	redis.call(ARGV[4], KEYS[1], ARGV[8] .. table.concat(ids, ','))
+end
+
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call(ARGV[4], KEYS[1], ARGV[1])
+if bytes >= 0 then
+	bytes = bytes + size
+end
+return {evicted, count + 1, bytes}
+`)
+
+// loadPublishScript preloads the publish script so Pub can call it by SHA.
+// Loading goes to every master in cluster mode.
+func (s *ValkeyStorage) loadPublishScript(ctx context.Context) {
+	log := log.WithField("prefix", "ValkeyStorage.loadPublishScript")
+
+	err := publishScript.Load(ctx, s.client).Err()
+	if err == nil {
+		return
+	}
+	if isScriptingUnavailable(err) {
+		s.scriptingDisabled.Store(true)
+		log.Warnf("scripting is not available, publishing with MULTI/EXEC: %v", err)
+		return
+	}
+	// Pub reloads the script on NOSCRIPT
+	log.Warnf("failed to preload publish script: %v", err)
+}
+
+// storeAndPublish atomically applies the inbox quota, adds the message to the sorted set,
+// sets the key expiry and publishes it. It uses EVALSHA (reloading the script on NOSCRIPT)
+// and MULTI/EXEC when the server does not allow scripts.
+// Returns ErrInboxFull when the quota rejects the message.
+func (s *ValkeyStorage) storeAndPublish(ctx context.Context, channel string, data []byte, expireAt int64, keyTTL int64) error {
+	if !s.scriptingDisabled.Load() {
+		res, err := publishScript.Run(ctx, s.client, []string{channel}, s.publishArgs(data, expireAt, keyTTL)...).Int64Slice()
+		if err == nil {
+			return publishResult(res)
+		}
+		if !isScriptingUnavailable(err) {
+			return err
+		}
+		s.scriptingDisabled.Store(true)
+		log.WithField("prefix", "ValkeyStorage.storeAndPublish").Warnf("scripting is not available, publishing with MULTI/EXEC: %v", err)
+	}
+
+	// Without scripts the quota is checked before the transaction, so concurrent
+	// publishes to the same inbox may briefly exceed it
+	var evicted []string
+	count := -1
+	bytes := int64(-1)
+	if s.quota.Enabled() {
+		members, err := s.client.ZRange(ctx, channel, 0, -1).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		sortByEventID(members)
+		sizes := make([]int64, len(members))
+		bytes = 0
+		for i, m := range members {
+			sizes[i] = int64(len(m))
+			bytes += sizes[i]
+		}
+		evict, err := s.quota.fit(sizes, int64(len(data)))
+		if err != nil {
+			return rejectInbox()
+		}
+		evicted = members[:evict]
+		for _, m := range evicted {
+			bytes -= int64(len(m))
+		}
+		count = len(members) - evict + 1
+		bytes += int64(len(data))
+	}
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		evictedIDs := make([]int64, len(evicted))
+		for i, m := range evicted {
+			pipe.ZRem(ctx, channel, m)
+			var msg models.SseMessage
+			if err := json.Unmarshal([]byte(m), &msg); err == nil {
+				evictedIDs[i] = msg.EventId
+			}
+		}
+		if len(evicted) > 0 {
+			removal := valkeyRemovalPayload(evictedIDs)
+			if s.cluster != nil {
+				pipe.SPublish(ctx, channel, removal)
+			} else {
+				pipe.Publish(ctx, channel, removal)
+			}
+		}
+		pipe.ZAdd(ctx, channel, redis.Z{Score: float64(expireAt), Member: data})
+		pipe.Expire(ctx, channel, time.Duration(keyTTL)*time.Second)
+		if s.cluster != nil {
+			pipe.SPublish(ctx, channel, data)
+		} else {
+			pipe.Publish(ctx, channel, data)
+		}
+		return nil
+	})
+	if err == nil && count >= 0 {
+		observeInbox(count, bytes, len(evicted))
+	}
+	return err
+}
+
+// PubBatch publishes messages with the publish script in one pipeline, see BatchPublisher.
+// In cluster mode the pipeline is split by node. Messages whose script call fails because
+// the script is not loaded or scripting is unavailable are retried with storeAndPublish.
+func (s *ValkeyStorage) PubBatch(ctx context.Context, messages []BatchMessage) []error {
+	log := log.WithField("prefix", "ValkeyStorage.PubBatch")
+
+	errs := make([]error, len(messages))
+	channels := make([]string, len(messages))
+	data := make([][]byte, len(messages))
+	expireAts := make([]int64, len(messages))
+	now := time.Now()
+	for i, m := range messages {
+		channels[i] = s.keys.inbox(m.Message.To)
+		expireAts[i] = now.Add(time.Duration(m.TTL) * time.Second).Unix()
+		m.Message.ExpireAt = expireAts[i]
+		encoded, err := json.Marshal(m.Message)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to marshal message: %w", err)
+			continue
+		}
+		data[i] = encoded
+	}
+
+	cmds := make([]*redis.Cmd, len(messages))
+	if !s.scriptingDisabled.Load() {
+		pipe := s.client.Pipeline()
+		for i, m := range messages {
+			if errs[i] == nil {
+				cmds[i] = publishScript.EvalSha(ctx, pipe, []string{channels[i]}, s.publishArgs(data[i], expireAts[i], m.TTL+inboxKeyTTLSlack)...)
+			}
+		}
+		// Errors are checked per command below
+		_, _ = pipe.Exec(ctx)
+	}
+
+	for i, m := range messages {
+		if errs[i] != nil {
+			continue
+		}
+		var err error
+		if cmds[i] != nil {
+			var res []int64
+			res, err = cmds[i].Int64Slice()
+			if err == nil {
+				err = publishResult(res)
+			}
+		}
+		if cmds[i] == nil || redis.HasErrorPrefix(err, "NOSCRIPT") || isScriptingUnavailable(err) {
+			err = s.storeAndPublish(ctx, channels[i], data[i], expireAts[i], m.TTL+inboxKeyTTLSlack)
+		}
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to publish message to channel %s: %w", channels[i], err)
+		}
+	}
+
+	log.Debugf("published a batch of %d messages", len(messages))
+	return errs
+}
+
+// sortByEventID orders inbox members oldest first, as the quota evicts them.
+// Members that fail to decode sort first.
+func sortByEventID(members []string) {
+	ids := make(map[string]int64, len(members))
+	for _, m := range members {
+		var msg models.SseMessage
+		if err := json.Unmarshal([]byte(m), &msg); err == nil {
+			ids[m] = msg.EventId
+		}
+	}
+	sort.SliceStable(members, func(i, j int) bool { return ids[members[i]] < ids[members[j]] })
+}
+
+// publishCommand is the command scripts publish on the inbox channel with
+func (s *ValkeyStorage) publishCommand() string {
+	if s.cluster != nil {
+		// SPUBLISH keeps the message within the shard owning the channel
+		return "SPUBLISH"
+	}
+	return "PUBLISH"
+}
+
+// publishArgs are the ARGV of publishScript
+func (s *ValkeyStorage) publishArgs(data []byte, expireAt int64, keyTTL int64) []interface{} {
+	return []interface{}{data, expireAt, keyTTL, s.publishCommand(), s.quota.MaxMessages, s.quota.MaxBytes, s.quota.policy(), valkeyRemovalPrefix}
+}
+
+// publishResult interprets the reply of publishScript
+func publishResult(res []int64) error {
+	if res[0] < 0 {
+		return rejectInbox()
+	}
+	observeInbox(int(res[1]), res[2], int(res[0]))
+	return nil
+}
+
+// isScriptingUnavailable reports whether err means the server refuses scripts,
+// e.g. EVAL/EVALSHA are renamed, disabled or denied by ACL
+func isScriptingUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unknown command") ||
+		strings.HasPrefix(msg, "noperm") ||
+		strings.Contains(msg, "scripting is disabled")
+}
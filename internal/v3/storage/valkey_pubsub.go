@@ -0,0 +1,350 @@
+package storagev3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"github.com/ton-connect/bridge/internal/models"
+)
+
+const (
+	// pubSubPingInterval is how long a pub/sub connection may stay silent before it is pinged.
+	// A connection that does not answer the ping within another interval is replaced.
+	pubSubPingInterval = 15 * time.Second
+	pubSubMinBackoff   = 100 * time.Millisecond
+	pubSubMaxBackoff   = 10 * time.Second
+	catchUpTimeout     = 10 * time.Second
+)
+
+// pubSubLink is the state of one pub/sub connection as seen by its receive loop
+type pubSubLink struct {
+	name string
+	up   atomic.Bool
+}
+
+func newPubSubLink(name string) *pubSubLink {
+	link := &pubSubLink{name: name}
+	link.up.Store(true)
+	return link
+}
+
+// catchUpQueue collects subscribers of keys resubscribed after a reconnect; one worker
+// replays them. The queue holds the replay gate of every subscriber channel in pending
+// until its catch-up is sent, so live messages cannot advance the cursors past the
+// messages missed during the outage.
+type catchUpQueue struct {
+	mu      sync.Mutex
+	pending map[chan<- models.SseMessage][]string // keys to replay per subscriber channel
+	running bool
+}
+
+// receive runs the receive loop of a pub/sub connection until it is closed.
+// Broken connections are re-established by go-redis, which subscribes to the
+// tracked channels again; the unsolicited confirmations trigger a catch-up replay
+// (see confirm). Connections that stop answering pings are replaced with restart.
+func (s *ValkeyStorage) receive(link *pubSubLink, pubSub *redis.PubSub, restart func(old *redis.PubSub), handle func(msg interface{})) {
+	log := log.WithField("prefix", "ValkeyStorage.receive").WithField("link", link.name)
+	ctx := context.Background()
+
+	backoff := pubSubMinBackoff
+	awaitingPong := false
+	for {
+		msg, err := pubSub.ReceiveTimeout(ctx, pubSubPingInterval)
+		if err == nil {
+			if !link.up.Swap(true) {
+				log.Info("pub/sub connection restored")
+			}
+			backoff = pubSubMinBackoff
+			awaitingPong = false
+			handle(msg)
+			continue
+		}
+		if errors.Is(err, redis.ErrClosed) {
+			return
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if awaitingPong {
+				link.up.Store(false)
+				log.Warn("pub/sub connection does not answer pings, replacing it")
+				restart(pubSub)
+				return
+			}
+			awaitingPong = true
+			if err = pubSub.Ping(ctx); err == nil {
+				continue
+			}
+		}
+
+		if link.up.Swap(false) {
+			log.Warnf("pub/sub connection lost: %v", err)
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, pubSubMaxBackoff)
+	}
+}
+
+// startPubSub opens the classic pub/sub connection subscribed to the channels.
+// Should be called with subMutex locked
+func (s *ValkeyStorage) startPubSub(ctx context.Context, channels []string) {
+	pubSub := s.client.Subscribe(ctx, channels...)
+	s.pubSubConn = pubSub
+	if s.pubSubLink == nil {
+		s.pubSubLink = newPubSubLink("pubsub")
+	}
+	go s.receive(s.pubSubLink, pubSub, s.restartPubSub, s.handlePubSub)
+}
+
+// restartPubSub replaces the classic pub/sub connection with a new one subscribed to all wanted channels
+func (s *ValkeyStorage) restartPubSub(old *redis.PubSub) {
+	s.subMutex.Lock()
+	if s.pubSubConn != old {
+		s.subMutex.Unlock()
+		return
+	}
+	s.startPubSub(context.Background(), s.wantedChannels())
+	s.subMutex.Unlock()
+
+	_ = old.Close()
+}
+
+// restartShard replaces a shard connection with a new one subscribed to the shard's channels
+func (s *ValkeyStorage) restartShard(shard *pubSubShard, old *redis.PubSub) {
+	s.subMutex.Lock()
+	if s.shards[shard.addr] != shard || shard.pubSub != old {
+		s.subMutex.Unlock()
+		return
+	}
+	channels := make([]string, 0, len(shard.channels))
+	for channel := range shard.channels {
+		channels = append(channels, channel)
+	}
+	shard.pubSub = s.cluster.SSubscribe(context.Background(), channels...)
+	go s.receive(shard.link, shard.pubSub, func(old *redis.PubSub) { s.restartShard(shard, old) }, s.handleShard(shard))
+	s.subMutex.Unlock()
+
+	_ = old.Close()
+}
+
+// wantedChannels lists the channels of keys with local subscribers.
+// Should be called with subMutex locked
+func (s *ValkeyStorage) wantedChannels() []string {
+	channels := make([]string, 0, len(s.subscribers))
+	for key := range s.subscribers {
+		channels = append(channels, s.keys.inbox(key))
+	}
+	return channels
+}
+
+// pubSubHealth reports an error when a pub/sub connection is down
+func (s *ValkeyStorage) pubSubHealth() error {
+	s.subMutex.RLock()
+	defer s.subMutex.RUnlock()
+
+	if s.pubSubLink != nil && !s.pubSubLink.up.Load() {
+		return fmt.Errorf("pub/sub connection is down")
+	}
+	for addr, shard := range s.shards {
+		if !shard.link.up.Load() {
+			return fmt.Errorf("pub/sub connection to shard %s is down", addr)
+		}
+	}
+	return nil
+}
+
+// syncPubSub waits until the pub/sub connections of the channels have handled every
+// message published before the call. A message stored before the history was read may
+// still be on its way to the receive loop; releasing the replay gate before it arrives
+// would deliver it twice. Servers answer a PING after the pushes queued before it, so
+// the pong marks the point where nothing older is in flight.
+func (s *ValkeyStorage) syncPubSub(ctx context.Context, channels []string) error {
+	s.subMutex.RLock()
+	conns := make([]*redis.PubSub, 0, 1)
+	if s.cluster == nil {
+		if s.pubSubConn != nil {
+			conns = append(conns, s.pubSubConn)
+		}
+	} else {
+		for _, channel := range channels {
+			if shard, ok := s.channelShards[channel]; ok && !slices.Contains(conns, shard.pubSub) {
+				conns = append(conns, shard.pubSub)
+			}
+		}
+	}
+	s.subMutex.RUnlock()
+
+	waiters := make([]chan struct{}, len(conns))
+	for i, pubSub := range conns {
+		token := fmt.Sprintf("sync:%d", s.pingSeq.Add(1))
+		waiters[i] = make(chan struct{})
+		s.confirmMutex.Lock()
+		s.pongs[token] = waiters[i]
+		s.confirmMutex.Unlock()
+		defer func() {
+			s.confirmMutex.Lock()
+			delete(s.pongs, token)
+			s.confirmMutex.Unlock()
+		}()
+
+		if err := pubSub.Ping(ctx, token); err != nil {
+			return fmt.Errorf("failed to ping pub/sub connection: %w", err)
+		}
+	}
+
+	timeout := time.NewTimer(5 * time.Second)
+	defer timeout.Stop()
+	for _, w := range waiters {
+		select {
+		case <-w:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("timed out waiting for pong")
+		}
+	}
+	return nil
+}
+
+// pong releases the waiter of a sync ping
+func (s *ValkeyStorage) pong(payload string) {
+	s.confirmMutex.Lock()
+	defer s.confirmMutex.Unlock()
+
+	if w, ok := s.pongs[payload]; ok {
+		close(w)
+		delete(s.pongs, payload)
+	}
+}
+
+// requestCatchUp queues a replay for the subscribers of a key whose channel was resubscribed
+// after the connection was lost, since messages published meanwhile were not received.
+// The replay gates of the subscribers are opened right away.
+func (s *ValkeyStorage) requestCatchUp(key string) {
+	s.subMutex.RLock()
+	defer s.subMutex.RUnlock()
+
+	q := &s.catchUps
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, ch := range s.subscribers[key] {
+		if keys, queued := q.pending[ch]; queued {
+			if !slices.Contains(keys, key) {
+				q.pending[ch] = append(keys, key)
+			}
+			continue
+		}
+		// Subscribers still in Sub read the history after their subscription is confirmed
+		if s.replay.tryOpen(ch) {
+			q.pending[ch] = []string{key}
+		}
+	}
+	if len(q.pending) > 0 && !q.running {
+		q.running = true
+		go s.runCatchUps()
+	}
+}
+
+// runCatchUps replays queued subscribers until the queue is empty
+func (s *ValkeyStorage) runCatchUps() {
+	q := &s.catchUps
+	for {
+		q.mu.Lock()
+		subscribers := make(map[chan<- models.SseMessage][]string)
+		for ch, keys := range q.pending {
+			if len(keys) > 0 {
+				subscribers[ch] = keys
+				// The entry stays while the catch-up runs, the queue still holds the gate
+				q.pending[ch] = nil
+			}
+		}
+		if len(subscribers) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+
+		s.catchUp(subscribers)
+	}
+}
+
+// catchUp sends each subscriber the stored messages of its keys after the last event ID
+// it got of that key, followed by the live messages held back since the resubscription
+func (s *ValkeyStorage) catchUp(subscribers map[chan<- models.SseMessage][]string) {
+	log := log.WithField("prefix", "ValkeyStorage.catchUp")
+	ctx, cancel := context.WithTimeout(context.Background(), catchUpTimeout)
+	defer cancel()
+
+	var keys, channels []string
+	for _, chKeys := range subscribers {
+		for _, key := range chKeys {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+				channels = append(channels, s.keys.inbox(key))
+			}
+		}
+	}
+	history := s.loadHistory(ctx, keys)
+	if err := s.syncPubSub(ctx, channels); err != nil {
+		log.Warnf("pub/sub for %v not synced before releasing live messages: %v", keys, err)
+	}
+	byKey := make(map[string][]models.SseMessage)
+	for _, msg := range history {
+		byKey[msg.To] = append(byKey[msg.To], msg)
+	}
+
+	q := &s.catchUps
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	for ch, chKeys := range subscribers {
+		q.mu.Lock()
+		if requeued := q.pending[ch]; len(requeued) > 0 {
+			// Another key of the channel was resubscribed meanwhile: keep the gate
+			// and replay all of them in the next round
+			for _, key := range chKeys {
+				if !slices.Contains(requeued, key) {
+					requeued = append(requeued, key)
+				}
+			}
+			q.pending[ch] = requeued
+			q.mu.Unlock()
+			continue
+		}
+		delete(q.pending, ch)
+		buffered := s.replay.release(ch)
+		q.mu.Unlock()
+
+		var missedMsgs []models.SseMessage
+		subscribed := false
+		for _, key := range chKeys {
+			if !slices.Contains(s.subscribers[key], ch) {
+				continue
+			}
+			subscribed = true
+			cursor := s.cursors.get(ch, key)
+			for _, msg := range byKey[key] {
+				if msg.EventId > cursor {
+					missedMsgs = append(missedMsgs, msg)
+				}
+			}
+		}
+		if !subscribed {
+			// Unsubscribed meanwhile, the channel may be closed already
+			continue
+		}
+		replayHistory(ch, missedMsgs, buffered, 0)
+		s.cursors.advance(ch, missedMsgs...)
+		s.cursors.advance(ch, buffered...)
+	}
+
+	log.Debugf("replayed %d stored messages of %v to %d subscribers after resubscription", len(history), keys, len(subscribers))
+}
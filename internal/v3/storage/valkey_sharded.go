@@ -0,0 +1,158 @@
+package storagev3
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// pubSubShard is one SSUBSCRIBE connection serving all channels owned by a single cluster shard
+type pubSubShard struct {
+	addr     string
+	pubSub   *redis.PubSub
+	link     *pubSubLink
+	channels map[string]struct{}
+}
+
+// shardAddr returns the address of the master that currently owns the channel's slot
+func (s *ValkeyStorage) shardAddr(ctx context.Context, channel string) (string, error) {
+	master, err := s.cluster.MasterForKey(ctx, channel)
+	if err != nil {
+		return "", err
+	}
+	return master.Options().Addr, nil
+}
+
+// sSubscribe sends SSUBSCRIBE for the channels, opening one connection per shard.
+// Should be called with subMutex locked
+func (s *ValkeyStorage) sSubscribe(ctx context.Context, channels []string) error {
+	groups := make(map[string][]string)
+	for _, channel := range channels {
+		if shard, exists := s.channelShards[channel]; exists {
+			groups[shard.addr] = append(groups[shard.addr], channel)
+			continue
+		}
+		addr, err := s.shardAddr(ctx, channel)
+		if err != nil {
+			return fmt.Errorf("failed to resolve shard for channel %s: %w", channel, err)
+		}
+		groups[addr] = append(groups[addr], channel)
+	}
+
+	for addr, group := range groups {
+		shard, exists := s.shards[addr]
+		if !exists {
+			shard = &pubSubShard{
+				addr:     addr,
+				pubSub:   s.cluster.SSubscribe(ctx),
+				link:     newPubSubLink("shard " + addr),
+				channels: make(map[string]struct{}),
+			}
+			s.shards[addr] = shard
+			go s.receive(shard.link, shard.pubSub, func(old *redis.PubSub) { s.restartShard(shard, old) }, s.handleShard(shard))
+		}
+		if err := shard.pubSub.SSubscribe(ctx, group...); err != nil {
+			return fmt.Errorf("failed to subscribe to shard %s: %w", addr, err)
+		}
+		for _, channel := range group {
+			shard.channels[channel] = struct{}{}
+			s.channelShards[channel] = shard
+		}
+	}
+	return nil
+}
+
+// sUnsubscribe drops sharded subscriptions and closes shard connections left without channels.
+// Should be called with subMutex locked
+func (s *ValkeyStorage) sUnsubscribe(ctx context.Context, channels []string) error {
+	groups := make(map[*pubSubShard][]string)
+	for _, channel := range channels {
+		shard, exists := s.channelShards[channel]
+		if !exists {
+			continue
+		}
+		delete(s.channelShards, channel)
+		delete(shard.channels, channel)
+		groups[shard] = append(groups[shard], channel)
+	}
+
+	var firstErr error
+	for shard, group := range groups {
+		var err error
+		if len(shard.channels) == 0 {
+			delete(s.shards, shard.addr)
+			err = shard.pubSub.Close()
+		} else {
+			err = shard.pubSub.SUnsubscribe(ctx, group...)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to unsubscribe from shard %s: %w", shard.addr, err)
+		}
+	}
+	return firstErr
+}
+
+// handleShard returns the message handler of a single shard connection. The server sends an
+// unsolicited sunsubscribe when a channel's slot migrates to another shard; such
+// channels are moved to the connection of their new owner.
+func (s *ValkeyStorage) handleShard(shard *pubSubShard) func(msg interface{}) {
+	log := log.WithField("prefix", "ValkeyStorage.handleShard").WithField("shard", shard.addr)
+
+	return func(msg interface{}) {
+		switch m := msg.(type) {
+		case *redis.Message:
+			s.dispatch(m.Channel, m.Payload)
+		case *redis.Pong:
+			s.pong(m.Payload)
+		case *redis.Subscription:
+			if m.Kind == "ssubscribe" {
+				s.confirm(m.Channel)
+				return
+			}
+			if m.Kind != "sunsubscribe" {
+				return
+			}
+			s.subMutex.RLock()
+			_, stillWanted := shard.channels[m.Channel]
+			s.subMutex.RUnlock()
+			if stillWanted {
+				log.Infof("channel %s left the shard, resubscribing", m.Channel)
+				go s.resubscribeMigrated(shard, m.Channel)
+			}
+		}
+	}
+}
+
+// resubscribeMigrated moves a channel whose slot migrated to the connection of its new shard
+func (s *ValkeyStorage) resubscribeMigrated(old *pubSubShard, channel string) {
+	log := log.WithField("prefix", "ValkeyStorage.resubscribeMigrated")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Cluster state reload is lazy, so give it a few chances to observe the new owner
+	s.cluster.ReloadState(ctx)
+	for attempt := 0; attempt < 5; attempt++ {
+		addr, err := s.shardAddr(ctx, channel)
+		if err == nil && addr != old.addr {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+
+	if s.channelShards[channel] != old {
+		// Unsubscribed or already moved meanwhile
+		return
+	}
+	if err := s.sUnsubscribe(ctx, []string{channel}); err != nil {
+		log.Warnf("failed to drop migrated channel %s: %v", channel, err)
+	}
+	if err := s.sSubscribe(ctx, []string{channel}); err != nil {
+		log.Errorf("failed to resubscribe migrated channel %s: %v", channel, err)
+	}
+}